@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/joho/godotenv"
+	"github.com/web-stuff-98/electron-social-chat/pkg/db"
+	"github.com/web-stuff-98/electron-social-chat/pkg/db/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	Moves messages out of the old embedded arrays (room_channel_messages.messages
+	and user_messaging_data.messages) into the room_messages and direct_messages
+	collections. Message IDs are kept, so attachments stay linked to their messages.
+
+	Messages are upserted by ID and the embedded data is only removed after it
+	has been copied, so it is safe to run again if it gets interrupted.
+
+	Run from the server directory: go run ./cmd/migratemessages
+*/
+
+type legacyRoomChannelMessages struct {
+	ID       primitive.ObjectID          `bson:"_id"`
+	Messages []models.RoomChannelMessage `bson:"messages"`
+}
+
+type legacyUserMessagingData struct {
+	ID       primitive.ObjectID     `bson:"_id"`
+	Messages []models.DirectMessage `bson:"messages"`
+}
+
+func main() {
+	if err := godotenv.Load(); err != nil {
+		log.Fatal("Error loading .env file:", err)
+	}
+
+	DB, colls := db.Init()
+
+	channels, err := migrateRoomMessages(DB, colls)
+	if err != nil {
+		log.Fatal("Error migrating room messages:", err)
+	}
+	log.Printf("Migrated messages from %d room channels\n", channels)
+
+	users, err := migrateDirectMessages(colls)
+	if err != nil {
+		log.Fatal("Error migrating direct messages:", err)
+	}
+	log.Printf("Migrated messages from %d inboxes\n", users)
+}
+
+func migrateRoomMessages(DB *mongo.Database, colls *db.Collections) (int, error) {
+	legacyColl := DB.Collection("room_channel_messages")
+	cursor, err := legacyColl.Find(context.Background(), bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(context.Background())
+
+	count := 0
+	for cursor.Next(context.Background()) {
+		legacy := &legacyRoomChannelMessages{}
+		if err := cursor.Decode(&legacy); err != nil {
+			return count, err
+		}
+		writes := []mongo.WriteModel{}
+		for _, rcm := range legacy.Messages {
+			rcm.ChannelID = legacy.ID
+			writes = append(writes, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": rcm.ID}).SetReplacement(rcm).SetUpsert(true))
+		}
+		if len(writes) > 0 {
+			if _, err := colls.RoomMessageCollection.BulkWrite(context.Background(), writes, options.BulkWrite().SetOrdered(false)); err != nil {
+				return count, err
+			}
+		}
+		if _, err := legacyColl.DeleteOne(context.Background(), bson.M{"_id": legacy.ID}); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, cursor.Err()
+}
+
+// Direct messages were stored in the recipients messaging data
+func migrateDirectMessages(colls *db.Collections) (int, error) {
+	cursor, err := colls.UserMessagingDataCollection.Find(context.Background(), bson.M{"messages": bson.M{"$exists": true}})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(context.Background())
+
+	count := 0
+	for cursor.Next(context.Background()) {
+		legacy := &legacyUserMessagingData{}
+		if err := cursor.Decode(&legacy); err != nil {
+			return count, err
+		}
+		writes := []mongo.WriteModel{}
+		for _, dm := range legacy.Messages {
+			dm.Recipient = legacy.ID
+			writes = append(writes, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": dm.ID}).SetReplacement(dm).SetUpsert(true))
+		}
+		if len(writes) > 0 {
+			if _, err := colls.DirectMessageCollection.BulkWrite(context.Background(), writes, options.BulkWrite().SetOrdered(false)); err != nil {
+				return count, err
+			}
+		}
+		if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), legacy.ID, bson.M{
+			"$unset": bson.M{"messages": ""},
+		}); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, cursor.Err()
+}
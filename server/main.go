@@ -14,8 +14,14 @@ import (
 	"github.com/web-stuff-98/electron-social-chat/pkg/changestreams"
 	"github.com/web-stuff-98/electron-social-chat/pkg/db"
 	"github.com/web-stuff-98/electron-social-chat/pkg/handlers"
+	"github.com/web-stuff-98/electron-social-chat/pkg/linkpreviewserver"
+	"github.com/web-stuff-98/electron-social-chat/pkg/messagescheduler"
+	"github.com/web-stuff-98/electron-social-chat/pkg/moderationsweeper"
+	"github.com/web-stuff-98/electron-social-chat/pkg/pollcloser"
 	rdb "github.com/web-stuff-98/electron-social-chat/pkg/redis"
+	"github.com/web-stuff-98/electron-social-chat/pkg/roomcallserver"
 	"github.com/web-stuff-98/electron-social-chat/pkg/socketserver"
+	"github.com/web-stuff-98/electron-social-chat/pkg/typingserver"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -30,15 +36,23 @@ func main() {
 	redis := rdb.Init()
 
 	disconnectCallChan := make(chan primitive.ObjectID)
-	socketServer, err := socketserver.Init(colls, disconnectCallChan)
+	disconnectRoomCallChan := make(chan primitive.ObjectID)
+	socketServer, err := socketserver.Init(colls, disconnectCallChan, disconnectRoomCallChan)
 	if err != nil {
 		log.Fatal("Error setting up socket server: ", err)
 	}
 
-	callServer := callserver.Init(socketServer, disconnectCallChan)
+	callServer := callserver.Init(socketServer, colls, disconnectCallChan)
+	roomCallServer := roomcallserver.Init(socketServer, disconnectRoomCallChan)
 	attachmentServer := attachmentserver.Init(socketServer, colls)
+	moderationsweeper.Init(socketServer, colls)
+	pollcloser.Init(socketServer, colls)
+	typingServer := typingserver.Init(socketServer)
+	linkPreviewServer := linkpreviewserver.Init(socketServer, colls)
 
-	h := handlers.New(DB, colls, redis, socketServer, attachmentServer, callServer)
+	messagescheduler.Init(socketServer, colls, handlers.DeliverScheduledMessage(socketServer, linkPreviewServer, colls))
+
+	h := handlers.New(DB, colls, redis, socketServer, attachmentServer, callServer, roomCallServer, typingServer, linkPreviewServer)
 
 	var origins []string
 	if os.Getenv("PRODUCTION") == "true" {
@@ -62,7 +76,13 @@ func main() {
 	api.HandleFunc("/acc/delete", h.DeleteAccount).Methods(http.MethodDelete)
 	api.HandleFunc("/acc/pfp", h.UploadPfp).Methods(http.MethodPost)
 	api.HandleFunc("/acc/conversation/{uid}", h.GetConversation).Methods(http.MethodGet)
+	api.HandleFunc("/acc/conversation/{uid}/thread/{id}", h.GetConversationThread).Methods(http.MethodGet)
+	api.HandleFunc("/acc/conversation/{uid}/revisions/{id}", h.GetDirectMessageRevisions).Methods(http.MethodGet)
+	api.HandleFunc("/acc/conversation/{uid}/pins", h.GetConversationPins).Methods(http.MethodGet)
 	api.HandleFunc("/acc/conversations", h.GetConversations).Methods(http.MethodGet)
+	api.HandleFunc("/acc/conversations/search", h.SearchDirectMessages).Methods(http.MethodPost)
+	api.HandleFunc("/acc/calls/{page}", h.GetCallHistory).Methods(http.MethodGet)
+	api.HandleFunc("/acc/scheduled", h.GetScheduledMessages).Methods(http.MethodGet)
 
 	api.HandleFunc("/user/search", h.SearchUsers).Methods(http.MethodPost)
 	api.HandleFunc("/user/{id}", h.GetUser).Methods(http.MethodGet)
@@ -72,12 +92,22 @@ func main() {
 	api.HandleFunc("/room/channels/{id}", h.GetRoomChannelsData).Methods(http.MethodGet)
 	api.HandleFunc("/room/channels/update/{roomId}", h.UpdateRoomChannelsData).Methods(http.MethodPatch)
 	api.HandleFunc("/room/channel/{roomId}/{id}", h.GetRoomChannel).Methods(http.MethodGet)
+	api.HandleFunc("/room/thread/{channelId}/{id}", h.GetRoomThread).Methods(http.MethodGet)
+	api.HandleFunc("/room/revisions/{channelId}/{id}", h.GetRoomMessageRevisions).Methods(http.MethodGet)
+	api.HandleFunc("/room/pins/{channelId}", h.GetRoomChannelPins).Methods(http.MethodGet)
+	api.HandleFunc("/room/search/{roomId}", h.SearchRoomMessages).Methods(http.MethodPost)
 	api.HandleFunc("/room/delete/{id}", h.DeleteRoom).Methods(http.MethodDelete)
 	api.HandleFunc("/room/{id}", h.GetRoom).Methods(http.MethodGet)
+	api.HandleFunc("/room/{id}/audit", h.GetRoomAuditLog).Methods(http.MethodGet)
 	api.HandleFunc("/room/image/{id}", h.GetRoomImage).Methods(http.MethodGet)
 	api.HandleFunc("/room/display/{id}", h.GetRoomDisplayData).Methods(http.MethodGet)
 	api.HandleFunc("/room/image/{id}", h.UploadRoomImage).Methods(http.MethodPost)
 	api.HandleFunc("/room/page/{page}", h.GetRoomPage).Methods(http.MethodGet)
+	api.HandleFunc("/room/kick/{roomId}/{uid}", h.KickFromRoom).Methods(http.MethodPost)
+	api.HandleFunc("/room/roles/create/{roomId}", h.CreateRoomRole).Methods(http.MethodPost)
+	api.HandleFunc("/room/roles/update/{roomId}/{id}", h.UpdateRoomRole).Methods(http.MethodPatch)
+	api.HandleFunc("/room/roles/delete/{roomId}/{id}", h.DeleteRoomRole).Methods(http.MethodDelete)
+	api.HandleFunc("/room/roles/assign/{roomId}", h.AssignRoomRole).Methods(http.MethodPatch)
 	api.HandleFunc("/rooms/own/ids", h.GetOwnRoomIDs).Methods(http.MethodGet)
 
 	api.HandleFunc("/attachment/chunk/{msgId}", h.UploadAttachmentChunk).Methods(http.MethodPost)
@@ -54,6 +54,8 @@ type InChunk struct {
 type Delete struct {
 	MsgId primitive.ObjectID
 	Uid   primitive.ObjectID
+	// Set when the deleted message was forwarded, the ID the shared attachment is stored under
+	SharedFrom *primitive.ObjectID
 }
 
 func Init(ss *socketserver.SocketServer, colls *db.Collections) *AttachmentServer {
@@ -248,8 +250,15 @@ func deleteLoop(as *AttachmentServer, ss *socketserver.SocketServer, colls *db.C
 			}
 		}()
 		deleteData := <-as.DeleteChan
+		attachmentId := deleteData.MsgId
+		if deleteData.SharedFrom != nil {
+			attachmentId = *deleteData.SharedFrom
+		}
+		if attachmentInUse(attachmentId, deleteData.SharedFrom != nil, colls) {
+			continue
+		}
 		as.Uploaders.mutex.Lock()
-		if _, err := colls.AttachmentMetadataCollection.DeleteOne(context.Background(), bson.M{"_id": deleteData.MsgId}); err != nil {
+		if _, err := colls.AttachmentMetadataCollection.DeleteOne(context.Background(), bson.M{"_id": attachmentId}); err != nil {
 			log.Println("Error deleting attachment metadata:", err)
 			delete(as.Uploaders.data[deleteData.Uid], deleteData.MsgId)
 			if len(as.Uploaders.data[deleteData.Uid]) == 0 {
@@ -257,7 +266,7 @@ func deleteLoop(as *AttachmentServer, ss *socketserver.SocketServer, colls *db.C
 			}
 			continue
 		}
-		deleteAttachmentChunks(deleteData.MsgId, deleteData.Uid, deleteData.MsgId, as, colls)
+		deleteAttachmentChunks(attachmentId, deleteData.Uid, attachmentId, as, colls)
 		as.Uploaders.mutex.Unlock()
 	}
 }
@@ -305,3 +314,24 @@ func deleteAttachmentChunks(chunkId primitive.ObjectID, uid primitive.ObjectID,
 	}
 	deleteAttachmentChunks(chunkData.NextChunkID, uid, msgId, as, colls)
 }
+
+// Forwarded messages share the attachment of the original message, so it's kept until
+// the original message and every forwarded copy have been deleted.
+func attachmentInUse(attachmentId primitive.ObjectID, shared bool, colls *db.Collections) bool {
+	filter := bson.M{"attachment_id": attachmentId}
+	if shared {
+		filter = bson.M{"$or": bson.A{filter, bson.M{"_id": attachmentId}}}
+	}
+	for _, collection := range []*mongo.Collection{colls.RoomMessageCollection, colls.DirectMessageCollection} {
+		count, err := collection.CountDocuments(context.Background(), filter)
+		if err != nil {
+			// Better to leave the attachment than delete one that's still being used
+			log.Println("Error checking for forwarded attachments:", err)
+			return true
+		}
+		if count > 0 {
+			return true
+		}
+	}
+	return false
+}
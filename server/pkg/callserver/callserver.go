@@ -1,16 +1,34 @@
 package callserver
 
 import (
+	"context"
 	"log"
+	"os"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/web-stuff-98/electron-social-chat/pkg/db"
+	"github.com/web-stuff-98/electron-social-chat/pkg/db/models"
 	"github.com/web-stuff-98/electron-social-chat/pkg/socketmodels"
 	"github.com/web-stuff-98/electron-social-chat/pkg/socketserver"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 /*
 	This is for 1-1 video calls
+
+	Pending calls expire after the ring timeout (CALL_RING_TIMEOUT in seconds,
+	defaults to 30). When a call expires a missed call message is written into
+	the inbox of the user that was called.
+
+	Every call is written to the call log collection. Answered calls are
+	logged when accepted and updated when they end, calls that were never
+	answered are logged when rejected, cancelled or missed. The logs are
+	written after the mutexes are unlocked, so a slow write doesn't hold up
+	other calls.
 */
 
 type CallServer struct {
@@ -30,22 +48,42 @@ type CallServer struct {
 	SendCalledAnswer chan CalledSignal
 	// Channel for recipient requesting WebRTC re-initialization (necessary for changing/adding media devices)
 	CallRecipientRequestedReInitialization chan primitive.ObjectID
+	// Channel for mic/camera/screenshare changes, relayed to the peer without renegotiation
+	MediaStateChan chan InMediaState
+	// Channel for closing any pending or active call between two users (used when blocking/banning)
+	CloseCallsBetweenChan chan CallsBetween
+	// How long a call can go unanswered before it times out
+	RingTimeout time.Duration
 }
 
 /* --------------- MUTEX PROTECTED MAPS --------------- */
 type CallsPending struct {
-	// outer map is caller ID, inner map is the user that was called ID
-	data  map[primitive.ObjectID]primitive.ObjectID
+	// key is caller ID
+	data  map[primitive.ObjectID]PendingCall
 	mutex sync.Mutex
 }
 type CallsActive struct {
-	// outer map is caller ID, inner map is the user that was called ID
-	data  map[primitive.ObjectID]primitive.ObjectID
+	// key is caller ID
+	data  map[primitive.ObjectID]ActiveCall
 	mutex sync.Mutex
 }
 
 /* --------------- STRUCTS --------------- */
 
+type PendingCall struct {
+	Called    primitive.ObjectID
+	CreatedAt time.Time
+}
+type ActiveCall struct {
+	Called    primitive.ObjectID
+	LogID     primitive.ObjectID
+	StartedAt time.Time
+
+	// Last known media states, sent to the peer again after renegotiating. A socket
+	// disconnect ends the call, so these only last for the users current connection.
+	CallerMediaState socketmodels.MediaState
+	CalledMediaState socketmodels.MediaState
+}
 type CallerSignal struct {
 	Caller primitive.ObjectID
 	Signal string
@@ -66,64 +104,88 @@ type InCall struct {
 	Caller primitive.ObjectID
 	Called primitive.ObjectID
 }
+type InMediaState struct {
+	Uid        primitive.ObjectID
+	MediaState socketmodels.MediaState
+}
+type CallsBetween struct {
+	UidA primitive.ObjectID
+	UidB primitive.ObjectID
+	// Written to the call log as the end reason
+	Reason string
+}
 type InCallResponse struct {
 	Caller primitive.ObjectID
 	Called primitive.ObjectID
 	Accept bool
 }
 
-func Init(ss *socketserver.SocketServer, dc chan primitive.ObjectID) *CallServer {
+func Init(ss *socketserver.SocketServer, colls *db.Collections, dc chan primitive.ObjectID) *CallServer {
+	ringTimeout := time.Second * 30
+	if secs, err := strconv.Atoi(os.Getenv("CALL_RING_TIMEOUT")); err == nil && secs > 0 {
+		ringTimeout = time.Second * time.Duration(secs)
+	}
 	cs := &CallServer{
 		CallsPending: CallsPending{
-			data: make(map[primitive.ObjectID]primitive.ObjectID),
+			data: make(map[primitive.ObjectID]PendingCall),
 		},
 		CallsPendingChan:   make(chan InCall),
 		ResponseToCallChan: make(chan InCallResponse),
 		CallsActive: CallsActive{
-			data: make(map[primitive.ObjectID]primitive.ObjectID),
+			data: make(map[primitive.ObjectID]ActiveCall),
 		},
 		LeaveCallChan:                          make(chan primitive.ObjectID),
 		SendCallRecipientOffer:                 make(chan CallerSignal),
 		SendCalledAnswer:                       make(chan CalledSignal),
 		CallRecipientRequestedReInitialization: make(chan primitive.ObjectID),
+		MediaStateChan:                         make(chan InMediaState),
+		CloseCallsBetweenChan:                  make(chan CallsBetween),
+		RingTimeout:                            ringTimeout,
 	}
-	runServer(ss, cs, dc)
+	runServer(ss, cs, colls, dc)
 	return cs
 }
 
-func runServer(ss *socketserver.SocketServer, cs *CallServer, dc chan primitive.ObjectID) {
+func runServer(ss *socketserver.SocketServer, cs *CallServer, colls *db.Collections, dc chan primitive.ObjectID) {
 	/* ----- Call pending loop ----- */
-	go callPendingChanLoop(ss, cs)
+	go callPendingChanLoop(ss, cs, colls)
 	/* ----- Call response loop ----- */
-	go callResponseChanLoop(ss, cs)
+	go callResponseChanLoop(ss, cs, colls)
 	/* ----- Leave call channel loop ----- */
-	go leaveCallChanLoop(ss, cs)
+	go leaveCallChanLoop(ss, cs, colls)
 	/* ----- Send call recipient webRTC offer loop ----- */
 	go sendCallRecipientOfferLoop(ss, cs)
 	/* ----- Send call recipient webRTC offer loop ----- */
 	go sendCallerAnswerLoop(ss, cs)
 	/* ----- Call recipient request webRTC reinitialization loop ----- */
 	go callRecipientRequestReInitializationLoop(ss, cs)
+	/* ----- Media state loop ----- */
+	go mediaStateLoop(ss, cs)
+	/* ----- Close calls between users loop ----- */
+	go closeCallsBetweenLoop(ss, cs, colls)
 	/* ----- Socket disconnect registration loop ----- */
-	go socketDisconnectRegistrationLoop(ss, cs, dc)
+	go socketDisconnectRegistrationLoop(ss, cs, colls, dc)
+	/* ----- Pending call timeout loop ----- */
+	go callTimeoutLoop(ss, cs, colls)
 }
 
-func callPendingChanLoop(ss *socketserver.SocketServer, cs *CallServer) {
+func callPendingChanLoop(ss *socketserver.SocketServer, cs *CallServer, colls *db.Collections) {
 	for {
 		defer func() {
 			r := recover()
 			if r != nil {
 				log.Println("Recovered from panic in pending call channel:", r)
 			}
-			go callPendingChanLoop(ss, cs)
+			go callPendingChanLoop(ss, cs, colls)
 		}()
 		data := <-cs.CallsPendingChan
+		logs := []callLogEntry{}
 		cs.CallsPending.mutex.Lock()
-		if called, ok := cs.CallsPending.data[data.Caller]; ok {
-			if called != data.Called {
+		if pending, ok := cs.CallsPending.data[data.Caller]; ok {
+			if pending.Called != data.Called {
 				// pending call switching to different user. cancel previous pending call.
 				Uids := make(map[primitive.ObjectID]struct{})
-				Uids[called] = struct{}{}
+				Uids[pending.Called] = struct{}{}
 				Uids[data.Caller] = struct{}{}
 				ss.SendDataToUsers <- socketserver.UsersDataMessage{
 					Uids: Uids,
@@ -134,10 +196,17 @@ func callPendingChanLoop(ss *socketserver.SocketServer, cs *CallServer) {
 						Accept: false,
 					},
 				}
-				cs.CallsPending.data[data.Caller] = data.Called
+				logs = append(logs, unansweredCallLog(data.Caller, pending.Called, pending.CreatedAt, "CANCELLED"))
+				cs.CallsPending.data[data.Caller] = PendingCall{
+					Called:    data.Called,
+					CreatedAt: time.Now(),
+				}
 			}
 		} else {
-			cs.CallsPending.data[data.Caller] = data.Called
+			cs.CallsPending.data[data.Caller] = PendingCall{
+				Called:    data.Called,
+				CreatedAt: time.Now(),
+			}
 		}
 		Uids := make(map[primitive.ObjectID]struct{})
 		Uids[data.Called] = struct{}{}
@@ -151,21 +220,30 @@ func callPendingChanLoop(ss *socketserver.SocketServer, cs *CallServer) {
 			},
 		}
 		cs.CallsPending.mutex.Unlock()
+		writeCallLogs(colls, logs)
 	}
 }
 
-func callResponseChanLoop(ss *socketserver.SocketServer, cs *CallServer) {
+func callResponseChanLoop(ss *socketserver.SocketServer, cs *CallServer, colls *db.Collections) {
 	for {
 		defer func() {
 			r := recover()
 			if r != nil {
 				log.Println("Recovered from panic in call response channel:", r)
 			}
-			go callResponseChanLoop(ss, cs)
+			go callResponseChanLoop(ss, cs, colls)
 		}()
 		data := <-cs.ResponseToCallChan
+		logs := []callLogEntry{}
 		cs.CallsPending.mutex.Lock()
 		cs.CallsActive.mutex.Lock()
+		pending, ok := cs.CallsPending.data[data.Caller]
+		if !ok || pending.Called != data.Called {
+			// The call already timed out, was cancelled or never existed
+			cs.CallsPending.mutex.Unlock()
+			cs.CallsActive.mutex.Unlock()
+			continue
+		}
 		delete(cs.CallsPending.data, data.Caller)
 
 		if data.Accept {
@@ -174,42 +252,45 @@ func callResponseChanLoop(ss *socketserver.SocketServer, cs *CallServer) {
 			// Confusing variable names here.
 			closedCallerCall := false
 			closedCalledCall := false
-			if callerCalled, ok := cs.CallsActive.data[data.Caller]; ok {
+			if callerCall, ok := cs.CallsActive.data[data.Caller]; ok {
 				closedCallerCall = true
 				Uids := make(map[primitive.ObjectID]struct{})
 				Uids[data.Caller] = struct{}{}
-				Uids[callerCalled] = struct{}{}
+				Uids[callerCall.Called] = struct{}{}
 				ss.SendDataToUsers <- socketserver.UsersDataMessage{
 					Type: "CALL_LEFT",
 					Data: socketmodels.CallLeft{},
 					Uids: Uids,
 				}
+				logs = append(logs, endedCallLog(data.Caller, callerCall, "REPLACED"))
 				delete(cs.CallsActive.data, data.Caller)
 			}
-			if calledCalled, ok := cs.CallsActive.data[data.Called]; ok {
+			if calledCall, ok := cs.CallsActive.data[data.Called]; ok {
 				closedCalledCall = true
 				Uids := make(map[primitive.ObjectID]struct{})
 				Uids[data.Called] = struct{}{}
-				Uids[calledCalled] = struct{}{}
+				Uids[calledCall.Called] = struct{}{}
 				ss.SendDataToUsers <- socketserver.UsersDataMessage{
 					Type: "CALL_LEFT",
 					Data: socketmodels.CallLeft{},
 					Uids: Uids,
 				}
+				logs = append(logs, endedCallLog(data.Called, calledCall, "REPLACED"))
 				delete(cs.CallsActive.data, data.Called)
 			}
 			// make sure that the caller is not in a call. If they are exit the call they are already in
 			if !closedCallerCall {
-				for caller, called := range cs.CallsActive.data {
-					if data.Caller == called {
+				for caller, active := range cs.CallsActive.data {
+					if data.Caller == active.Called {
 						Uids := make(map[primitive.ObjectID]struct{})
 						Uids[caller] = struct{}{}
-						Uids[called] = struct{}{}
+						Uids[active.Called] = struct{}{}
 						ss.SendDataToUsers <- socketserver.UsersDataMessage{
 							Type: "CALL_LEFT",
 							Data: socketmodels.CallLeft{},
 							Uids: Uids,
 						}
+						logs = append(logs, endedCallLog(caller, active, "REPLACED"))
 						delete(cs.CallsActive.data, caller)
 						break
 					}
@@ -217,16 +298,17 @@ func callResponseChanLoop(ss *socketserver.SocketServer, cs *CallServer) {
 			}
 			// make sure that the called user is not in a call. If they are exit the call they are already in
 			if !closedCalledCall {
-				for caller, called := range cs.CallsActive.data {
-					if data.Called == called {
+				for caller, active := range cs.CallsActive.data {
+					if data.Called == active.Called {
 						Uids := make(map[primitive.ObjectID]struct{})
 						Uids[caller] = struct{}{}
-						Uids[called] = struct{}{}
+						Uids[active.Called] = struct{}{}
 						ss.SendDataToUsers <- socketserver.UsersDataMessage{
 							Type: "CALL_LEFT",
 							Data: socketmodels.CallLeft{},
 							Uids: Uids,
 						}
+						logs = append(logs, endedCallLog(caller, active, "REPLACED"))
 						delete(cs.CallsActive.data, caller)
 						break
 					}
@@ -234,7 +316,15 @@ func callResponseChanLoop(ss *socketserver.SocketServer, cs *CallServer) {
 			}
 
 			// Any active calls that either user in have now been closed. Proceed.
-			cs.CallsActive.data[data.Caller] = data.Called
+			active := ActiveCall{
+				Called:    data.Called,
+				LogID:     primitive.NewObjectID(),
+				StartedAt: time.Now(),
+			}
+			cs.CallsActive.data[data.Caller] = active
+			logs = append(logs, startedCallLog(data.Caller, active))
+		} else {
+			logs = append(logs, unansweredCallLog(data.Caller, data.Called, pending.CreatedAt, "REJECTED"))
 		}
 
 		// Send the response to both clients
@@ -253,41 +343,46 @@ func callResponseChanLoop(ss *socketserver.SocketServer, cs *CallServer) {
 
 		cs.CallsPending.mutex.Unlock()
 		cs.CallsActive.mutex.Unlock()
+		writeCallLogs(colls, logs)
 	}
 }
 
-func leaveCallChanLoop(ss *socketserver.SocketServer, cs *CallServer) {
+func leaveCallChanLoop(ss *socketserver.SocketServer, cs *CallServer, colls *db.Collections) {
 	for {
 		defer func() {
 			r := recover()
 			if r != nil {
 				log.Println("Recovered from panic in leave call channel:", r)
 			}
-			go leaveCallChanLoop(ss, cs)
+			go leaveCallChanLoop(ss, cs, colls)
 		}()
 		uid := <-cs.LeaveCallChan
+		logs := []callLogEntry{}
 		cs.CallsActive.mutex.Lock()
-		if called, ok := cs.CallsActive.data[uid]; ok {
+		if active, ok := cs.CallsActive.data[uid]; ok {
 			ss.SendDataToUser <- socketserver.UserDataMessage{
 				Type: "CALL_LEFT",
 				Data: socketmodels.CallLeft{},
-				Uid:  called,
+				Uid:  active.Called,
 			}
+			logs = append(logs, endedCallLog(uid, active, "LEFT"))
 			delete(cs.CallsActive.data, uid)
 		} else {
-			for caller, called := range cs.CallsActive.data {
-				if called == uid {
+			for caller, active := range cs.CallsActive.data {
+				if active.Called == uid {
 					ss.SendDataToUser <- socketserver.UserDataMessage{
 						Type: "CALL_LEFT",
 						Data: socketmodels.CallLeft{},
 						Uid:  caller,
 					}
+					logs = append(logs, endedCallLog(caller, active, "LEFT"))
 					delete(cs.CallsActive.data, caller)
 					break
 				}
 			}
 		}
 		cs.CallsActive.mutex.Unlock()
+		writeCallLogs(colls, logs)
 	}
 }
 
@@ -302,9 +397,9 @@ func sendCallRecipientOfferLoop(ss *socketserver.SocketServer, cs *CallServer) {
 		}()
 		data := <-cs.SendCallRecipientOffer
 		cs.CallsActive.mutex.Lock()
-		if called, ok := cs.CallsActive.data[data.Caller]; ok {
+		if active, ok := cs.CallsActive.data[data.Caller]; ok {
 			ss.SendDataToUser <- socketserver.UserDataMessage{
-				Uid:  called,
+				Uid:  active.Called,
 				Type: "CALL_WEBRTC_OFFER_FROM_INITIATOR",
 				Data: socketmodels.CallWebRTCOfferFromInitiator{
 					Signal: data.Signal,
@@ -314,6 +409,14 @@ func sendCallRecipientOfferLoop(ss *socketserver.SocketServer, cs *CallServer) {
 					DisplayMediaVid:   data.DisplayMediaVid,
 				},
 			}
+			ss.SendDataToUser <- socketserver.UserDataMessage{
+				Uid:  active.Called,
+				Type: "CALL_MEDIA_STATE_FROM_PEER",
+				Data: socketmodels.CallMediaStateFromPeer{
+					Uid:        data.Caller.Hex(),
+					MediaState: active.CallerMediaState,
+				},
+			}
 		}
 		cs.CallsActive.mutex.Unlock()
 	}
@@ -330,8 +433,8 @@ func sendCallerAnswerLoop(ss *socketserver.SocketServer, cs *CallServer) {
 		}()
 		data := <-cs.SendCalledAnswer
 		cs.CallsActive.mutex.Lock()
-		for caller, oi2 := range cs.CallsActive.data {
-			if oi2 == data.Called {
+		for caller, active := range cs.CallsActive.data {
+			if active.Called == data.Called {
 				ss.SendDataToUser <- socketserver.UserDataMessage{
 					Uid:  caller,
 					Type: "CALL_WEBRTC_ANSWER_FROM_RECIPIENT",
@@ -343,6 +446,14 @@ func sendCallerAnswerLoop(ss *socketserver.SocketServer, cs *CallServer) {
 						DisplayMediaVid:   data.DisplayMediaVid,
 					},
 				}
+				ss.SendDataToUser <- socketserver.UserDataMessage{
+					Uid:  caller,
+					Type: "CALL_MEDIA_STATE_FROM_PEER",
+					Data: socketmodels.CallMediaStateFromPeer{
+						Uid:        data.Called.Hex(),
+						MediaState: active.CalledMediaState,
+					},
+				}
 				break
 			}
 		}
@@ -361,8 +472,8 @@ func callRecipientRequestReInitializationLoop(ss *socketserver.SocketServer, cs
 		}()
 		callerUid := <-cs.CallRecipientRequestedReInitialization
 		cs.CallsActive.mutex.Lock()
-		for caller, oi2 := range cs.CallsActive.data {
-			if oi2 == callerUid {
+		for caller, active := range cs.CallsActive.data {
+			if active.Called == callerUid {
 				ss.SendDataToUser <- socketserver.UserDataMessage{
 					Uid:  caller,
 					Type: "CALL_WEBRTC_REQUESTED_REINITIALIZATION",
@@ -375,31 +486,126 @@ func callRecipientRequestReInitializationLoop(ss *socketserver.SocketServer, cs
 	}
 }
 
-func socketDisconnectRegistrationLoop(ss *socketserver.SocketServer, cs *CallServer, dc chan primitive.ObjectID) {
+func mediaStateLoop(ss *socketserver.SocketServer, cs *CallServer) {
+	for {
+		defer func() {
+			r := recover()
+			if r != nil {
+				log.Println("Recovered from panic in media state loop :", r)
+			}
+			go mediaStateLoop(ss, cs)
+		}()
+		data := <-cs.MediaStateChan
+		cs.CallsActive.mutex.Lock()
+		if active, ok := cs.CallsActive.data[data.Uid]; ok {
+			active.CallerMediaState = data.MediaState
+			cs.CallsActive.data[data.Uid] = active
+			ss.SendDataToUser <- socketserver.UserDataMessage{
+				Uid:  active.Called,
+				Type: "CALL_MEDIA_STATE_FROM_PEER",
+				Data: socketmodels.CallMediaStateFromPeer{
+					Uid:        data.Uid.Hex(),
+					MediaState: data.MediaState,
+				},
+			}
+		} else {
+			for caller, active := range cs.CallsActive.data {
+				if active.Called == data.Uid {
+					active.CalledMediaState = data.MediaState
+					cs.CallsActive.data[caller] = active
+					ss.SendDataToUser <- socketserver.UserDataMessage{
+						Uid:  caller,
+						Type: "CALL_MEDIA_STATE_FROM_PEER",
+						Data: socketmodels.CallMediaStateFromPeer{
+							Uid:        data.Uid.Hex(),
+							MediaState: data.MediaState,
+						},
+					}
+					break
+				}
+			}
+		}
+		cs.CallsActive.mutex.Unlock()
+	}
+}
+
+func closeCallsBetweenLoop(ss *socketserver.SocketServer, cs *CallServer, colls *db.Collections) {
+	for {
+		defer func() {
+			r := recover()
+			if r != nil {
+				log.Println("Recovered from panic in close calls between users loop :", r)
+			}
+			go closeCallsBetweenLoop(ss, cs, colls)
+		}()
+		data := <-cs.CloseCallsBetweenChan
+		logs := []callLogEntry{}
+		cs.CallsPending.mutex.Lock()
+		cs.CallsActive.mutex.Lock()
+		Uids := make(map[primitive.ObjectID]struct{})
+		Uids[data.UidA] = struct{}{}
+		Uids[data.UidB] = struct{}{}
+		for _, caller := range []primitive.ObjectID{data.UidA, data.UidB} {
+			called := data.UidA
+			if caller == data.UidA {
+				called = data.UidB
+			}
+			if pending, ok := cs.CallsPending.data[caller]; ok && pending.Called == called {
+				ss.SendDataToUsers <- socketserver.UsersDataMessage{
+					Uids: Uids,
+					Type: "CALL_USER_RESPONSE",
+					Data: socketmodels.CallResponse{
+						Caller: caller.Hex(),
+						Called: called.Hex(),
+						Accept: false,
+					},
+				}
+				logs = append(logs, unansweredCallLog(caller, called, pending.CreatedAt, data.Reason))
+				delete(cs.CallsPending.data, caller)
+			}
+			if active, ok := cs.CallsActive.data[caller]; ok && active.Called == called {
+				ss.SendDataToUsers <- socketserver.UsersDataMessage{
+					Uids: Uids,
+					Type: "CALL_LEFT",
+					Data: socketmodels.CallLeft{},
+				}
+				logs = append(logs, endedCallLog(caller, active, data.Reason))
+				delete(cs.CallsActive.data, caller)
+			}
+		}
+		cs.CallsPending.mutex.Unlock()
+		cs.CallsActive.mutex.Unlock()
+		writeCallLogs(colls, logs)
+	}
+}
+
+func socketDisconnectRegistrationLoop(ss *socketserver.SocketServer, cs *CallServer, colls *db.Collections, dc chan primitive.ObjectID) {
 	for {
 		defer func() {
 			r := recover()
 			if r != nil {
 				log.Println("Recovered from panic in caller socket disconnect registration loop :", r)
 			}
-			go socketDisconnectRegistrationLoop(ss, cs, dc)
+			go socketDisconnectRegistrationLoop(ss, cs, colls, dc)
 		}()
 		uid := <-dc
+		logs := []callLogEntry{}
 		cs.CallsPending.mutex.Lock()
 		if callPending, ok := cs.CallsPending.data[uid]; ok {
 			ss.SendDataToUser <- socketserver.UserDataMessage{
-				Uid:  callPending,
+				Uid:  callPending.Called,
 				Type: "CALL_USER_RESPONSE",
 				Data: socketmodels.CallResponse{
 					Caller: uid.Hex(),
-					Called: callPending.Hex(),
+					Called: callPending.Called.Hex(),
 					Accept: false,
 				},
 			}
-			delete(cs.CallsActive.data, uid)
+			logs = append(logs, unansweredCallLog(uid, callPending.Called, callPending.CreatedAt, "DISCONNECTED"))
+			delete(cs.CallsPending.data, uid)
 		}
-		for caller, called := range cs.CallsPending.data {
-			if called == uid {
+		for caller, pending := range cs.CallsPending.data {
+			if pending.Called == uid {
 				ss.SendDataToUser <- socketserver.UserDataMessage{
 					Uid:  caller,
 					Type: "CALL_USER_RESPONSE",
@@ -409,32 +615,204 @@ func socketDisconnectRegistrationLoop(ss *socketserver.SocketServer, cs *CallSer
 						Accept: false,
 					},
 				}
+				logs = append(logs, unansweredCallLog(caller, uid, pending.CreatedAt, "DISCONNECTED"))
 				delete(cs.CallsPending.data, caller)
 			}
 		}
 		cs.CallsPending.mutex.Unlock()
 
 		cs.CallsActive.mutex.Lock()
-		if called, ok := cs.CallsActive.data[uid]; ok {
+		if active, ok := cs.CallsActive.data[uid]; ok {
 			ss.SendDataToUser <- socketserver.UserDataMessage{
-				Uid:  called,
+				Uid:  active.Called,
 				Type: "CALL_LEFT",
 				Data: socketmodels.CallLeft{},
 			}
+			logs = append(logs, endedCallLog(uid, active, "DISCONNECTED"))
 			delete(cs.CallsActive.data, uid)
 		} else {
-			for caller, called := range cs.CallsActive.data {
-				if called == uid {
+			for caller, active := range cs.CallsActive.data {
+				if active.Called == uid {
 					ss.SendDataToUser <- socketserver.UserDataMessage{
 						Type: "CALL_LEFT",
 						Uid:  caller,
 						Data: socketmodels.CallLeft{},
 					}
+					logs = append(logs, endedCallLog(caller, active, "DISCONNECTED"))
 					delete(cs.CallsActive.data, caller)
 					break
 				}
 			}
 		}
 		cs.CallsActive.mutex.Unlock()
+		writeCallLogs(colls, logs)
+	}
+}
+
+func callTimeoutLoop(ss *socketserver.SocketServer, cs *CallServer, colls *db.Collections) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			log.Println("Recovered from panic in call timeout loop :", r)
+		}
+		go callTimeoutLoop(ss, cs, colls)
+	}()
+	ticker := time.NewTicker(time.Second)
+	for {
+		<-ticker.C
+		cs.CallsPending.mutex.Lock()
+		timedOut := make(map[primitive.ObjectID]PendingCall)
+		for caller, pending := range cs.CallsPending.data {
+			if pending.CreatedAt.Before(time.Now().Add(-cs.RingTimeout)) {
+				timedOut[caller] = pending
+				delete(cs.CallsPending.data, caller)
+			}
+		}
+		cs.CallsPending.mutex.Unlock()
+		for caller, pending := range timedOut {
+			called := pending.Called
+			writeCallLog(colls, unansweredCallLog(caller, called, pending.CreatedAt, "MISSED"))
+			Uids := make(map[primitive.ObjectID]struct{})
+			Uids[caller] = struct{}{}
+			Uids[called] = struct{}{}
+			ss.SendDataToUsers <- socketserver.UsersDataMessage{
+				Uids: Uids,
+				Type: "CALL_TIMEOUT",
+				Data: socketmodels.CallTimeout{
+					Caller: caller.Hex(),
+					Called: called.Hex(),
+				},
+			}
+			if msgId, err := writeMissedCall(colls, caller, called); err != nil {
+				log.Println("Error writing missed call :", err)
+			} else {
+				ss.SendDataToUsers <- socketserver.UsersDataMessage{
+					Uids: Uids,
+					Type: "OUT_DIRECT_MESSAGE",
+					Data: socketmodels.OutDirectMessage{
+						ID:         msgId.Hex(),
+						Author:     caller.Hex(),
+						Recipient:  called.Hex(),
+						MissedCall: true,
+					},
+				}
+			}
+		}
+	}
+}
+
+// Missed calls are stored in the called users inbox as direct messages from the caller
+func writeMissedCall(colls *db.Collections, caller primitive.ObjectID, called primitive.ObjectID) (primitive.ObjectID, error) {
+	msgId := primitive.NewObjectID()
+	if _, err := colls.DirectMessageCollection.InsertOne(context.Background(), models.DirectMessage{
+		ID:         msgId,
+		CreatedAt:  primitive.NewDateTimeFromTime(time.Now()),
+		UpdatedAt:  primitive.NewDateTimeFromTime(time.Now()),
+		Author:     caller,
+		Recipient:  called,
+		MissedCall: true,
+	}); err != nil {
+		return msgId, err
+	}
+	if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), called, bson.M{
+		"$addToSet": bson.M{
+			"messages_received_from": caller,
+		},
+	}); err != nil {
+		return msgId, err
+	}
+	if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), caller, bson.M{
+		"$addToSet": bson.M{
+			"messages_sent_to": called,
+		},
+	}); err != nil {
+		return msgId, err
+	}
+	return msgId, nil
+}
+
+// A call log write, collected while the mutexes are locked and written after
+type callLogEntry struct {
+	// Zero for calls that were never answered
+	LogID     primitive.ObjectID
+	Caller    primitive.ObjectID
+	Called    primitive.ObjectID
+	StartedAt time.Time
+	// Zero for answered calls that have just started
+	EndedAt time.Time
+	Reason  string
+}
+
+func unansweredCallLog(caller primitive.ObjectID, called primitive.ObjectID, startedAt time.Time, reason string) callLogEntry {
+	return callLogEntry{
+		Caller:    caller,
+		Called:    called,
+		StartedAt: startedAt,
+		EndedAt:   time.Now(),
+		Reason:    reason,
+	}
+}
+
+func startedCallLog(caller primitive.ObjectID, active ActiveCall) callLogEntry {
+	return callLogEntry{
+		LogID:     active.LogID,
+		Caller:    caller,
+		Called:    active.Called,
+		StartedAt: active.StartedAt,
+	}
+}
+
+func endedCallLog(caller primitive.ObjectID, active ActiveCall, reason string) callLogEntry {
+	return callLogEntry{
+		LogID:     active.LogID,
+		Caller:    caller,
+		Called:    active.Called,
+		StartedAt: active.StartedAt,
+		EndedAt:   time.Now(),
+		Reason:    reason,
+	}
+}
+
+func writeCallLogs(colls *db.Collections, logs []callLogEntry) {
+	for _, entry := range logs {
+		writeCallLog(colls, entry)
+	}
+}
+
+// Answered calls are upserted, so the end of a call can be written before its start without losing either
+func writeCallLog(colls *db.Collections, entry callLogEntry) {
+	if entry.LogID.IsZero() {
+		if _, err := colls.CallLogCollection.InsertOne(context.Background(), models.CallLog{
+			ID:        primitive.NewObjectID(),
+			Caller:    entry.Caller,
+			Called:    entry.Called,
+			StartedAt: primitive.NewDateTimeFromTime(entry.StartedAt),
+			EndedAt:   primitive.NewDateTimeFromTime(entry.EndedAt),
+			EndReason: entry.Reason,
+		}); err != nil {
+			log.Println("Error writing call log :", err)
+		}
+		return
+	}
+	onInsert := bson.M{
+		"caller":     entry.Caller,
+		"called":     entry.Called,
+		"answered":   true,
+		"started_at": primitive.NewDateTimeFromTime(entry.StartedAt),
+	}
+	update := bson.M{"$setOnInsert": onInsert}
+	if entry.EndedAt.IsZero() {
+		onInsert["ended_at"] = primitive.DateTime(0)
+		onInsert["duration"] = 0
+		onInsert["end_reason"] = ""
+	} else {
+		update["$set"] = bson.M{
+			"ended_at":   primitive.NewDateTimeFromTime(entry.EndedAt),
+			"duration":   int(entry.EndedAt.Sub(entry.StartedAt).Seconds()),
+			"end_reason": entry.Reason,
+		}
+	}
+	if _, err := colls.CallLogCollection.UpdateByID(context.Background(), entry.LogID, update, options.Update().SetUpsert(true)); err != nil {
+		log.Println("Error writing call log :", err)
 	}
 }
@@ -74,30 +74,26 @@ func watchUserDeletes(db *mongo.Database, ss *socketserver.SocketServer) {
 		db.Collection("pfps").DeleteOne(context.Background(), bson.M{"_id": uid})
 		db.Collection("rooms").DeleteMany(context.Background(), bson.M{"author": uid})
 
-		userMessagingData := &models.UserMessagingData{}
-		if err := db.Collection("user_messaging_data").FindOne(context.Background(), bson.M{"_id": uid}).Decode(&userMessagingData); err == nil {
-			for _, oi := range userMessagingData.MessagesSentTo {
-				// for each inbox the user has sent a message to, remove their messages
-				db.Collection("user_messaging_data").UpdateByID(context.Background(), oi, bson.M{
-					"$pull": bson.M{
-						"messages": bson.M{
-							"author": uid,
-						},
-					},
-				})
-			}
-			for _, oi := range userMessagingData.MessagesReceivedFrom {
-				// for each inbox the user has received a message from, remove those messages
-				db.Collection("user_messaging_data").UpdateByID(context.Background(), oi, bson.M{
-					"$pull": bson.M{
-						"messages": bson.M{
-							"recipient": uid,
-						},
-					},
-				})
-			}
-		}
+		// remove the messages the user sent and received
+		db.Collection("direct_messages").DeleteMany(context.Background(), bson.M{
+			"$or": bson.A{
+				bson.M{"author": uid},
+				bson.M{"recipient": uid},
+			},
+		})
 
+		db.Collection("read_markers").DeleteMany(context.Background(), bson.M{
+			"$or": bson.A{
+				bson.M{"uid": uid},
+				bson.M{"target": uid},
+			},
+		})
+		db.Collection("scheduled_messages").DeleteMany(context.Background(), bson.M{
+			"$or": bson.A{
+				bson.M{"uid": uid},
+				bson.M{"target": uid, "is_room": false},
+			},
+		})
 		db.Collection("user_messaging_data").DeleteOne(context.Background(), bson.M{"_id": uid})
 
 		ss.DestroySubscription <- "user=" + uid.Hex()
@@ -226,6 +222,7 @@ func watchRoomDeletes(db *mongo.Database, ss *socketserver.SocketServer) {
 		db.Collection("room_internal_data").DeleteOne(context.Background(), bson.M{"_id": id})
 		db.Collection("room_external_data").DeleteOne(context.Background(), bson.M{"_id": id})
 		db.Collection("room_image").DeleteOne(context.Background(), bson.M{"_id": id})
+		db.Collection("room_audit_logs").DeleteMany(context.Background(), bson.M{"room_id": id})
 		channelIds := []primitive.ObjectID{}
 		if cursor, err := db.Collection("room_channels").Find(context.Background(), bson.M{"room_id": id}); err != nil {
 			log.Fatal("CS CURSOR ERR : ", err)
@@ -295,18 +292,21 @@ func watchRoomChannelUpdates(db *mongo.Database, ss *socketserver.SocketServer,
 				},
 			})
 			db.Collection("room_channels").DeleteOne(context.Background(), bson.M{"_id": changeEv.FullDocument.ID})
-			channelMessages := &models.RoomChannelMessages{}
-			if err := db.Collection("room_channel_messages").FindOne(context.Background(), bson.M{"_id": changeEv.DocumentKey.ID}).Decode(&channelMessages); err == nil {
-				for _, rcm := range channelMessages.Messages {
-					if rcm.HasAttachment {
-						as.DeleteChan <- attachmentserver.Delete{
-							MsgId: rcm.ID,
-							Uid:   rcm.Author,
-						}
-					}
+			channelMessages := []models.RoomChannelMessage{}
+			if cursor, err := db.Collection("room_messages").Find(context.Background(), bson.M{"channel_id": changeEv.DocumentKey.ID, "has_attachment": true}); err == nil {
+				cursor.All(context.Background(), &channelMessages)
+			}
+			// the messages are deleted first, so that forwarded copies in the same channel don't keep shared attachments
+			db.Collection("room_messages").DeleteMany(context.Background(), bson.M{"channel_id": changeEv.DocumentKey.ID})
+			for _, rcm := range channelMessages {
+				as.DeleteChan <- attachmentserver.Delete{
+					MsgId:      rcm.ID,
+					Uid:        rcm.Author,
+					SharedFrom: rcm.AttachmentID,
 				}
 			}
-			db.Collection("room_channel_messages").DeleteOne(context.Background(), bson.M{"_id": changeEv.FullDocument.ID})
+			db.Collection("read_markers").DeleteMany(context.Background(), bson.M{"target": changeEv.DocumentKey.ID})
+			db.Collection("scheduled_messages").DeleteMany(context.Background(), bson.M{"target": changeEv.DocumentKey.ID, "is_room": true})
 		} else {
 			outBytes, err := json.Marshal(changeEv.FullDocument)
 			if err != nil {
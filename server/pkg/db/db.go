@@ -19,12 +19,21 @@ type Collections struct {
 	AttachmentChunkCollection    *mongo.Collection
 	AttachmentMetadataCollection *mongo.Collection
 
-	RoomCollection                *mongo.Collection
-	RoomInternalDataCollection    *mongo.Collection
-	RoomExternalDataCollection    *mongo.Collection
-	RoomImageCollection           *mongo.Collection
-	RoomChannelCollection         *mongo.Collection
-	RoomChannelMessagesCollection *mongo.Collection
+	RoomCollection             *mongo.Collection
+	RoomInternalDataCollection *mongo.Collection
+	RoomExternalDataCollection *mongo.Collection
+	RoomImageCollection        *mongo.Collection
+	RoomChannelCollection      *mongo.Collection
+	RoomMessageCollection      *mongo.Collection
+	DirectMessageCollection    *mongo.Collection
+
+	CallLogCollection *mongo.Collection
+
+	RoomAuditLogCollection *mongo.Collection
+
+	ReadMarkerCollection *mongo.Collection
+
+	ScheduledMessageCollection *mongo.Collection
 }
 
 func Init() (*mongo.Database, *Collections) {
@@ -49,12 +58,21 @@ func Init() (*mongo.Database, *Collections) {
 		AttachmentChunkCollection:    DB.Collection("attachment_chunks"),
 		AttachmentMetadataCollection: DB.Collection("attachment_metadata"),
 
-		RoomCollection:                DB.Collection("rooms"),
-		RoomInternalDataCollection:    DB.Collection("room_internal_data"),
-		RoomExternalDataCollection:    DB.Collection("room_external_data"),
-		RoomImageCollection:           DB.Collection("room_image"),
-		RoomChannelCollection:         DB.Collection("room_channels"),
-		RoomChannelMessagesCollection: DB.Collection("room_channel_messages"),
+		RoomCollection:             DB.Collection("rooms"),
+		RoomInternalDataCollection: DB.Collection("room_internal_data"),
+		RoomExternalDataCollection: DB.Collection("room_external_data"),
+		RoomImageCollection:        DB.Collection("room_image"),
+		RoomChannelCollection:      DB.Collection("room_channels"),
+		RoomMessageCollection:      DB.Collection("room_messages"),
+		DirectMessageCollection:    DB.Collection("direct_messages"),
+
+		CallLogCollection: DB.Collection("call_logs"),
+
+		RoomAuditLogCollection: DB.Collection("room_audit_logs"),
+
+		ReadMarkerCollection: DB.Collection("read_markers"),
+
+		ScheduledMessageCollection: DB.Collection("scheduled_messages"),
 	}
 
 	//DB.Drop(context.Background())
@@ -66,6 +84,98 @@ func Init() (*mongo.Database, *Collections) {
 		Options: options.Index().SetName("username_text"),
 	})
 
+	// ObjectIDs are created in order, so _id is used as the creation time for paging
+	colls.RoomMessageCollection.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "channel_id", Value: 1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("channel_id_id"),
+		},
+		{
+			Keys:    bson.D{{Key: "channel_id", Value: 1}, {Key: "pinned_at", Value: -1}},
+			Options: options.Index().SetName("channel_id_pinned_at").SetPartialFilterExpression(bson.M{"pinned_at": bson.M{"$exists": true}}),
+		},
+		{
+			Keys:    bson.D{{Key: "reply_to", Value: 1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("reply_to_id").SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "content", Value: "text"}},
+			Options: options.Index().SetName("content_text"),
+		},
+		{
+			Keys:    bson.D{{Key: "attachment_id", Value: 1}},
+			Options: options.Index().SetName("attachment_id").SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "poll.closes_at", Value: 1}},
+			Options: options.Index().SetName("poll_closes_at").SetPartialFilterExpression(bson.M{"poll.closed": false}),
+		},
+	})
+	colls.DirectMessageCollection.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "reply_to", Value: 1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("reply_to_id").SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "content", Value: "text"}},
+			Options: options.Index().SetName("content_text"),
+		},
+		{
+			Keys:    bson.D{{Key: "attachment_id", Value: 1}},
+			Options: options.Index().SetName("attachment_id").SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "author", Value: 1}, {Key: "recipient", Value: 1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("author_recipient_id"),
+		},
+		{
+			Keys:    bson.D{{Key: "author", Value: 1}, {Key: "recipient", Value: 1}, {Key: "pinned_at", Value: -1}},
+			Options: options.Index().SetName("author_recipient_pinned_at").SetPartialFilterExpression(bson.M{"pinned_at": bson.M{"$exists": true}}),
+		},
+		{
+			Keys:    bson.D{{Key: "recipient", Value: 1}, {Key: "missed_call", Value: 1}},
+			Options: options.Index().SetName("recipient_missed_call"),
+		},
+	})
+
+	colls.CallLogCollection.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "caller", Value: 1}, {Key: "started_at", Value: -1}},
+			Options: options.Index().SetName("caller_started_at"),
+		},
+		{
+			Keys:    bson.D{{Key: "called", Value: 1}, {Key: "started_at", Value: -1}},
+			Options: options.Index().SetName("called_started_at"),
+		},
+	})
+
+	colls.RoomAuditLogCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "room_id", Value: 1}, {Key: "created_at", Value: -1}},
+		Options: options.Index().SetName("room_id_created_at"),
+	})
+
+	colls.ReadMarkerCollection.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "uid", Value: 1}, {Key: "target", Value: 1}},
+			Options: options.Index().SetName("uid_target").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "target", Value: 1}},
+			Options: options.Index().SetName("target"),
+		},
+	})
+
+	colls.ScheduledMessageCollection.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "send_at", Value: 1}},
+			Options: options.Index().SetName("send_at"),
+		},
+		{
+			Keys:    bson.D{{Key: "uid", Value: 1}, {Key: "send_at", Value: 1}},
+			Options: options.Index().SetName("uid_send_at"),
+		},
+	})
+
 	log.Println("Connected to MongoDB")
 
 	return DB, colls
@@ -1,6 +1,10 @@
 package models
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"github.com/web-stuff-98/electron-social-chat/pkg/linkpreview"
+	"github.com/web-stuff-98/electron-social-chat/pkg/richtext"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 /*
 A lot of things are split up into seperate collections, mainly
@@ -24,13 +28,59 @@ type User struct {
 	IsOnline  bool               `bson:"-" json:"online"`
 }
 
+// Stored in the direct messages collection, one document per message
 type DirectMessage struct {
 	ID            primitive.ObjectID `bson:"_id,omitempty" json:"ID"`
 	Content       string             `bson:"content,maxlength=300" json:"content"`
 	CreatedAt     primitive.DateTime `bson:"created_at" json:"created_at"`
 	UpdatedAt     primitive.DateTime `bson:"updated_at" json:"updated_at"`
 	Author        primitive.ObjectID `bson:"author" json:"author"`
+	Recipient     primitive.ObjectID `bson:"recipient" json:"recipient"`
 	HasAttachment bool               `bson:"has_attachment" json:"has_attachment"`
+	// The first message in the thread, replies to replies go to the first message. Replies are left out of the conversation and fetched by thread.
+	ReplyTo    *primitive.ObjectID `bson:"reply_to,omitempty" json:"reply_to,omitempty"`
+	ReplyCount int                 `bson:"reply_count" json:"reply_count"`
+	Reactions  []MessageReaction   `bson:"reactions" json:"reactions"`
+	Edited     bool                `bson:"edited" json:"edited"`
+	// Rich text messages have the parsed content stored with the raw content
+	RichText bool            `bson:"rich_text" json:"rich_text"`
+	Rendered []richtext.Node `bson:"rendered,omitempty" json:"rendered,omitempty"`
+	// Set while the message is pinned
+	PinnedAt *primitive.DateTime `bson:"pinned_at,omitempty" json:"pinned_at,omitempty"`
+	PinnedBy *primitive.ObjectID `bson:"pinned_by,omitempty" json:"pinned_by,omitempty"`
+	// Previous versions, oldest first. Left out of message lists and fetched separately.
+	Revisions []MessageRevision `bson:"revisions,omitempty" json:"-"`
+	// Set by the link preview server after the message is created or edited, if the content has a link
+	LinkPreview *linkpreview.Preview `bson:"link_preview,omitempty" json:"link_preview,omitempty"`
+	// Set for forwarded messages
+	ForwardedFrom *ForwardOrigin `bson:"forwarded_from,omitempty" json:"forwarded_from,omitempty"`
+	// Forwarded messages share the attachment of the original message, it's stored under this ID instead of the message ID
+	AttachmentID *primitive.ObjectID `bson:"attachment_id,omitempty" json:"attachment_id,omitempty"`
+	// Missed calls are stored as messages from the caller with no content
+	MissedCall bool `bson:"missed_call" json:"missed_call"`
+}
+
+// The message a forwarded message was copied from. Forwarding a forwarded message keeps the first origin.
+type ForwardOrigin struct {
+	MsgID     primitive.ObjectID `bson:"msg_id" json:"msg_id"`
+	Author    primitive.ObjectID `bson:"author" json:"author"`
+	CreatedAt primitive.DateTime `bson:"created_at" json:"created_at"`
+	// Set if the message was in a room channel
+	ChannelID *primitive.ObjectID `bson:"channel_id,omitempty" json:"channel_id,omitempty"`
+	RoomID    *primitive.ObjectID `bson:"room_id,omitempty" json:"room_id,omitempty"`
+}
+
+// One per emoji. The count is the number of uids.
+type MessageReaction struct {
+	Emoji string               `bson:"emoji" json:"emoji"`
+	Uids  []primitive.ObjectID `bson:"uids" json:"uids"`
+}
+
+// CreatedAt is when this version was written, ReplacedAt is when it was edited
+type MessageRevision struct {
+	Content    string             `bson:"content" json:"content"`
+	CreatedAt  primitive.DateTime `bson:"created_at" json:"created_at"`
+	ReplacedAt primitive.DateTime `bson:"replaced_at" json:"replaced_at"`
 }
 
 type Invitation struct {
@@ -54,7 +104,6 @@ type FriendRequest struct {
 
 type UserMessagingData struct {
 	ID             primitive.ObjectID `bson:"_id,omitempty" json:"ID"`
-	Messages       []DirectMessage    `bson:"messages" json:"messages"`
 	Invitations    []Invitation       `bson:"invitations" json:"invitations"`
 	FriendRequests []FriendRequest    `bson:"friend_requests" json:"friend_requests"`
 	// also includes invitations & friend requests
@@ -73,18 +122,55 @@ type Pfp struct {
 
 /*---------------- Room structs ----------------*/
 
+// Stored in the room messages collection, one document per message
 type RoomChannelMessage struct {
 	ID            primitive.ObjectID `bson:"_id,omitempty" json:"ID"`
+	ChannelID     primitive.ObjectID `bson:"channel_id" json:"channel_id"`
 	Content       string             `bson:"content,maxlength=300" json:"content"`
 	CreatedAt     primitive.DateTime `bson:"created_at" json:"created_at"`
 	UpdatedAt     primitive.DateTime `bson:"updated_at" json:"updated_at"`
 	Author        primitive.ObjectID `bson:"author" json:"author"`
 	HasAttachment bool               `bson:"has_attachment" json:"has_attachment"`
+	// The first message in the thread, replies to replies go to the first message. Replies are left out of the channel and fetched by thread.
+	ReplyTo    *primitive.ObjectID `bson:"reply_to,omitempty" json:"reply_to,omitempty"`
+	ReplyCount int                 `bson:"reply_count" json:"reply_count"`
+	Reactions  []MessageReaction   `bson:"reactions" json:"reactions"`
+	Edited     bool                `bson:"edited" json:"edited"`
+	// Rich text messages have the parsed content stored with the raw content
+	RichText bool            `bson:"rich_text" json:"rich_text"`
+	Rendered []richtext.Node `bson:"rendered,omitempty" json:"rendered,omitempty"`
+	// Set while the message is pinned
+	PinnedAt *primitive.DateTime `bson:"pinned_at,omitempty" json:"pinned_at,omitempty"`
+	PinnedBy *primitive.ObjectID `bson:"pinned_by,omitempty" json:"pinned_by,omitempty"`
+	// Previous versions, oldest first. Left out of message lists and fetched separately.
+	Revisions []MessageRevision `bson:"revisions,omitempty" json:"-"`
+	// Set by the link preview server after the message is created or edited, if the content has a link
+	LinkPreview *linkpreview.Preview `bson:"link_preview,omitempty" json:"link_preview,omitempty"`
+	// Set for forwarded messages
+	ForwardedFrom *ForwardOrigin `bson:"forwarded_from,omitempty" json:"forwarded_from,omitempty"`
+	// Forwarded messages share the attachment of the original message, it's stored under this ID instead of the message ID
+	AttachmentID *primitive.ObjectID `bson:"attachment_id,omitempty" json:"attachment_id,omitempty"`
+	// Users mentioned by name
+	Mentions []primitive.ObjectID `bson:"mentions,omitempty" json:"mentions,omitempty"`
+	// "here" or "everyone", only stored if the author was allowed to use it
+	MassMention string `bson:"mass_mention,omitempty" json:"mass_mention,omitempty"`
+	// Set for polls, the content is the question
+	Poll *Poll `bson:"poll,omitempty" json:"poll,omitempty"`
 }
 
-type RoomChannelMessages struct {
-	ID       primitive.ObjectID   `bson:"_id,omitempty" json:"ID"`
-	Messages []RoomChannelMessage `bson:"messages" json:"messages"`
+// Only room members can vote. The tally of each option is the number of votes.
+type Poll struct {
+	Options []PollOption `bson:"options" json:"options"`
+	// Users can vote for more than one option, but only once for each
+	MultipleChoice bool `bson:"multiple_choice" json:"multiple_choice"`
+	// nil if the poll stays open until it's closed
+	ClosesAt *primitive.DateTime `bson:"closes_at,omitempty" json:"closes_at,omitempty"`
+	Closed   bool                `bson:"closed" json:"closed"`
+}
+
+type PollOption struct {
+	Text  string               `bson:"text" json:"text"`
+	Votes []primitive.ObjectID `bson:"votes" json:"votes"`
 }
 
 // Changes to room channel docs triggers changestream events
@@ -93,8 +179,19 @@ type RoomChannel struct {
 	RoomID   primitive.ObjectID   `bson:"room_id" json:"-"`
 	Name     string               `bson:"name" json:"name"`
 	Messages []RoomChannelMessage `bson:"-" json:"messages"`
+	Pinned   []RoomChannelMessage `bson:"-" json:"pinned"`
+	// Only set by GetRoomChannelsData
+	Unread int64 `bson:"-" json:"unread,omitempty"`
 	// Need to use this because changeStream delete events dont return full document
 	ToBeDeleted bool `bson:"to_be_deleted" json:"-"`
+
+	// Overrides. Users with the manage channels permission can always see and post in the channel.
+	// Only users with the manage channels permission can post
+	ReadOnly bool `bson:"read_only" json:"read_only"`
+	// Only room members can see the channel
+	Hidden bool `bson:"hidden" json:"hidden"`
+	// Nobody can upload attachments
+	NoAttachments bool `bson:"no_attachments" json:"no_attachments"`
 }
 
 // Changes to room docs triggers changestream events
@@ -108,9 +205,17 @@ type Room struct {
 	Private bool                 `bson:"-" json:"is_private"`
 	Members []primitive.ObjectID `bson:"-" json:"members"`
 	Banned  []primitive.ObjectID `bson:"-" json:"banned"`
+	// Only included for users with the ban/mute permissions
+	BanRecords []RoomRestriction `bson:"-" json:"ban_records,omitempty"`
+	Mutes      []RoomRestriction `bson:"-" json:"mutes,omitempty"`
 
 	Channels    []primitive.ObjectID `bson:"-" json:"channels"`
 	MainChannel primitive.ObjectID   `bson:"-" json:"main_channel"`
+
+	Roles           []RoomRole           `bson:"-" json:"roles"`
+	RoleAssignments []RoomRoleAssignment `bson:"-" json:"role_assignments"`
+	// Permissions of the user that requested the room
+	Permissions RoomPermission `bson:"-" json:"permissions"`
 }
 
 type RoomImage struct {
@@ -131,6 +236,102 @@ type RoomExternalData struct {
 	Private bool                 `bson:"private" json:"private"`
 	Members []primitive.ObjectID `bson:"members" json:"members"`
 	Banned  []primitive.ObjectID `bson:"banned" json:"banned"`
+	// Bans made by moderators have a record, bans from blocking don't. Expired records are removed by the moderation sweeper.
+	BanRecords []RoomRestriction `bson:"ban_records" json:"ban_records"`
+	// Muted users can see the room but cannot send messages
+	Mutes []RoomRestriction `bson:"mutes" json:"mutes"`
+
+	Roles []RoomRole `bson:"roles" json:"roles"`
+	// Users without an assignment have the default role
+	RoleAssignments []RoomRoleAssignment `bson:"role_assignments" json:"role_assignments"`
+}
+
+type RoomRestriction struct {
+	Uid       primitive.ObjectID `bson:"uid" json:"uid"`
+	Moderator primitive.ObjectID `bson:"moderator" json:"moderator"`
+	Reason    string             `bson:"reason" json:"reason"`
+	CreatedAt primitive.DateTime `bson:"created_at" json:"created_at"`
+	// nil if the restriction is permanent
+	ExpiresAt *primitive.DateTime `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+}
+
+/*---------------- Room role structs ----------------*/
+
+type RoomPermission uint32
+
+const (
+	PermissionBan RoomPermission = 1 << iota
+	PermissionKick
+	PermissionManageChannels
+	// Deleting other users messages
+	PermissionDeleteMessages
+	PermissionInvite
+	PermissionUploadAttachments
+	PermissionMute
+	// Using @here and @everyone
+	PermissionMentionEveryone
+
+	// Channel permissions, these are worked out from the channel overrides and cannot be given to a role
+	PermissionViewChannel  RoomPermission = 1 << 29
+	PermissionSendMessages RoomPermission = 1 << 30
+
+	// Only the room author has this, it cannot be given to a role
+	PermissionOwner RoomPermission = 1 << 31
+
+	// Every permission that can be given to a role
+	PermissionAllRoles = PermissionBan | PermissionKick | PermissionManageChannels | PermissionDeleteMessages | PermissionInvite | PermissionUploadAttachments | PermissionMute | PermissionMentionEveryone
+	// Having any of these lets the user see the rooms audit log
+	PermissionsModeration = PermissionBan | PermissionKick | PermissionManageChannels | PermissionDeleteMessages | PermissionMute
+	// Permissions for the moderator role created with the room
+	PermissionsModeratorDefault = PermissionAllRoles
+	// Permissions for the member role created with the room, also used for rooms created before roles existed
+	PermissionsMemberDefault = PermissionUploadAttachments
+)
+
+type RoomRole struct {
+	ID          primitive.ObjectID `bson:"_id" json:"ID"`
+	Name        string             `bson:"name" json:"name"`
+	Permissions RoomPermission     `bson:"permissions" json:"permissions"`
+	// The default role is given to members without a role assignment. It cannot be deleted.
+	Default bool `bson:"default" json:"default"`
+}
+
+type RoomRoleAssignment struct {
+	Uid    primitive.ObjectID `bson:"uid" json:"uid"`
+	RoleID primitive.ObjectID `bson:"role_id" json:"role_id"`
+}
+
+/*---------------- Room audit log structs ----------------*/
+
+// Written by every moderation and room admin action
+type RoomAuditLog struct {
+	ID     primitive.ObjectID `bson:"_id,omitempty" json:"ID"`
+	RoomID primitive.ObjectID `bson:"room_id" json:"room_id"`
+	Actor  primitive.ObjectID `bson:"actor" json:"actor"`
+	// BAN, UNBAN, KICK, MUTE, UNMUTE, DELETE_MESSAGE, PIN_MESSAGE, UNPIN_MESSAGE, CLOSE_POLL, UPDATE_ROOM, UPDATE_ROOM_IMAGE,
+	// CREATE_CHANNEL, UPDATE_CHANNEL, DELETE_CHANNEL, PROMOTE_MAIN_CHANNEL, CREATE_ROLE, UPDATE_ROLE, DELETE_ROLE or ASSIGN_ROLE
+	Action string `bson:"action" json:"action"`
+	// The user, channel, message or role the action was done to. Omitted for room actions.
+	Target    *primitive.ObjectID `bson:"target,omitempty" json:"target,omitempty"`
+	Details   string              `bson:"details" json:"details"`
+	CreatedAt primitive.DateTime  `bson:"created_at" json:"created_at"`
+}
+
+/*---------------- Call log structs ----------------*/
+
+type CallLog struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"ID"`
+	Caller   primitive.ObjectID `bson:"caller" json:"caller"`
+	Called   primitive.ObjectID `bson:"called" json:"called"`
+	Answered bool               `bson:"answered" json:"answered"`
+	// For calls that were never answered this is when the call started ringing
+	StartedAt primitive.DateTime `bson:"started_at" json:"started_at"`
+	// Zero while the call is still active
+	EndedAt primitive.DateTime `bson:"ended_at" json:"ended_at"`
+	// Seconds, always 0 for calls that were never answered
+	Duration int `bson:"duration" json:"duration"`
+	// REJECTED, CANCELLED, MISSED, LEFT, DISCONNECTED, REPLACED (another call was accepted), BLOCKED or BANNED
+	EndReason string `bson:"end_reason" json:"end_reason"`
 }
 
 /*---------------- Attachment structs ----------------*/
@@ -150,3 +351,45 @@ type AttachmentData struct {
 	Ratio  float32            `bson:"ratio" json:"ratio"`
 	Failed bool               `bson:"failed" json:"failed"`
 }
+
+/*---------------- Read marker structs ----------------*/
+
+// One per user for each channel and conversation they have read
+type ReadMarker struct {
+	ID  primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Uid primitive.ObjectID `bson:"uid" json:"uid"`
+	// The channel ID, or the other user for conversations
+	Target primitive.ObjectID `bson:"target" json:"target"`
+	// The newest message the user has read
+	LastRead  primitive.ObjectID `bson:"last_read" json:"last_read"`
+	UpdatedAt primitive.DateTime `bson:"updated_at" json:"updated_at"`
+}
+
+/*---------------- Scheduled message structs ----------------*/
+
+const (
+	ScheduledKindMessage  = "MESSAGE"
+	ScheduledKindReminder = "REMINDER"
+)
+
+// Messages to send later and reminders about existing messages, deleted once they have been sent
+type ScheduledMessage struct {
+	ID  primitive.ObjectID `bson:"_id,omitempty" json:"ID"`
+	Uid primitive.ObjectID `bson:"uid" json:"uid"`
+	// MESSAGE or REMINDER
+	Kind   string             `bson:"kind" json:"kind"`
+	SendAt primitive.DateTime `bson:"send_at" json:"send_at"`
+	// The channel for room messages, or the other user for direct messages
+	Target primitive.ObjectID `bson:"target" json:"target"`
+	IsRoom bool               `bson:"is_room" json:"is_room"`
+	// The message content, or the users note for reminders
+	Content  string              `bson:"content" json:"content"`
+	RichText bool                `bson:"rich_text" json:"rich_text"`
+	ReplyTo  *primitive.ObjectID `bson:"reply_to,omitempty" json:"reply_to,omitempty"`
+	// The message the reminder is for, or the ID a scheduled message is sent with
+	MsgID     *primitive.ObjectID `bson:"msg_id,omitempty" json:"msg_id,omitempty"`
+	CreatedAt primitive.DateTime  `bson:"created_at" json:"created_at"`
+	// Set by the dispatcher while sending. Claims that are never cleared are retried, so a crash doesn't lose the message.
+	ClaimedAt *primitive.DateTime `bson:"claimed_at,omitempty" json:"-"`
+	Attempts  int                 `bson:"attempts" json:"-"`
+}
@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/mux"
@@ -20,6 +21,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -134,7 +136,6 @@ func (h handler) Register(w http.ResponseWriter, r *http.Request) {
 
 	userMessagingData := models.UserMessagingData{
 		ID:                   user.ID,
-		Messages:             []models.DirectMessage{},
 		MessagesSentTo:       []primitive.ObjectID{},
 		MessagesReceivedFrom: []primitive.ObjectID{},
 		Blocked:              []primitive.ObjectID{},
@@ -291,6 +292,7 @@ func (h handler) UploadPfp(w http.ResponseWriter, r *http.Request) {
 	responseMessage(w, http.StatusOK, "Pfp updated")
 }
 
+// Messages are paged with the "before" and "limit" query params, see helpers.GetMessagePageFromRequest
 func (h handler) GetConversation(w http.ResponseWriter, r *http.Request) {
 	user, err := helpers.GetUserFromRequest(r, r.Context(), *h.Collections, h.RedisClient)
 	if err != nil {
@@ -304,41 +306,219 @@ func (h handler) GetConversation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	messagingData := &models.UserMessagingData{}
-	if h.Collections.UserMessagingDataCollection.FindOne(r.Context(), bson.M{"_id": user.ID}).Decode(&messagingData); err != nil {
+	page, err := helpers.GetMessagePageFromRequest(r)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Replies are fetched by thread
+	filter := bson.M{
+		"$or": bson.A{
+			bson.M{"author": converseId, "recipient": user.ID},
+			bson.M{"author": user.ID, "recipient": converseId},
+		},
+		"reply_to": bson.M{"$exists": false},
+	}
+	if !page.Before.IsZero() {
+		filter["_id"] = bson.M{"$lt": page.Before}
+	}
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "_id", Value: -1}})
+	findOptions.SetLimit(int64(page.Limit))
+	findOptions.SetProjection(bson.M{"revisions": 0})
+
+	cursor, err := h.Collections.DirectMessageCollection.Find(r.Context(), filter, findOptions)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	newestFirst := []models.DirectMessage{}
+	if err := cursor.All(r.Context(), &newestFirst); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	blocked, err := helpers.GetBlockedUids(r.Context(), *h.Collections, user.ID)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	messages := make([]models.DirectMessage, len(newestFirst))
+	for i, dm := range newestFirst {
+		dm.Reactions = helpers.FilterBlockedReactions(dm.Reactions, blocked)
+		messages[len(newestFirst)-1-i] = dm
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(messages)
+}
+
+// Gets the first message of a thread and a page of its replies. Paged the same as GetConversation.
+func (h handler) GetConversationThread(w http.ResponseWriter, r *http.Request) {
+	user, err := helpers.GetUserFromRequest(r, r.Context(), *h.Collections, h.RedisClient)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	converseId, err := primitive.ObjectIDFromHex(mux.Vars(r)["uid"])
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	msgId, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	page, err := helpers.GetMessagePageFromRequest(r)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	parent := &models.DirectMessage{}
+	if err := h.Collections.DirectMessageCollection.FindOne(r.Context(), bson.M{
+		"_id": msgId,
+		"$or": bson.A{
+			bson.M{"author": converseId, "recipient": user.ID},
+			bson.M{"author": user.ID, "recipient": converseId},
+		},
+	}).Decode(&parent); err != nil {
 		if err == mongo.ErrNoDocuments {
-			responseMessage(w, http.StatusNotFound, "Not found")
+			responseMessage(w, http.StatusNotFound, "Message not found")
 		} else {
 			responseMessage(w, http.StatusInternalServerError, "Internal error")
 		}
 		return
 	}
 
-	converseMessagingData := &models.UserMessagingData{}
-	if h.Collections.UserMessagingDataCollection.FindOne(r.Context(), bson.M{"_id": converseId}).Decode(&converseMessagingData); err != nil {
+	filter := bson.M{"reply_to": msgId}
+	if !page.Before.IsZero() {
+		filter["_id"] = bson.M{"$lt": page.Before}
+	}
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "_id", Value: -1}})
+	findOptions.SetLimit(int64(page.Limit))
+	findOptions.SetProjection(bson.M{"revisions": 0})
+
+	cursor, err := h.Collections.DirectMessageCollection.Find(r.Context(), filter, findOptions)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	newestFirst := []models.DirectMessage{}
+	if err := cursor.All(r.Context(), &newestFirst); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	blocked, err := helpers.GetBlockedUids(r.Context(), *h.Collections, user.ID)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	parent.Reactions = helpers.FilterBlockedReactions(parent.Reactions, blocked)
+	replies := make([]models.DirectMessage, len(newestFirst))
+	for i, dm := range newestFirst {
+		dm.Reactions = helpers.FilterBlockedReactions(dm.Reactions, blocked)
+		replies[len(newestFirst)-1-i] = dm
+	}
+
+	out := make(map[string]interface{})
+	out["parent"] = parent
+	out["replies"] = replies
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(out)
+}
+
+// Gets the pinned messages in the conversation, most recently pinned first
+func (h handler) GetConversationPins(w http.ResponseWriter, r *http.Request) {
+	user, err := helpers.GetUserFromRequest(r, r.Context(), *h.Collections, h.RedisClient)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	converseId, err := primitive.ObjectIDFromHex(mux.Vars(r)["uid"])
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	pinned := []models.DirectMessage{}
+	if err := helpers.GetPinnedMessages(r.Context(), h.Collections.DirectMessageCollection, bson.M{
+		"$or": bson.A{
+			bson.M{"author": converseId, "recipient": user.ID},
+			bson.M{"author": user.ID, "recipient": converseId},
+		},
+	}, &pinned); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	blocked, err := helpers.GetBlockedUids(r.Context(), *h.Collections, user.ID)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	for i, dm := range pinned {
+		pinned[i].Reactions = helpers.FilterBlockedReactions(dm.Reactions, blocked)
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(pinned)
+}
+
+// Gets the previous versions of a message, oldest first. Only the author can see them.
+func (h handler) GetDirectMessageRevisions(w http.ResponseWriter, r *http.Request) {
+	user, err := helpers.GetUserFromRequest(r, r.Context(), *h.Collections, h.RedisClient)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	recipientId, err := primitive.ObjectIDFromHex(mux.Vars(r)["uid"])
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	msgId, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	msg := &models.DirectMessage{}
+	if err := h.Collections.DirectMessageCollection.FindOne(r.Context(), bson.M{
+		"_id":       msgId,
+		"author":    user.ID,
+		"recipient": recipientId,
+	}).Decode(&msg); err != nil {
 		if err == mongo.ErrNoDocuments {
-			responseMessage(w, http.StatusNotFound, "Not found")
+			responseMessage(w, http.StatusNotFound, "Message not found")
 		} else {
 			responseMessage(w, http.StatusInternalServerError, "Internal error")
 		}
 		return
 	}
 
-	messages := []models.DirectMessage{}
-	for _, dm := range messagingData.Messages {
-		if dm.Author == converseId {
-			messages = append(messages, dm)
-		}
-	}
-	for _, dm := range converseMessagingData.Messages {
-		if dm.Author == user.ID {
-			messages = append(messages, dm)
-		}
+	revisions := msg.Revisions
+	if revisions == nil {
+		revisions = []models.MessageRevision{}
 	}
 
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(messages)
+	json.NewEncoder(w).Encode(revisions)
 }
 
 func (h handler) GetConversations(w http.ResponseWriter, r *http.Request) {
@@ -423,12 +603,138 @@ func (h handler) GetConversations(w http.ResponseWriter, r *http.Request) {
 		cursor.Close(r.Context())
 	}
 
+	markers, err := helpers.GetReadMarkers(r.Context(), *h.Collections, user.ID, conversations)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	// Only the missed calls that haven't been read yet, older ones are in the conversation history
+	missedCalls := []models.DirectMessage{}
+	maxMissedCalls := 50
+	if len(conversations) > 0 {
+		unreadFilter := bson.A{}
+		for _, oi := range conversations {
+			unreadFilter = append(unreadFilter, bson.M{"author": oi, "_id": bson.M{"$gt": markers[oi]}})
+		}
+		if cursor, err := h.Collections.DirectMessageCollection.Find(r.Context(), bson.M{
+			"recipient":   user.ID,
+			"missed_call": true,
+			"$or":         unreadFilter,
+		}, options.Find().SetSort(bson.M{"_id": -1}).SetLimit(int64(maxMissedCalls))); err != nil {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		} else {
+			if err := cursor.All(r.Context(), &missedCalls); err != nil {
+				cursor.Close(r.Context())
+				responseMessage(w, http.StatusInternalServerError, "Internal error")
+				return
+			}
+		}
+	}
+	unreadCounts, err := helpers.CountUnread(r.Context(), h.Collections.DirectMessageCollection, bson.M{"recipient": user.ID}, "author", conversations, markers)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	unread := make(map[string]int64)
+	for _, oi := range conversations {
+		unread[oi.Hex()] = unreadCounts[oi]
+	}
+
+	// The newest message in each conversation the other user has read
+	readBy := make(map[string]primitive.ObjectID)
+	if cursor, err := h.Collections.ReadMarkerCollection.Find(r.Context(), bson.M{"uid": bson.M{"$in": conversations}, "target": user.ID}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	} else {
+		otherUsersMarkers := []models.ReadMarker{}
+		if err := cursor.All(r.Context(), &otherUsersMarkers); err != nil {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+		for _, rm := range otherUsersMarkers {
+			readBy[rm.Uid.Hex()] = rm.LastRead
+		}
+	}
+
 	out := make(map[string]interface{})
 	out["conversations"] = conversations
 	out["friend_requests"] = friendRequests
 	out["invitations"] = invitations
+	out["missed_calls"] = missedCalls
+	out["unread"] = unread
+	out["read_by"] = readBy
 
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(out)
 }
+
+func (h handler) GetCallHistory(w http.ResponseWriter, r *http.Request) {
+	user, err := helpers.GetUserFromRequest(r, r.Context(), *h.Collections, h.RedisClient)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	pageNumberString := mux.Vars(r)["page"]
+	pageNumber, err := strconv.Atoi(pageNumberString)
+	if err != nil || pageNumber < 1 {
+		responseMessage(w, http.StatusBadRequest, "Invalid page")
+		return
+	}
+	pageSize := 20
+
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "started_at", Value: -1}})
+	findOptions.SetLimit(int64(pageSize))
+	findOptions.SetSkip(int64(pageSize) * (int64(pageNumber) - 1))
+
+	filter := bson.M{"$or": bson.A{bson.M{"caller": user.ID}, bson.M{"called": user.ID}}}
+
+	calls := []models.CallLog{}
+	if cursor, err := h.Collections.CallLogCollection.Find(r.Context(), filter, findOptions); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	} else {
+		if err := cursor.All(r.Context(), &calls); err != nil {
+			cursor.Close(r.Context())
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(calls)
+}
+
+// Scheduled messages and reminders that haven't been sent yet, soonest first
+func (h handler) GetScheduledMessages(w http.ResponseWriter, r *http.Request) {
+	user, err := helpers.GetUserFromRequest(r, r.Context(), *h.Collections, h.RedisClient)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "send_at", Value: 1}})
+	findOptions.SetLimit(helpers.MaxScheduledPerUser)
+
+	scheduled := []models.ScheduledMessage{}
+	if cursor, err := h.Collections.ScheduledMessageCollection.Find(r.Context(), bson.M{"uid": user.ID}, findOptions); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	} else {
+		if err := cursor.All(r.Context(), &scheduled); err != nil {
+			cursor.Close(r.Context())
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(scheduled)
+}
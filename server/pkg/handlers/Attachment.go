@@ -52,37 +52,30 @@ func (h handler) UploadAttachmentChunk(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		}
-		channelMessages := &models.RoomChannelMessages{}
-		if err := h.Collections.RoomChannelMessagesCollection.FindOne(r.Context(), bson.M{"_id": recipient}).Decode(&channelMessages); err != nil {
+		roomExternalData := &models.RoomExternalData{}
+		if err := h.Collections.RoomExternalDataCollection.FindOne(r.Context(), bson.M{"_id": channel.RoomID}).Decode(&roomExternalData); err != nil {
 			if err == mongo.ErrNoDocuments {
-				responseMessage(w, http.StatusNotFound, "Channel not found")
+				responseMessage(w, http.StatusNotFound, "Room not found")
 			} else {
 				responseMessage(w, http.StatusInternalServerError, "Internal error")
 			}
 			return
 		}
-		roomExternalData := &models.RoomExternalData{}
-		if err := h.Collections.RoomExternalDataCollection.FindOne(r.Context(), bson.M{"_id": channel.RoomID}).Decode(&roomExternalData); err != nil {
+		if err := helpers.CheckRoomChannelPermission(r.Context(), *h.Collections, channel, user.ID, models.PermissionUploadAttachments); err != nil {
+			roomPermissionErrorResponse(w, err)
+			return
+		}
+		msg := &models.RoomChannelMessage{}
+		if err := h.Collections.RoomMessageCollection.FindOne(r.Context(), bson.M{"_id": msgId, "channel_id": recipient}).Decode(&msg); err != nil {
 			if err == mongo.ErrNoDocuments {
-				responseMessage(w, http.StatusNotFound, "Room not found")
+				responseMessage(w, http.StatusNotFound, "Message not found")
 			} else {
 				responseMessage(w, http.StatusInternalServerError, "Internal error")
 			}
 			return
 		}
-		found := false
-		for _, rcm := range channelMessages.Messages {
-			if rcm.ID == msgId {
-				found = true
-				if rcm.Author != user.ID {
-					responseMessage(w, http.StatusUnauthorized, "Unauthorized")
-					return
-				}
-				break
-			}
-		}
-		if !found {
-			responseMessage(w, http.StatusNotFound, "Message not found")
+		if msg.Author != user.ID {
+			responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 			return
 		}
 	} else {
@@ -101,19 +94,17 @@ func (h handler) UploadAttachmentChunk(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		}
-		found := false
-		for _, dm := range recipientMessagingData.Messages {
-			if dm.ID == msgId {
-				found = true
-				if dm.Author != user.ID {
-					responseMessage(w, http.StatusUnauthorized, "Unauthorized")
-					return
-				}
-				break
+		msg := &models.DirectMessage{}
+		if err := h.Collections.DirectMessageCollection.FindOne(r.Context(), bson.M{"_id": msgId, "recipient": recipient}).Decode(&msg); err != nil {
+			if err == mongo.ErrNoDocuments {
+				responseMessage(w, http.StatusNotFound, "Message not found")
+			} else {
+				responseMessage(w, http.StatusInternalServerError, "Internal error")
 			}
+			return
 		}
-		if !found {
-			responseMessage(w, http.StatusNotFound, "Message not found")
+		if msg.Author != user.ID {
+			responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 			return
 		}
 	}
@@ -207,37 +198,30 @@ func (h handler) CreateAttachmentMetadata(w http.ResponseWriter, r *http.Request
 			}
 			return
 		}
-		channelMessages := &models.RoomChannelMessages{}
-		if err := h.Collections.RoomChannelMessagesCollection.FindOne(r.Context(), bson.M{"_id": recipient}).Decode(&channelMessages); err != nil {
+		roomExternalData := &models.RoomExternalData{}
+		if err := h.Collections.RoomExternalDataCollection.FindOne(r.Context(), bson.M{"_id": channel.RoomID}).Decode(&roomExternalData); err != nil {
 			if err == mongo.ErrNoDocuments {
-				responseMessage(w, http.StatusNotFound, "Channel not found")
+				responseMessage(w, http.StatusNotFound, "Room not found")
 			} else {
 				responseMessage(w, http.StatusInternalServerError, "Internal error")
 			}
 			return
 		}
-		roomExternalData := &models.RoomExternalData{}
-		if err := h.Collections.RoomExternalDataCollection.FindOne(r.Context(), bson.M{"_id": channel.RoomID}).Decode(&roomExternalData); err != nil {
+		if err := helpers.CheckRoomChannelPermission(r.Context(), *h.Collections, channel, user.ID, models.PermissionUploadAttachments); err != nil {
+			roomPermissionErrorResponse(w, err)
+			return
+		}
+		msg := &models.RoomChannelMessage{}
+		if err := h.Collections.RoomMessageCollection.FindOne(r.Context(), bson.M{"_id": msgId, "channel_id": recipient}).Decode(&msg); err != nil {
 			if err == mongo.ErrNoDocuments {
-				responseMessage(w, http.StatusNotFound, "Room not found")
+				responseMessage(w, http.StatusNotFound, "Message not found")
 			} else {
 				responseMessage(w, http.StatusInternalServerError, "Internal error")
 			}
 			return
 		}
-		found := false
-		for _, rcm := range channelMessages.Messages {
-			if rcm.ID == msgId {
-				found = true
-				if rcm.Author != user.ID {
-					responseMessage(w, http.StatusUnauthorized, "Unauthorized")
-					return
-				}
-				break
-			}
-		}
-		if !found {
-			responseMessage(w, http.StatusNotFound, "Message not found")
+		if msg.Author != user.ID {
+			responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 			return
 		}
 	} else {
@@ -257,19 +241,17 @@ func (h handler) CreateAttachmentMetadata(w http.ResponseWriter, r *http.Request
 			}
 			return
 		}
-		found := false
-		for _, dm := range recipientMessagingData.Messages {
-			if dm.ID == msgId {
-				found = true
-				if dm.Author != user.ID {
-					responseMessage(w, http.StatusUnauthorized, "Unauthorized")
-					return
-				}
-				break
+		msg := &models.DirectMessage{}
+		if err := h.Collections.DirectMessageCollection.FindOne(r.Context(), bson.M{"_id": msgId, "recipient": recipient}).Decode(&msg); err != nil {
+			if err == mongo.ErrNoDocuments {
+				responseMessage(w, http.StatusNotFound, "Message not found")
+			} else {
+				responseMessage(w, http.StatusInternalServerError, "Internal error")
 			}
+			return
 		}
-		if !found {
-			responseMessage(w, http.StatusNotFound, "Message not found")
+		if msg.Author != user.ID {
+			responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 			return
 		}
 	}
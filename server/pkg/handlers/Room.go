@@ -113,6 +113,12 @@ func (h handler) CreateRoom(w http.ResponseWriter, r *http.Request) {
 		Private: roomInput.Private,
 		Members: []primitive.ObjectID{},
 		Banned:  []primitive.ObjectID{},
+
+		BanRecords: []models.RoomRestriction{},
+		Mutes:      []models.RoomRestriction{},
+
+		Roles:           helpers.DefaultRoomRoles(),
+		RoleAssignments: []models.RoomRoleAssignment{},
 	}); err != nil {
 		h.Collections.RoomCollection.DeleteOne(r.Context(), bson.M{"_id": inserted.InsertedID.(primitive.ObjectID)})
 		responseMessage(w, http.StatusInternalServerError, "Internal error")
@@ -123,14 +129,6 @@ func (h handler) CreateRoom(w http.ResponseWriter, r *http.Request) {
 		responseMessage(w, http.StatusInternalServerError, "Internal error")
 		return
 	}
-	if _, err := h.Collections.RoomChannelMessagesCollection.InsertOne(r.Context(), models.RoomChannelMessages{
-		ID:       mainChannel.ID,
-		Messages: []models.RoomChannelMessage{},
-	}); err != nil {
-		h.Collections.RoomCollection.DeleteOne(r.Context(), bson.M{"_id": inserted.InsertedID.(primitive.ObjectID)})
-		responseMessage(w, http.StatusInternalServerError, "Internal error")
-		return
-	}
 
 	w.WriteHeader(http.StatusCreated)
 	w.Header().Add("Content-Type", "application/json")
@@ -164,15 +162,8 @@ func (h handler) UpdateRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var room models.Room
-	if err := h.Collections.RoomCollection.FindOne(r.Context(), bson.M{"_id": id}).Decode(&room); err != nil {
-		if err != mongo.ErrNoDocuments {
-			responseMessage(w, http.StatusInternalServerError, "Internal error")
-			return
-		}
-	}
-	if room.Author != user.ID {
-		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+	if err := helpers.CheckRoomPermission(r.Context(), *h.Collections, id, user.ID, models.PermissionOwner); err != nil {
+		roomPermissionErrorResponse(w, err)
 		return
 	}
 
@@ -184,6 +175,7 @@ func (h handler) UpdateRoom(w http.ResponseWriter, r *http.Request) {
 	}); err != nil {
 		responseMessage(w, http.StatusInternalServerError, "Internal error")
 	} else {
+		helpers.WriteRoomAuditLog(r.Context(), *h.Collections, id, user.ID, "UPDATE_ROOM", primitive.NilObjectID, "Name: "+roomInput.Name)
 		responseMessage(w, http.StatusOK, "Room updated")
 	}
 }
@@ -212,15 +204,8 @@ func (h handler) UpdateRoomChannelsData(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	var room models.Room
-	if err := h.Collections.RoomCollection.FindOne(r.Context(), bson.M{"_id": roomId}).Decode(&room); err != nil {
-		if err != mongo.ErrNoDocuments {
-			responseMessage(w, http.StatusInternalServerError, "Internal error")
-			return
-		}
-	}
-	if room.Author != user.ID {
-		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+	if err := helpers.CheckRoomPermission(r.Context(), *h.Collections, roomId, user.ID, models.PermissionManageChannels); err != nil {
+		roomPermissionErrorResponse(w, err)
 		return
 	}
 
@@ -241,7 +226,7 @@ func (h handler) UpdateRoomChannelsData(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Update room channel names
+	// Update room channel names and overrides
 	for _, urcd := range updateRoomChannelsData.UpdateData {
 		id, err := primitive.ObjectIDFromHex(urcd.ID)
 		if err != nil {
@@ -261,7 +246,10 @@ func (h handler) UpdateRoomChannelsData(w http.ResponseWriter, r *http.Request)
 		}
 		res, err := h.Collections.RoomChannelCollection.UpdateOne(r.Context(), bson.M{"_id": id, "room_id": roomId}, bson.M{
 			"$set": bson.M{
-				"name": strings.TrimSpace(urcd.Name),
+				"name":           strings.TrimSpace(urcd.Name),
+				"read_only":      urcd.ReadOnly,
+				"hidden":         urcd.Hidden,
+				"no_attachments": urcd.NoAttachments,
 			},
 		})
 		if err != nil {
@@ -272,6 +260,18 @@ func (h handler) UpdateRoomChannelsData(w http.ResponseWriter, r *http.Request)
 			responseMessage(w, http.StatusBadRequest, "Bad request")
 			return
 		}
+		if urcd.Hidden {
+			channel := &models.RoomChannel{}
+			if err := h.Collections.RoomChannelCollection.FindOne(r.Context(), bson.M{"_id": id}).Decode(&channel); err != nil {
+				responseMessage(w, http.StatusInternalServerError, "Internal error")
+				return
+			}
+			if err := removeRoomChannelNonViewers(channel, h.SocketServer, h.RoomCallServer, h.Collections); err != nil {
+				responseMessage(w, http.StatusInternalServerError, "Internal error")
+				return
+			}
+		}
+		helpers.WriteRoomAuditLog(r.Context(), *h.Collections, roomId, user.ID, "UPDATE_CHANNEL", id, "Name: "+strings.TrimSpace(urcd.Name))
 	}
 
 	insertedNewMainChannel := false
@@ -283,18 +283,14 @@ func (h handler) UpdateRoomChannelsData(w http.ResponseWriter, r *http.Request)
 			ID:     primitive.NewObjectID(),
 			RoomID: roomId,
 			Name:   strings.TrimSpace(insertData.Name),
+
+			ReadOnly:      insertData.ReadOnly,
+			Hidden:        insertData.Hidden,
+			NoAttachments: insertData.NoAttachments,
 		})
 		if err != nil {
 			responseMessage(w, http.StatusInternalServerError, "Internal error")
 			return
-		} else {
-			if _, err := h.Collections.RoomChannelMessagesCollection.InsertOne(r.Context(), models.RoomChannelMessages{
-				ID:       res.InsertedID.(primitive.ObjectID),
-				Messages: []models.RoomChannelMessage{},
-			}); err != nil {
-				responseMessage(w, http.StatusInternalServerError, "Internal error")
-				return
-			}
 		}
 		if _, err := h.Collections.RoomInternalDataCollection.UpdateByID(r.Context(), roomId, bson.M{
 			"$push": bson.M{
@@ -317,10 +313,15 @@ func (h handler) UpdateRoomChannelsData(w http.ResponseWriter, r *http.Request)
 				return
 			}
 		}
+		helpers.WriteRoomAuditLog(r.Context(), *h.Collections, roomId, user.ID, "CREATE_CHANNEL", res.InsertedID.(primitive.ObjectID), "Name: "+strings.TrimSpace(insertData.Name))
 		insertedChannels = append(insertedChannels, models.RoomChannel{
 			ID:     res.InsertedID.(primitive.ObjectID),
 			RoomID: roomId,
 			Name:   strings.TrimSpace(insertData.Name),
+
+			ReadOnly:      insertData.ReadOnly,
+			Hidden:        insertData.Hidden,
+			NoAttachments: insertData.NoAttachments,
 		})
 	}
 
@@ -345,6 +346,9 @@ func (h handler) UpdateRoomChannelsData(w http.ResponseWriter, r *http.Request)
 			responseMessage(w, http.StatusInternalServerError, "Internal error")
 			return
 		}
+		for _, id := range ids {
+			helpers.WriteRoomAuditLog(r.Context(), *h.Collections, roomId, user.ID, "DELETE_CHANNEL", id, "")
+		}
 	}
 
 	// Promote pre-existing room channel to main (step will be skipped if a new main channel was already created)
@@ -370,6 +374,7 @@ func (h handler) UpdateRoomChannelsData(w http.ResponseWriter, r *http.Request)
 						responseMessage(w, http.StatusInternalServerError, "Internal error")
 						return
 					}
+					helpers.WriteRoomAuditLog(r.Context(), *h.Collections, roomId, user.ID, "PROMOTE_MAIN_CHANNEL", promoteToMain, "")
 				}
 			}
 		}
@@ -391,15 +396,8 @@ func (h handler) DeleteRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var room models.Room
-	if err := h.Collections.RoomCollection.FindOne(r.Context(), bson.M{"_id": id}).Decode(&room); err != nil {
-		if err != mongo.ErrNoDocuments {
-			responseMessage(w, http.StatusInternalServerError, "Internal error")
-			return
-		}
-	}
-	if room.Author != user.ID {
-		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+	if err := helpers.CheckRoomPermission(r.Context(), *h.Collections, id, user.ID, models.PermissionOwner); err != nil {
+		roomPermissionErrorResponse(w, err)
 		return
 	}
 
@@ -434,8 +432,8 @@ func (h handler) UploadRoomImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if room.Author != user.ID {
-		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+	if err := helpers.CheckRoomPermission(r.Context(), *h.Collections, id, user.ID, models.PermissionOwner); err != nil {
+		roomPermissionErrorResponse(w, err)
 		return
 	}
 
@@ -535,6 +533,8 @@ func (h handler) UploadRoomImage(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	helpers.WriteRoomAuditLog(r.Context(), *h.Collections, id, user.ID, "UPDATE_ROOM_IMAGE", primitive.NilObjectID, "")
+
 	if foundImage {
 		responseMessage(w, http.StatusOK, "Image updated")
 	} else {
@@ -609,32 +609,14 @@ func (h handler) GetRoomPage(w http.ResponseWriter, r *http.Request) {
 
 	outRooms := []models.Room{}
 	for _, room := range rooms {
-		var roomExternalData models.RoomExternalData
-		if err := h.Collections.RoomExternalDataCollection.FindOne(r.Context(), bson.M{"_id": room.ID}).Decode(&roomExternalData); err != nil {
+		// Leave out rooms the user is banned from, and private rooms they aren't a member of
+		if _, err := helpers.GetRoomPermissions(r.Context(), *h.Collections, room.ID, user.ID); err != nil {
+			if err == helpers.ErrRoomBanned || err == helpers.ErrRoomNotMember {
+				continue
+			}
 			responseMessage(w, http.StatusInternalServerError, "Internal error")
 			return
 		}
-		addRoom := true
-		// If user is banned from a room don't add it to the response
-		for _, oi := range roomExternalData.Banned {
-			if oi == user.ID {
-				addRoom = false
-				break
-			}
-		}
-		isMember := room.Author == user.ID
-		if !isMember {
-			// If user is not a member, and the room is private, don't add it to the response
-			for _, oi := range roomExternalData.Members {
-				if oi == user.ID {
-					isMember = true
-					break
-				}
-			}
-		}
-		if !addRoom || roomExternalData.Private && !isMember {
-			continue
-		}
 		outRooms = append(outRooms, room)
 	}
 
@@ -691,13 +673,9 @@ func (h handler) GetRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	roomExternalData := &models.RoomExternalData{}
-	if err := h.Collections.RoomExternalDataCollection.FindOne(r.Context(), bson.M{"_id": id}).Decode(&roomExternalData); err != nil {
-		if err != mongo.ErrNoDocuments {
-			responseMessage(w, http.StatusInternalServerError, "Internal error")
-		} else {
-			responseMessage(w, http.StatusNotFound, "Room not found")
-		}
+	permissions, roomExternalData, err := helpers.GetRoomPermissionsAndExternalData(r.Context(), *h.Collections, id, user.ID)
+	if err != nil {
+		roomPermissionErrorResponse(w, err)
 		return
 	}
 
@@ -711,33 +689,20 @@ func (h handler) GetRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if room.Author != user.ID {
-		for _, oi := range roomExternalData.Banned {
-			if oi == user.ID {
-				responseMessage(w, http.StatusUnauthorized, "You are banned from this room")
-				return
-			}
-		}
-		if roomExternalData.Private {
-			isMember := false
-			for _, oi := range roomExternalData.Members {
-				if oi == user.ID {
-					isMember = true
-					break
-				}
-			}
-			if !isMember {
-				responseMessage(w, http.StatusForbidden, "You are not a member of this room")
-				return
-			}
-		}
-	}
-
 	room.Private = roomExternalData.Private
 	room.Members = roomExternalData.Members
 	room.Banned = roomExternalData.Banned
 	room.Channels = roomInternalData.Channels
 	room.MainChannel = roomInternalData.MainChannel
+	room.Roles = roomExternalData.Roles
+	room.RoleAssignments = roomExternalData.RoleAssignments
+	room.Permissions = permissions
+	if permissions&models.PermissionBan != 0 {
+		room.BanRecords = roomExternalData.BanRecords
+	}
+	if permissions&models.PermissionMute != 0 {
+		room.Mutes = roomExternalData.Mutes
+	}
 
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -767,38 +732,11 @@ func (h handler) GetRoomDisplayData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	roomExternalData := &models.RoomExternalData{}
-	if err := h.Collections.RoomExternalDataCollection.FindOne(r.Context(), bson.M{"_id": id}).Decode(&roomExternalData); err != nil {
-		if err != mongo.ErrNoDocuments {
-			responseMessage(w, http.StatusInternalServerError, "Internal error")
-		} else {
-			responseMessage(w, http.StatusNotFound, "Room not found")
-		}
+	if _, err := helpers.GetRoomPermissions(r.Context(), *h.Collections, id, user.ID); err != nil {
+		roomPermissionErrorResponse(w, err)
 		return
 	}
 
-	if room.Author != user.ID {
-		for _, oi := range roomExternalData.Banned {
-			if oi == user.ID {
-				responseMessage(w, http.StatusUnauthorized, "You are banned from this room")
-				return
-			}
-		}
-		if roomExternalData.Private {
-			isMember := false
-			for _, oi := range roomExternalData.Members {
-				if oi == user.ID {
-					isMember = true
-					break
-				}
-			}
-			if !isMember {
-				responseMessage(w, http.StatusForbidden, "You are not a member of this room")
-				return
-			}
-		}
-	}
-
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(room)
@@ -817,46 +755,11 @@ func (h handler) GetRoomImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	roomExternalData := &models.RoomExternalData{}
-	if err := h.Collections.RoomExternalDataCollection.FindOne(r.Context(), bson.M{"_id": id}).Decode(&roomExternalData); err != nil {
-		if err == mongo.ErrNoDocuments {
-			responseMessage(w, http.StatusNotFound, "Not found")
-		} else {
-			responseMessage(w, http.StatusInternalServerError, "Internal error")
-		}
-		return
-	}
-	room := &models.Room{}
-	if err := h.Collections.RoomCollection.FindOne(r.Context(), bson.M{"_id": id}).Decode(&room); err != nil {
-		if err == mongo.ErrNoDocuments {
-			responseMessage(w, http.StatusNotFound, "Not found")
-		} else {
-			responseMessage(w, http.StatusInternalServerError, "Internal error")
-		}
+	if _, err := helpers.GetRoomPermissions(r.Context(), *h.Collections, id, user.ID); err != nil {
+		roomPermissionErrorResponse(w, err)
 		return
 	}
 
-	for _, oi := range roomExternalData.Banned {
-		if oi == user.ID {
-			responseMessage(w, http.StatusUnauthorized, "You are banned from this room")
-			return
-		}
-	}
-
-	if roomExternalData.Private && room.Author != user.ID {
-		isMember := false
-		for _, oi := range roomExternalData.Members {
-			if oi == user.ID {
-				isMember = true
-				break
-			}
-		}
-		if !isMember {
-			responseMessage(w, http.StatusForbidden, "You are not a member of this room")
-			return
-		}
-	}
-
 	roomImage := &models.RoomImage{}
 	if err := h.Collections.RoomImageCollection.FindOne(r.Context(), bson.M{"_id": id}).Decode(&roomImage); err != nil {
 		if err == mongo.ErrNoDocuments {
@@ -887,13 +790,9 @@ func (h handler) GetRoomChannelsData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	roomExternalData := &models.RoomExternalData{}
-	if err := h.Collections.RoomExternalDataCollection.FindOne(r.Context(), bson.M{"_id": roomId}).Decode(&roomExternalData); err != nil {
-		if err == mongo.ErrNoDocuments {
-			responseMessage(w, http.StatusNotFound, "Not found")
-		} else {
-			responseMessage(w, http.StatusInternalServerError, "Internal error")
-		}
+	permissions, roomExternalData, err := helpers.GetRoomPermissionsAndExternalData(r.Context(), *h.Collections, roomId, user.ID)
+	if err != nil {
+		roomPermissionErrorResponse(w, err)
 		return
 	}
 	roomInternalData := &models.RoomInternalData{}
@@ -905,36 +804,6 @@ func (h handler) GetRoomChannelsData(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	room := &models.Room{}
-	if err := h.Collections.RoomCollection.FindOne(r.Context(), bson.M{"_id": roomId}).Decode(&room); err != nil {
-		if err == mongo.ErrNoDocuments {
-			responseMessage(w, http.StatusNotFound, "Not found")
-		} else {
-			responseMessage(w, http.StatusInternalServerError, "Internal error")
-		}
-		return
-	}
-
-	for _, oi := range roomExternalData.Banned {
-		if oi == user.ID {
-			responseMessage(w, http.StatusUnauthorized, "You are banned from this room")
-			return
-		}
-	}
-
-	if roomExternalData.Private && room.Author != user.ID {
-		isMember := false
-		for _, oi := range roomExternalData.Members {
-			if oi == user.ID {
-				isMember = true
-				break
-			}
-		}
-		if !isMember {
-			responseMessage(w, http.StatusForbidden, "You are not a member of this room")
-			return
-		}
-	}
 
 	channels := []models.RoomChannel{}
 	if cursor, err := h.Collections.RoomChannelCollection.Find(r.Context(), bson.M{
@@ -962,16 +831,39 @@ func (h handler) GetRoomChannelsData(w http.ResponseWriter, r *http.Request) {
 				responseMessage(w, http.StatusInternalServerError, "Internal error")
 				return
 			}
+			// Leave out hidden channels the user cannot see
+			if helpers.ApplyChannelOverrides(channel, roomExternalData, user.ID, permissions)&models.PermissionViewChannel == 0 {
+				continue
+			}
 			channels = append(channels, *channel)
 		}
 		cursor.Close(r.Context())
 	}
 
+	channelIds := []primitive.ObjectID{}
+	for _, channel := range channels {
+		channelIds = append(channelIds, channel.ID)
+	}
+	markers, err := helpers.GetReadMarkers(r.Context(), *h.Collections, user.ID, channelIds)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	unread, err := helpers.CountUnread(r.Context(), h.Collections.RoomMessageCollection, bson.M{"author": bson.M{"$ne": user.ID}}, "channel_id", channelIds, markers)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	for i, channel := range channels {
+		channels[i].Unread = unread[channel.ID]
+	}
+
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(channels)
 }
 
+// Messages are paged with the "before" and "limit" query params, see helpers.GetMessagePageFromRequest
 func (h handler) GetRoomChannel(w http.ResponseWriter, r *http.Request) {
 	user, err := helpers.GetUserFromRequest(r, r.Context(), *h.Collections, h.RedisClient)
 	if err != nil {
@@ -990,47 +882,18 @@ func (h handler) GetRoomChannel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	room := &models.Room{}
-	if err := h.Collections.RoomCollection.FindOne(r.Context(), bson.M{"_id": roomId}).Decode(&room); err != nil {
-		if err == mongo.ErrNoDocuments {
-			responseMessage(w, http.StatusNotFound, "Not found")
-		} else {
-			responseMessage(w, http.StatusInternalServerError, "Internal error")
-		}
+	page, err := helpers.GetMessagePageFromRequest(r)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	roomExternalData := &models.RoomExternalData{}
-	if err := h.Collections.RoomExternalDataCollection.FindOne(r.Context(), bson.M{"_id": roomId}).Decode(&roomExternalData); err != nil {
-		if err == mongo.ErrNoDocuments {
-			responseMessage(w, http.StatusNotFound, "Room not found")
-		} else {
-			responseMessage(w, http.StatusInternalServerError, "Internal error")
-		}
+	permissions, roomExternalData, err := helpers.GetRoomPermissionsAndExternalData(r.Context(), *h.Collections, roomId, user.ID)
+	if err != nil {
+		roomPermissionErrorResponse(w, err)
 		return
 	}
 
-	for _, oi := range roomExternalData.Banned {
-		if oi == user.ID {
-			responseMessage(w, http.StatusUnauthorized, "You are banned from this room")
-			return
-		}
-	}
-
-	if roomExternalData.Private && room.Author != user.ID {
-		isMember := false
-		for _, oi := range roomExternalData.Members {
-			if oi == user.ID {
-				isMember = true
-				break
-			}
-		}
-		if !isMember {
-			responseMessage(w, http.StatusForbidden, "You are not a member of this room")
-			return
-		}
-	}
-
 	roomChannel := &models.RoomChannel{}
 	if err := h.Collections.RoomChannelCollection.FindOne(r.Context(), bson.M{"_id": id}).Decode(&roomChannel); err != nil {
 		if err == mongo.ErrNoDocuments {
@@ -1045,20 +908,620 @@ func (h handler) GetRoomChannel(w http.ResponseWriter, r *http.Request) {
 		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
+	if helpers.ApplyChannelOverrides(roomChannel, roomExternalData, user.ID, permissions)&models.PermissionViewChannel == 0 {
+		responseMessage(w, http.StatusNotFound, "Channel not found")
+		return
+	}
 
-	roomChannelMessages := &models.RoomChannelMessages{}
-	if err := h.Collections.RoomChannelMessagesCollection.FindOne(r.Context(), bson.M{"_id": id}).Decode(&roomChannelMessages); err != nil {
-		if err == mongo.ErrNoDocuments {
-			responseMessage(w, http.StatusNotFound, "Channel not found")
-		} else {
-			responseMessage(w, http.StatusInternalServerError, "Internal error")
-		}
+	// Replies are fetched by thread
+	filter := bson.M{"channel_id": id, "reply_to": bson.M{"$exists": false}}
+	if !page.Before.IsZero() {
+		filter["_id"] = bson.M{"$lt": page.Before}
+	}
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "_id", Value: -1}})
+	findOptions.SetLimit(int64(page.Limit))
+	findOptions.SetProjection(bson.M{"revisions": 0})
+
+	cursor, err := h.Collections.RoomMessageCollection.Find(r.Context(), filter, findOptions)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	newestFirst := []models.RoomChannelMessage{}
+	if err := cursor.All(r.Context(), &newestFirst); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	blocked, err := helpers.GetBlockedUids(r.Context(), *h.Collections, user.ID)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
 		return
 	}
 
-	roomChannel.Messages = roomChannelMessages.Messages
+	roomChannel.Messages = make([]models.RoomChannelMessage, len(newestFirst))
+	for i, rcm := range newestFirst {
+		rcm.Reactions = helpers.FilterBlockedReactions(rcm.Reactions, blocked)
+		roomChannel.Messages[len(newestFirst)-1-i] = rcm
+	}
+
+	roomChannel.Pinned = []models.RoomChannelMessage{}
+	if err := helpers.GetPinnedMessages(r.Context(), h.Collections.RoomMessageCollection, bson.M{"channel_id": id}, &roomChannel.Pinned); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	for i, rcm := range roomChannel.Pinned {
+		roomChannel.Pinned[i].Reactions = helpers.FilterBlockedReactions(rcm.Reactions, blocked)
+	}
 
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(roomChannel)
 }
+
+// Removes the user from the room without banning them, the same as the KICK socket event
+func (h handler) KickFromRoom(w http.ResponseWriter, r *http.Request) {
+	user, err := helpers.GetUserFromRequest(r, r.Context(), *h.Collections, h.RedisClient)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	roomId, err := primitive.ObjectIDFromHex(mux.Vars(r)["roomId"])
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	kickedUid, err := primitive.ObjectIDFromHex(mux.Vars(r)["uid"])
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	if err := kickFromRoom(roomId, kickedUid, user.ID, h.SocketServer, h.RoomCallServer, h.Collections); err != nil {
+		switch err {
+		case mongo.ErrNoDocuments, helpers.ErrRoomBanned, helpers.ErrRoomNotMember, helpers.ErrRoomMissingPermission, helpers.ErrRoomTargetModerator:
+			roomPermissionErrorResponse(w, err)
+		default:
+			responseMessage(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+
+	responseMessage(w, http.StatusOK, "User kicked")
+}
+
+// Only the room owner can manage roles
+func (h handler) CreateRoomRole(w http.ResponseWriter, r *http.Request) {
+	user, err := helpers.GetUserFromRequest(r, r.Context(), *h.Collections, h.RedisClient)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	roomId, err := primitive.ObjectIDFromHex(mux.Vars(r)["roomId"])
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	var roleInput validation.RoomRole
+	if err := json.Unmarshal(body, &roleInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	validate := validator.New()
+	if err := validate.Struct(roleInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	if err := helpers.CheckRoomPermission(r.Context(), *h.Collections, roomId, user.ID, models.PermissionOwner); err != nil {
+		roomPermissionErrorResponse(w, err)
+		return
+	}
+
+	role := models.RoomRole{
+		ID:          primitive.NewObjectID(),
+		Name:        strings.TrimSpace(roleInput.Name),
+		Permissions: models.RoomPermission(roleInput.Permissions) & models.PermissionAllRoles,
+	}
+	// Max 16 roles
+	if res, err := h.Collections.RoomExternalDataCollection.UpdateOne(r.Context(), bson.M{
+		"_id":      roomId,
+		"roles.15": bson.M{"$exists": false},
+	}, bson.M{
+		"$push": bson.M{
+			"roles": role,
+		},
+	}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	} else if res.MatchedCount == 0 {
+		responseMessage(w, http.StatusBadRequest, "Too many roles. Max 16.")
+		return
+	}
+
+	helpers.WriteRoomAuditLog(r.Context(), *h.Collections, roomId, user.ID, "CREATE_ROLE", role.ID, "Name: "+role.Name)
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(role)
+}
+
+func (h handler) UpdateRoomRole(w http.ResponseWriter, r *http.Request) {
+	user, err := helpers.GetUserFromRequest(r, r.Context(), *h.Collections, h.RedisClient)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	roomId, err := primitive.ObjectIDFromHex(mux.Vars(r)["roomId"])
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	roleId, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	var roleInput validation.RoomRole
+	if err := json.Unmarshal(body, &roleInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	validate := validator.New()
+	if err := validate.Struct(roleInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	if err := helpers.CheckRoomPermission(r.Context(), *h.Collections, roomId, user.ID, models.PermissionOwner); err != nil {
+		roomPermissionErrorResponse(w, err)
+		return
+	}
+
+	if res, err := h.Collections.RoomExternalDataCollection.UpdateOne(r.Context(), bson.M{
+		"_id":       roomId,
+		"roles._id": roleId,
+	}, bson.M{
+		"$set": bson.M{
+			"roles.$.name":        strings.TrimSpace(roleInput.Name),
+			"roles.$.permissions": models.RoomPermission(roleInput.Permissions) & models.PermissionAllRoles,
+		},
+	}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	} else if res.MatchedCount == 0 {
+		responseMessage(w, http.StatusNotFound, "Role not found")
+		return
+	}
+
+	helpers.WriteRoomAuditLog(r.Context(), *h.Collections, roomId, user.ID, "UPDATE_ROLE", roleId, "Name: "+strings.TrimSpace(roleInput.Name))
+
+	responseMessage(w, http.StatusOK, "Role updated")
+}
+
+// Users that had the role are given the default role. The default role cannot be deleted.
+func (h handler) DeleteRoomRole(w http.ResponseWriter, r *http.Request) {
+	user, err := helpers.GetUserFromRequest(r, r.Context(), *h.Collections, h.RedisClient)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	roomId, err := primitive.ObjectIDFromHex(mux.Vars(r)["roomId"])
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	roleId, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	if err := helpers.CheckRoomPermission(r.Context(), *h.Collections, roomId, user.ID, models.PermissionOwner); err != nil {
+		roomPermissionErrorResponse(w, err)
+		return
+	}
+
+	if res, err := h.Collections.RoomExternalDataCollection.UpdateOne(r.Context(), bson.M{
+		"_id": roomId,
+		"roles": bson.M{
+			"$elemMatch": bson.M{
+				"_id":     roleId,
+				"default": bson.M{"$ne": true},
+			},
+		},
+	}, bson.M{
+		"$pull": bson.M{
+			"roles":            bson.M{"_id": roleId},
+			"role_assignments": bson.M{"role_id": roleId},
+		},
+	}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	} else if res.MatchedCount == 0 {
+		responseMessage(w, http.StatusNotFound, "Role not found")
+		return
+	}
+
+	helpers.WriteRoomAuditLog(r.Context(), *h.Collections, roomId, user.ID, "DELETE_ROLE", roleId, "")
+
+	responseMessage(w, http.StatusOK, "Role deleted")
+}
+
+func (h handler) AssignRoomRole(w http.ResponseWriter, r *http.Request) {
+	user, err := helpers.GetUserFromRequest(r, r.Context(), *h.Collections, h.RedisClient)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	roomId, err := primitive.ObjectIDFromHex(mux.Vars(r)["roomId"])
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	var assignmentInput validation.RoomRoleAssignment
+	if err := json.Unmarshal(body, &assignmentInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	validate := validator.New()
+	if err := validate.Struct(assignmentInput); err != nil {
+		responseMessage(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	uid, err := primitive.ObjectIDFromHex(assignmentInput.Uid)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	if err := helpers.CheckRoomPermission(r.Context(), *h.Collections, roomId, user.ID, models.PermissionOwner); err != nil {
+		roomPermissionErrorResponse(w, err)
+		return
+	}
+	if uid == user.ID {
+		responseMessage(w, http.StatusBadRequest, "You cannot assign a role to yourself")
+		return
+	}
+
+	// Makes sure the user isn't banned, and is a member if the room is private
+	_, roomExternalData, err := helpers.GetRoomPermissionsAndExternalData(r.Context(), *h.Collections, roomId, uid)
+	if err != nil {
+		if err == helpers.ErrRoomBanned || err == helpers.ErrRoomNotMember {
+			responseMessage(w, http.StatusBadRequest, "This user cannot be given a role in this room")
+		} else {
+			roomPermissionErrorResponse(w, err)
+		}
+		return
+	}
+
+	var roleId primitive.ObjectID
+	if assignmentInput.RoleID != "" {
+		if roleId, err = primitive.ObjectIDFromHex(assignmentInput.RoleID); err != nil {
+			responseMessage(w, http.StatusBadRequest, "Invalid ID")
+			return
+		}
+		found := false
+		for _, role := range roomExternalData.Roles {
+			if role.ID == roleId {
+				found = true
+				break
+			}
+		}
+		if !found {
+			responseMessage(w, http.StatusNotFound, "Role not found")
+			return
+		}
+	}
+
+	if _, err := h.Collections.RoomExternalDataCollection.UpdateByID(r.Context(), roomId, bson.M{
+		"$pull": bson.M{
+			"role_assignments": bson.M{"uid": uid},
+		},
+	}); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if !roleId.IsZero() {
+		if _, err := h.Collections.RoomExternalDataCollection.UpdateByID(r.Context(), roomId, bson.M{
+			"$push": bson.M{
+				"role_assignments": models.RoomRoleAssignment{
+					Uid:    uid,
+					RoleID: roleId,
+				},
+			},
+		}); err != nil {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+	}
+
+	if roleId.IsZero() {
+		helpers.WriteRoomAuditLog(r.Context(), *h.Collections, roomId, user.ID, "ASSIGN_ROLE", uid, "Default role")
+	} else {
+		helpers.WriteRoomAuditLog(r.Context(), *h.Collections, roomId, user.ID, "ASSIGN_ROLE", uid, "Role: "+roleId.Hex())
+	}
+
+	responseMessage(w, http.StatusOK, "Role assigned")
+}
+
+// Owners and users with any moderation permission can see the audit log. Can be filtered with the actor and action query params.
+func (h handler) GetRoomAuditLog(w http.ResponseWriter, r *http.Request) {
+	user, err := helpers.GetUserFromRequest(r, r.Context(), *h.Collections, h.RedisClient)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	roomId, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	pageNumber := 1
+	if pageNumberString := r.URL.Query().Get("page"); pageNumberString != "" {
+		if pageNumber, err = strconv.Atoi(pageNumberString); err != nil || pageNumber < 1 {
+			responseMessage(w, http.StatusBadRequest, "Invalid page")
+			return
+		}
+	}
+	pageSize := 20
+
+	permissions, err := helpers.GetRoomPermissions(r.Context(), *h.Collections, roomId, user.ID)
+	if err != nil {
+		roomPermissionErrorResponse(w, err)
+		return
+	}
+	if permissions&(models.PermissionsModeration|models.PermissionOwner) == 0 {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	filter := bson.M{"room_id": roomId}
+	if actorHex := r.URL.Query().Get("actor"); actorHex != "" {
+		actor, err := primitive.ObjectIDFromHex(actorHex)
+		if err != nil {
+			responseMessage(w, http.StatusBadRequest, "Invalid ID")
+			return
+		}
+		filter["actor"] = actor
+	}
+	if action := r.URL.Query().Get("action"); action != "" {
+		filter["action"] = strings.ToUpper(action)
+	}
+
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "created_at", Value: -1}})
+	findOptions.SetLimit(int64(pageSize))
+	findOptions.SetSkip(int64(pageSize) * (int64(pageNumber) - 1))
+
+	auditLogs := []models.RoomAuditLog{}
+	if cursor, err := h.Collections.RoomAuditLogCollection.Find(r.Context(), filter, findOptions); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	} else {
+		if err := cursor.All(r.Context(), &auditLogs); err != nil {
+			cursor.Close(r.Context())
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(auditLogs)
+}
+
+// Gets the first message of a thread and a page of its replies. Paged the same as GetRoomChannel.
+func (h handler) GetRoomThread(w http.ResponseWriter, r *http.Request) {
+	user, err := helpers.GetUserFromRequest(r, r.Context(), *h.Collections, h.RedisClient)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	channelId, err := primitive.ObjectIDFromHex(mux.Vars(r)["channelId"])
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	msgId, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	page, err := helpers.GetMessagePageFromRequest(r)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if _, _, err := checkRoomChannelAccess(channelId, user.ID, h.Collections); err != nil {
+		switch err {
+		case helpers.ErrRoomBanned, helpers.ErrRoomNotMember, helpers.ErrRoomMissingPermission:
+			roomPermissionErrorResponse(w, err)
+		default:
+			responseMessage(w, http.StatusNotFound, "Channel not found")
+		}
+		return
+	}
+
+	parent := &models.RoomChannelMessage{}
+	if err := h.Collections.RoomMessageCollection.FindOne(r.Context(), bson.M{"_id": msgId, "channel_id": channelId}).Decode(&parent); err != nil {
+		if err == mongo.ErrNoDocuments {
+			responseMessage(w, http.StatusNotFound, "Message not found")
+		} else {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+		}
+		return
+	}
+
+	filter := bson.M{"reply_to": msgId}
+	if !page.Before.IsZero() {
+		filter["_id"] = bson.M{"$lt": page.Before}
+	}
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "_id", Value: -1}})
+	findOptions.SetLimit(int64(page.Limit))
+	findOptions.SetProjection(bson.M{"revisions": 0})
+
+	cursor, err := h.Collections.RoomMessageCollection.Find(r.Context(), filter, findOptions)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	newestFirst := []models.RoomChannelMessage{}
+	if err := cursor.All(r.Context(), &newestFirst); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	blocked, err := helpers.GetBlockedUids(r.Context(), *h.Collections, user.ID)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	parent.Reactions = helpers.FilterBlockedReactions(parent.Reactions, blocked)
+	replies := make([]models.RoomChannelMessage, len(newestFirst))
+	for i, rcm := range newestFirst {
+		rcm.Reactions = helpers.FilterBlockedReactions(rcm.Reactions, blocked)
+		replies[len(newestFirst)-1-i] = rcm
+	}
+
+	out := make(map[string]interface{})
+	out["parent"] = parent
+	out["replies"] = replies
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(out)
+}
+
+// Gets the previous versions of a message, oldest first. Only for the author and moderators.
+func (h handler) GetRoomMessageRevisions(w http.ResponseWriter, r *http.Request) {
+	user, err := helpers.GetUserFromRequest(r, r.Context(), *h.Collections, h.RedisClient)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	channelId, err := primitive.ObjectIDFromHex(mux.Vars(r)["channelId"])
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	msgId, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	_, permissions, err := checkRoomChannelAccess(channelId, user.ID, h.Collections)
+	if err != nil {
+		switch err {
+		case helpers.ErrRoomBanned, helpers.ErrRoomNotMember, helpers.ErrRoomMissingPermission:
+			roomPermissionErrorResponse(w, err)
+		default:
+			responseMessage(w, http.StatusNotFound, "Channel not found")
+		}
+		return
+	}
+
+	msg := &models.RoomChannelMessage{}
+	if err := h.Collections.RoomMessageCollection.FindOne(r.Context(), bson.M{"_id": msgId, "channel_id": channelId}).Decode(&msg); err != nil {
+		if err == mongo.ErrNoDocuments {
+			responseMessage(w, http.StatusNotFound, "Message not found")
+		} else {
+			responseMessage(w, http.StatusInternalServerError, "Internal error")
+		}
+		return
+	}
+
+	if msg.Author != user.ID && permissions&(models.PermissionsModeration|models.PermissionOwner) == 0 {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	revisions := msg.Revisions
+	if revisions == nil {
+		revisions = []models.MessageRevision{}
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// Gets the pinned messages in a channel, most recently pinned first. Also returned with GetRoomChannel.
+func (h handler) GetRoomChannelPins(w http.ResponseWriter, r *http.Request) {
+	user, err := helpers.GetUserFromRequest(r, r.Context(), *h.Collections, h.RedisClient)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	channelId, err := primitive.ObjectIDFromHex(mux.Vars(r)["channelId"])
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	if _, _, err := checkRoomChannelAccess(channelId, user.ID, h.Collections); err != nil {
+		switch err {
+		case helpers.ErrRoomBanned, helpers.ErrRoomNotMember, helpers.ErrRoomMissingPermission:
+			roomPermissionErrorResponse(w, err)
+		default:
+			responseMessage(w, http.StatusNotFound, "Channel not found")
+		}
+		return
+	}
+
+	pinned := []models.RoomChannelMessage{}
+	if err := helpers.GetPinnedMessages(r.Context(), h.Collections.RoomMessageCollection, bson.M{"channel_id": channelId}, &pinned); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	blocked, err := helpers.GetBlockedUids(r.Context(), *h.Collections, user.ID)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	for i, rcm := range pinned {
+		pinned[i].Reactions = helpers.FilterBlockedReactions(rcm.Reactions, blocked)
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(pinned)
+}
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+	"github.com/web-stuff-98/electron-social-chat/pkg/db/models"
+	"github.com/web-stuff-98/electron-social-chat/pkg/helpers"
+	"github.com/web-stuff-98/electron-social-chat/pkg/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	Message search uses the content_text indexes. Results are newest first and
+	paged with the "page" query param. Messages include the channel or the
+	users in the conversation, and reply_to for replies, so the client can
+	open the message where it was sent.
+*/
+
+// Searches the channels in the room the user can see
+func (h handler) SearchRoomMessages(w http.ResponseWriter, r *http.Request) {
+	user, err := helpers.GetUserFromRequest(r, r.Context(), *h.Collections, h.RedisClient)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	roomId, err := primitive.ObjectIDFromHex(mux.Vars(r)["roomId"])
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	searchInput, findOptions, err := getMessageSearchFromRequest(r)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filter, err := messageSearchFilter(searchInput)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	channelIds, err := helpers.GetVisibleRoomChannelIDs(r.Context(), *h.Collections, roomId, user.ID)
+	if err != nil {
+		roomPermissionErrorResponse(w, err)
+		return
+	}
+	if searchInput.Channel != "" {
+		channelId, err := primitive.ObjectIDFromHex(searchInput.Channel)
+		if err != nil {
+			responseMessage(w, http.StatusBadRequest, "Invalid ID")
+			return
+		}
+		visible := false
+		for _, oi := range channelIds {
+			if oi == channelId {
+				visible = true
+				break
+			}
+		}
+		if !visible {
+			responseMessage(w, http.StatusNotFound, "Channel not found")
+			return
+		}
+		channelIds = []primitive.ObjectID{channelId}
+	}
+	filter["channel_id"] = bson.M{"$in": channelIds}
+
+	cursor, err := h.Collections.RoomMessageCollection.Find(r.Context(), filter, findOptions)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	results := []models.RoomChannelMessage{}
+	if err := cursor.All(r.Context(), &results); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	blocked, err := helpers.GetBlockedUids(r.Context(), *h.Collections, user.ID)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	for i, rcm := range results {
+		results[i].Reactions = helpers.FilterBlockedReactions(rcm.Reactions, blocked)
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(results)
+}
+
+// Searches the users conversations, leaving out conversations where either user blocked the other
+func (h handler) SearchDirectMessages(w http.ResponseWriter, r *http.Request) {
+	user, err := helpers.GetUserFromRequest(r, r.Context(), *h.Collections, h.RedisClient)
+	if err != nil {
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	searchInput, findOptions, err := getMessageSearchFromRequest(r)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filter, err := messageSearchFilter(searchInput)
+	if err != nil {
+		responseMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	blocked, err := helpers.GetBlockedUids(r.Context(), *h.Collections, user.ID)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	excluded := append([]primitive.ObjectID{}, blocked...)
+	cursor, err := h.Collections.UserMessagingDataCollection.Find(r.Context(), bson.M{"blocked": user.ID}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	blockedBy := []models.UserMessagingData{}
+	if err := cursor.All(r.Context(), &blockedBy); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	for _, umd := range blockedBy {
+		excluded = append(excluded, umd.ID)
+	}
+
+	converse := bson.M{"$nin": excluded}
+	if searchInput.Uid != "" {
+		converseId, err := primitive.ObjectIDFromHex(searchInput.Uid)
+		if err != nil {
+			responseMessage(w, http.StatusBadRequest, "Invalid ID")
+			return
+		}
+		for _, oi := range excluded {
+			if oi == converseId {
+				responseMessage(w, http.StatusNotFound, "Conversation not found")
+				return
+			}
+		}
+		converse = bson.M{"$eq": converseId}
+	}
+	filter["$or"] = bson.A{
+		bson.M{"author": user.ID, "recipient": converse},
+		bson.M{"recipient": user.ID, "author": converse},
+	}
+
+	cursor, err = h.Collections.DirectMessageCollection.Find(r.Context(), filter, findOptions)
+	if err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	results := []models.DirectMessage{}
+	if err := cursor.All(r.Context(), &results); err != nil {
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(results)
+}
+
+// Reads the search from the body, and the page from the "page" query param
+func getMessageSearchFromRequest(r *http.Request) (validation.MessageSearch, *options.FindOptions, error) {
+	var searchInput validation.MessageSearch
+
+	pageNumber := 1
+	if pageNumberString := r.URL.Query().Get("page"); pageNumberString != "" {
+		var err error
+		if pageNumber, err = strconv.Atoi(pageNumberString); err != nil || pageNumber < 1 {
+			return searchInput, nil, fmt.Errorf("Invalid page")
+		}
+	}
+	pageSize := 20
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return searchInput, nil, fmt.Errorf("Bad request")
+	}
+	if err := json.Unmarshal(body, &searchInput); err != nil {
+		return searchInput, nil, fmt.Errorf("Bad request")
+	}
+	validate := validator.New()
+	if err := validate.Struct(searchInput); err != nil {
+		return searchInput, nil, fmt.Errorf("Bad request")
+	}
+
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "_id", Value: -1}})
+	findOptions.SetSkip(int64(pageSize) * (int64(pageNumber) - 1))
+	findOptions.SetLimit(int64(pageSize))
+	findOptions.SetProjection(bson.M{"revisions": 0})
+
+	return searchInput, findOptions, nil
+}
+
+// The text, author and date parts of the filter, shared by room and direct message search
+func messageSearchFilter(searchInput validation.MessageSearch) (bson.M, error) {
+	filter := bson.M{
+		"$text": bson.M{
+			"$search":        searchInput.Query,
+			"$caseSensitive": false,
+		},
+	}
+	if searchInput.Author != "" {
+		author, err := primitive.ObjectIDFromHex(searchInput.Author)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ID")
+		}
+		filter["author"] = author
+	}
+	createdAt := bson.M{}
+	if searchInput.After != "" {
+		after, err := time.Parse(time.RFC3339, searchInput.After)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid date")
+		}
+		createdAt["$gte"] = primitive.NewDateTimeFromTime(after)
+	}
+	if searchInput.Before != "" {
+		before, err := time.Parse(time.RFC3339, searchInput.Before)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid date")
+		}
+		createdAt["$lt"] = primitive.NewDateTimeFromTime(before)
+	}
+	if len(createdAt) > 0 {
+		filter["created_at"] = createdAt
+	}
+	return filter, nil
+}
@@ -10,7 +10,10 @@ import (
 	"github.com/web-stuff-98/electron-social-chat/pkg/callserver"
 	"github.com/web-stuff-98/electron-social-chat/pkg/db"
 	"github.com/web-stuff-98/electron-social-chat/pkg/helpers"
+	"github.com/web-stuff-98/electron-social-chat/pkg/linkpreviewserver"
+	"github.com/web-stuff-98/electron-social-chat/pkg/roomcallserver"
 	"github.com/web-stuff-98/electron-social-chat/pkg/socketserver"
+	"github.com/web-stuff-98/electron-social-chat/pkg/typingserver"
 
 	"github.com/gorilla/websocket"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -21,7 +24,7 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize: 2048,
 }
 
-func reader(conn *websocket.Conn, socketServer *socketserver.SocketServer, attachmentServer *attachmentserver.AttachmentServer, callServer *callserver.CallServer, uid *primitive.ObjectID, colls *db.Collections) {
+func reader(conn *websocket.Conn, socketServer *socketserver.SocketServer, attachmentServer *attachmentserver.AttachmentServer, callServer *callserver.CallServer, roomCallServer *roomcallserver.RoomCallServer, typingServer *typingserver.TypingServer, linkPreviewServer *linkpreviewserver.LinkPreviewServer, uid *primitive.ObjectID, colls *db.Collections) {
 	for {
 		defer func() {
 			r := recover()
@@ -42,7 +45,7 @@ func reader(conn *websocket.Conn, socketServer *socketserver.SocketServer, attac
 		eventType, eventTypeOk := data["event_type"]
 
 		if eventTypeOk {
-			err := HandleSocketEvent(eventType.(string), p, conn, *uid, socketServer, attachmentServer, callServer, colls)
+			err := HandleSocketEvent(eventType.(string), p, conn, *uid, socketServer, attachmentServer, callServer, roomCallServer, typingServer, linkPreviewServer, colls)
 			if err != nil {
 				sendErrorMessageThroughSocket(conn, err)
 			}
@@ -86,5 +89,5 @@ func (h handler) WebSocketEndpoint(w http.ResponseWriter, r *http.Request) {
 			Online: false,
 		}
 	}()
-	reader(ws, h.SocketServer, h.AttachmentServer, h.CallServer, &uid, h.Collections)
+	reader(ws, h.SocketServer, h.AttachmentServer, h.CallServer, h.RoomCallServer, h.TypingServer, h.LinkPreviewServer, &uid, h.Collections)
 }
@@ -13,8 +13,15 @@ import (
 	"github.com/web-stuff-98/electron-social-chat/pkg/callserver"
 	"github.com/web-stuff-98/electron-social-chat/pkg/db"
 	"github.com/web-stuff-98/electron-social-chat/pkg/db/models"
+	"github.com/web-stuff-98/electron-social-chat/pkg/helpers"
+	"github.com/web-stuff-98/electron-social-chat/pkg/linkpreview"
+	"github.com/web-stuff-98/electron-social-chat/pkg/linkpreviewserver"
+	"github.com/web-stuff-98/electron-social-chat/pkg/messagescheduler"
+	"github.com/web-stuff-98/electron-social-chat/pkg/richtext"
+	"github.com/web-stuff-98/electron-social-chat/pkg/roomcallserver"
 	"github.com/web-stuff-98/electron-social-chat/pkg/socketmodels"
 	"github.com/web-stuff-98/electron-social-chat/pkg/socketserver"
+	"github.com/web-stuff-98/electron-social-chat/pkg/typingserver"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -27,7 +34,7 @@ import (
 	which ones are inbound/outbound/both
 */
 
-func HandleSocketEvent(eventType string, data []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, cs *callserver.CallServer, colls *db.Collections) error {
+func HandleSocketEvent(eventType string, data []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, cs *callserver.CallServer, rcs *roomcallserver.RoomCallServer, ts *typingserver.TypingServer, lps *linkpreviewserver.LinkPreviewServer, colls *db.Collections) error {
 	switch eventType {
 	/* --------------- GENERAL EVENTS --------------- */
 	case "WATCH_USER":
@@ -49,22 +56,61 @@ func HandleSocketEvent(eventType string, data []byte, conn *websocket.Conn, uid
 		err := exitRoomChannel(data, conn, uid, ss, colls)
 		return err
 	case "ROOM_MESSAGE":
-		err := roomMessage(data, conn, uid, ss, colls)
+		err := roomMessage(data, conn, uid, ss, lps, colls)
 		return err
 	case "ROOM_MESSAGE_UPDATE":
-		err := roomMessageUpdate(data, conn, uid, ss, colls)
+		err := roomMessageUpdate(data, conn, uid, ss, lps, colls)
 		return err
 	case "ROOM_MESSAGE_DELETE":
 		err := roomMessageDelete(data, conn, uid, ss, as, colls)
 		return err
+	case "ROOM_MESSAGE_REACT":
+		err := roomMessageReact(data, conn, uid, ss, colls)
+		return err
 	case "DIRECT_MESSAGE":
-		err := directMessage(data, conn, uid, ss, colls)
+		err := directMessage(data, conn, uid, ss, lps, colls)
 		return err
 	case "DIRECT_MESSAGE_UPDATE":
-		err := directMessageUpdate(data, conn, uid, ss, colls)
+		err := directMessageUpdate(data, conn, uid, ss, lps, colls)
 		return err
 	case "DIRECT_MESSAGE_DELETE":
-		err := directMessageDelete(data, conn, uid, ss, colls)
+		err := directMessageDelete(data, conn, uid, ss, as, colls)
+		return err
+	case "DIRECT_MESSAGE_REACT":
+		err := directMessageReact(data, conn, uid, ss, colls)
+		return err
+	case "POLL_VOTE":
+		err := pollVote(data, conn, uid, ss, colls)
+		return err
+	case "POLL_CLOSE":
+		err := pollClose(data, conn, uid, ss, colls)
+		return err
+	case "FORWARD_MESSAGE":
+		err := forwardMessage(data, conn, uid, ss, colls)
+		return err
+	case "PIN":
+		err := pinMessage(data, conn, uid, ss, colls, false)
+		return err
+	case "UNPIN":
+		err := pinMessage(data, conn, uid, ss, colls, true)
+		return err
+	case "MARK_READ":
+		err := markRead(data, conn, uid, ss, colls)
+		return err
+	case "TYPING_START":
+		err := typing(data, conn, uid, ss, ts, colls, false)
+		return err
+	case "TYPING_STOP":
+		err := typing(data, conn, uid, ss, ts, colls, true)
+		return err
+	case "SCHEDULE_MESSAGE":
+		err := scheduleMessage(data, conn, uid, ss, colls)
+		return err
+	case "SCHEDULE_REMINDER":
+		err := scheduleReminder(data, conn, uid, ss, colls)
+		return err
+	case "SCHEDULED_DELETE":
+		err := scheduledDelete(data, conn, uid, ss, colls)
 		return err
 	case "FRIEND_REQUEST":
 		err := friendRequest(data, conn, uid, ss, colls)
@@ -85,17 +131,26 @@ func HandleSocketEvent(eventType string, data []byte, conn *websocket.Conn, uid
 		err := deleteInvitationToRoom(data, conn, uid, ss, colls)
 		return err
 	case "BLOCK":
-		err := blockUser(data, conn, uid, ss, as, colls)
+		err := blockUser(data, conn, uid, ss, as, cs, rcs, colls)
 		return err
 	case "UNBLOCK":
 		err := unblockUser(data, conn, uid, ss, as, colls)
 		return err
 	case "BAN":
-		err := banUser(data, conn, uid, ss, as, colls)
+		err := banUser(data, conn, uid, ss, as, cs, rcs, colls)
 		return err
 	case "UNBAN":
 		err := unbanUser(data, conn, uid, ss, as, colls)
 		return err
+	case "KICK":
+		err := kickUser(data, conn, uid, ss, rcs, colls)
+		return err
+	case "MUTE":
+		err := muteUser(data, conn, uid, ss, colls)
+		return err
+	case "UNMUTE":
+		err := unmuteUser(data, conn, uid, ss, colls)
+		return err
 
 	/* --------------- CALL SERVER EVENTS --------------- */
 	case "CALL_USER":
@@ -116,6 +171,29 @@ func HandleSocketEvent(eventType string, data []byte, conn *websocket.Conn, uid
 	case "CALL_WEBRTC_RECIPIENT_REQUEST_REINITIALIZATION":
 		err := callRecipientRequestReInitialization(data, conn, uid, cs)
 		return err
+	case "CALL_MEDIA_STATE":
+		err := callMediaState(data, conn, uid, cs)
+		return err
+
+	/* --------------- ROOM CALL SERVER EVENTS --------------- */
+	case "ROOM_CALL_JOIN":
+		err := roomCallJoin(data, conn, uid, rcs, colls)
+		return err
+	case "ROOM_CALL_LEAVE":
+		err := roomCallLeave(data, conn, uid, rcs)
+		return err
+	case "ROOM_CALL_WEBRTC_OFFER":
+		err := roomCallWebRTCOffer(data, conn, uid, rcs)
+		return err
+	case "ROOM_CALL_WEBRTC_ANSWER":
+		err := roomCallWebRTCAnswer(data, conn, uid, rcs)
+		return err
+	case "ROOM_CALL_WEBRTC_REQUEST_REINITIALIZATION":
+		err := roomCallRequestReInitialization(data, conn, uid, rcs)
+		return err
+	case "ROOM_CALL_MEDIA_STATE":
+		err := roomCallMediaState(data, conn, uid, rcs)
+		return err
 	}
 
 	return fmt.Errorf("Unrecognized event type :" + eventType)
@@ -212,39 +290,10 @@ func openRoomChannel(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss
 		return err
 	}
 
-	channel := &models.RoomChannel{}
-	if err := colls.RoomChannelCollection.FindOne(context.Background(), bson.M{"_id": channelId}).Decode(&channel); err != nil {
-		return err
-	}
-	roomExternalData := &models.RoomExternalData{}
-	if err := colls.RoomExternalDataCollection.FindOne(context.Background(), bson.M{"_id": channel.RoomID}).Decode(&roomExternalData); err != nil {
-		return err
-	}
-	room := &models.Room{}
-	if err := colls.RoomCollection.FindOne(context.Background(), bson.M{"_id": channel.RoomID}).Decode(&room); err != nil {
+	if _, _, err := checkRoomChannelAccess(channelId, uid, colls); err != nil {
 		return err
 	}
 
-	if uid != room.Author {
-		for _, oi := range roomExternalData.Banned {
-			if oi == uid {
-				return fmt.Errorf("Banned")
-			}
-		}
-		if roomExternalData.Private {
-			member := false
-			for _, oi := range roomExternalData.Members {
-				if oi == uid {
-					member = true
-					break
-				}
-			}
-			if !member {
-				return fmt.Errorf("Not a member")
-			}
-		}
-	}
-
 	ss.RegisterSubscriptionConn <- socketserver.SubscriptionConnectionInfo{
 		Name: "channel:" + channelId.Hex(),
 		Uid:  uid,
@@ -283,12 +332,17 @@ func exitRoomChannel(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss
 	return nil
 }
 
-func roomMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
+func roomMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, lps *linkpreviewserver.LinkPreviewServer, colls *db.Collections) error {
 	var data socketmodels.RoomMessage
 	if err := json.Unmarshal(b, &data); err != nil {
 		return err
 	}
 
+	return sendRoomMessage(data, primitive.NewObjectID(), uid, ss, lps, colls)
+}
+
+// Also used for scheduled messages, which are sent with the ID they were scheduled with so a retry can't send them twice
+func sendRoomMessage(data socketmodels.RoomMessage, msgId primitive.ObjectID, uid primitive.ObjectID, ss *socketserver.SocketServer, lps *linkpreviewserver.LinkPreviewServer, colls *db.Collections) error {
 	if strings.TrimSpace(data.Content) == "" {
 		return fmt.Errorf("You cannot submit an empty message")
 	}
@@ -301,62 +355,75 @@ func roomMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *soc
 		return err
 	}
 
-	channel := &models.RoomChannel{}
-	if err := colls.RoomChannelCollection.FindOne(context.Background(), bson.M{"_id": channelId}).Decode(&channel); err != nil {
+	channel, permissions, err := checkRoomChannelAccess(channelId, uid, colls)
+	if err != nil {
 		return err
 	}
-	roomExternalData := &models.RoomExternalData{}
-	if err := colls.RoomExternalDataCollection.FindOne(context.Background(), bson.M{"_id": channel.RoomID}).Decode(&roomExternalData); err != nil {
-		return err
+	if permissions&models.PermissionSendMessages == 0 {
+		return fmt.Errorf("This channel is read only")
 	}
-	room := &models.Room{}
-	if err := colls.RoomCollection.FindOne(context.Background(), bson.M{"_id": channel.RoomID}).Decode(&room); err != nil {
+	if data.HasAttachment && permissions&models.PermissionUploadAttachments == 0 {
+		return fmt.Errorf("You cannot upload attachments in this channel")
+	}
+	if err := helpers.CheckRoomMuted(context.Background(), *colls, channel.RoomID, uid); err != nil {
 		return err
 	}
 
-	if room.Author != uid {
-		for _, oi := range roomExternalData.Banned {
-			if oi == uid {
-				return fmt.Errorf("Banned")
-			}
+	var poll *models.Poll
+	if data.Poll != nil {
+		if data.HasAttachment {
+			return fmt.Errorf("Polls cannot have attachments")
 		}
-		if roomExternalData.Private {
-			member := false
-			for _, oi := range roomExternalData.Members {
-				if oi == uid {
-					member = true
-					break
-				}
-			}
-			if !member {
-				return fmt.Errorf("Not a member")
-			}
+		if poll, err = helpers.NewPoll(data.Poll.Options, data.Poll.MultipleChoice, data.Poll.ClosesAt); err != nil {
+			return err
 		}
 	}
 
-	msgId := primitive.NewObjectID()
+	replyTo, err := getRoomThreadRoot(channel.ID, data.ReplyTo, colls)
+	if err != nil {
+		return err
+	}
 
-	if _, err := colls.RoomChannelMessagesCollection.UpdateByID(context.Background(), channel.ID, bson.M{
-		"$push": bson.M{
-			"messages": models.RoomChannelMessage{
-				ID:            msgId,
-				Content:       data.Content,
-				CreatedAt:     primitive.NewDateTimeFromTime(time.Now()),
-				UpdatedAt:     primitive.NewDateTimeFromTime(time.Now()),
-				Author:        uid,
-				HasAttachment: data.HasAttachment,
-			},
-		},
+	mentions, err := getRoomMentions(data.Content, permissions, colls)
+	if err != nil {
+		return err
+	}
+	rendered := renderContent(data.Content, data.RichText)
+
+	if _, err := colls.RoomMessageCollection.InsertOne(context.Background(), models.RoomChannelMessage{
+		ID:            msgId,
+		ChannelID:     channel.ID,
+		Content:       data.Content,
+		CreatedAt:     primitive.NewDateTimeFromTime(time.Now()),
+		UpdatedAt:     primitive.NewDateTimeFromTime(time.Now()),
+		Author:        uid,
+		HasAttachment: data.HasAttachment,
+		ReplyTo:       replyTo,
+		Mentions:      mentions.Uids,
+		MassMention:   mentions.Mass,
+		RichText:      data.RichText,
+		Rendered:      rendered,
+		Poll:          poll,
 	}); err != nil {
 		return err
 	}
 
+	mentionsHex := []string{}
+	for _, oi := range mentions.Uids {
+		mentionsHex = append(mentionsHex, oi.Hex())
+	}
 	if outBytes, err := json.Marshal(socketmodels.OutRoomMessage{
 		Type:          "OUT_ROOM_MESSAGE",
 		Content:       data.Content,
 		ID:            msgId.Hex(),
 		Author:        uid.Hex(),
 		HasAttachment: data.HasAttachment,
+		ReplyTo:       replyToHex(replyTo),
+		Mentions:      mentionsHex,
+		MassMention:   mentions.Mass,
+		RichText:      data.RichText,
+		Rendered:      rendered,
+		Poll:          helpers.OutPoll(poll),
 	}); err == nil {
 		ss.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
 			Name: "channel:" + channelId.Hex(),
@@ -364,6 +431,19 @@ func roomMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *soc
 		}
 	}
 
+	queueLinkPreview(msgId, true, data.Content, lps)
+
+	// The message has already been sent, so these are logged instead of returned to the client
+	if err := sendRoomMentions(channel, msgId, uid, data.Content, mentions, nil, ss, colls); err != nil {
+		log.Println("Error sending mentions :", err)
+	}
+
+	if replyTo != nil {
+		if err := updateRoomReplyCount(channel.ID, *replyTo, 1, ss, colls); err != nil {
+			log.Println("Error updating reply count :", err)
+		}
+	}
+
 	if data.HasAttachment {
 		ss.SendDataToUser <- socketserver.UserDataMessage{
 			Type: "ATTACHMENT_REQUEST",
@@ -378,7 +458,7 @@ func roomMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *soc
 	return nil
 }
 
-func roomMessageUpdate(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
+func roomMessageUpdate(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, lps *linkpreviewserver.LinkPreviewServer, colls *db.Collections) error {
 	var data socketmodels.RoomMessageUpdate
 	if err := json.Unmarshal(b, &data); err != nil {
 		return err
@@ -400,58 +480,68 @@ func roomMessageUpdate(b []byte, conn *websocket.Conn, uid primitive.ObjectID, s
 		return err
 	}
 
-	channel := &models.RoomChannel{}
-	if err := colls.RoomChannelCollection.FindOne(context.Background(), bson.M{"_id": channelId}).Decode(&channel); err != nil {
+	channel, permissions, err := checkRoomChannelAccess(channelId, uid, colls)
+	if err != nil {
 		return err
 	}
-	roomExternalData := &models.RoomExternalData{}
-	if err := colls.RoomExternalDataCollection.FindOne(context.Background(), bson.M{"_id": channel.RoomID}).Decode(&roomExternalData); err != nil {
-		return err
+	if permissions&models.PermissionSendMessages == 0 {
+		return fmt.Errorf("This channel is read only")
 	}
-	room := &models.Room{}
-	if err := colls.RoomCollection.FindOne(context.Background(), bson.M{"_id": channel.RoomID}).Decode(&room); err != nil {
+
+	msgFilter := bson.M{
+		"_id":        msgId,
+		"channel_id": channelId,
+		"author":     uid,
+	}
+	prev := &models.RoomChannelMessage{}
+	if err := colls.RoomMessageCollection.FindOne(context.Background(), msgFilter).Decode(&prev); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return fmt.Errorf("Update failed")
+		}
 		return err
 	}
+	// Editing the question would change what people voted on
+	if prev.Poll != nil {
+		return fmt.Errorf("Polls cannot be edited")
+	}
 
-	if room.Author != uid {
-		for _, oi := range roomExternalData.Banned {
-			if oi == uid {
-				return fmt.Errorf("Banned")
-			}
-		}
-		if roomExternalData.Private {
-			member := false
-			for _, oi := range roomExternalData.Members {
-				if oi == uid {
-					member = true
-					break
-				}
-			}
-			if !member {
-				return fmt.Errorf("Not a member")
-			}
-		}
+	mentions, err := getRoomMentions(data.Content, permissions, colls)
+	if err != nil {
+		return err
 	}
 
-	if res, err := colls.RoomChannelMessagesCollection.UpdateOne(context.Background(), bson.M{
-		"_id":             channelId,
-		"messages._id":    msgId,
-		"messages.author": uid,
-	}, bson.M{
-		"$set": bson.M{
-			"messages.$.content":    data.Content,
-			"messages.$.updated_at": primitive.NewDateTimeFromTime(time.Now()),
-		},
+	rendered := renderContent(data.Content, data.RichText)
+
+	if err := helpers.EditMessageContent(context.Background(), colls.RoomMessageCollection, msgFilter, data.Content, bson.M{
+		"mentions":     mentions.Uids,
+		"mass_mention": mentions.Mass,
+		"rich_text":    data.RichText,
+		"rendered":     rendered,
+		// Fetched again for the new content
+		"link_preview": nil,
 	}); err != nil {
 		return err
-	} else if res.MatchedCount == 0 {
-		return fmt.Errorf("Update failed")
+	}
+
+	// Only users that weren't already mentioned get notified
+	alreadyMentioned := make(map[primitive.ObjectID]struct{})
+	for _, oi := range prev.Mentions {
+		alreadyMentioned[oi] = struct{}{}
+	}
+	if prev.MassMention == mentions.Mass {
+		mentions.Mass = ""
+	}
+	if err := sendRoomMentions(channel, msgId, uid, data.Content, mentions, alreadyMentioned, ss, colls); err != nil {
+		log.Println("Error sending mentions :", err)
 	}
 
 	outBytes, err := json.Marshal(socketmodels.OutRoomMessageUpdate{
-		Type:    "OUT_ROOM_MESSAGE_UPDATE",
-		Content: data.Content,
-		ID:      msgId.Hex(),
+		Type:     "OUT_ROOM_MESSAGE_UPDATE",
+		Content:  data.Content,
+		ID:       msgId.Hex(),
+		Edited:   true,
+		RichText: data.RichText,
+		Rendered: rendered,
 	})
 	if err != nil {
 		return err
@@ -462,6 +552,8 @@ func roomMessageUpdate(b []byte, conn *websocket.Conn, uid primitive.ObjectID, s
 		Data: outBytes,
 	}
 
+	queueLinkPreview(msgId, true, data.Content, lps)
+
 	return nil
 }
 
@@ -480,50 +572,51 @@ func roomMessageDelete(b []byte, conn *websocket.Conn, uid primitive.ObjectID, s
 		return err
 	}
 
-	channel := &models.RoomChannel{}
-	if err := colls.RoomChannelCollection.FindOne(context.Background(), bson.M{"_id": channelId}).Decode(&channel); err != nil {
+	channel, permissions, err := checkRoomChannelAccess(channelId, uid, colls)
+	if err != nil {
 		return err
 	}
-	roomExternalData := &models.RoomExternalData{}
-	if err := colls.RoomExternalDataCollection.FindOne(context.Background(), bson.M{"_id": channel.RoomID}).Decode(&roomExternalData); err != nil {
-		return err
+
+	// Users with the delete messages permission can delete anyones messages
+	deleteFilter := bson.M{
+		"_id":        msgId,
+		"channel_id": channelId,
+		"author":     uid,
 	}
-	room := &models.Room{}
-	if err := colls.RoomCollection.FindOne(context.Background(), bson.M{"_id": channel.RoomID}).Decode(&room); err != nil {
-		return err
+	if permissions&models.PermissionDeleteMessages != 0 {
+		delete(deleteFilter, "author")
 	}
 
-	if room.Author != uid {
-		for _, oi := range roomExternalData.Banned {
-			if oi == uid {
-				return fmt.Errorf("Banned")
-			}
+	msg := &models.RoomChannelMessage{}
+	if err := colls.RoomMessageCollection.FindOneAndDelete(context.Background(), deleteFilter).Decode(&msg); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return fmt.Errorf("Delete failed")
 		}
-		if roomExternalData.Private {
-			member := false
-			for _, oi := range roomExternalData.Members {
-				if oi == uid {
-					member = true
-					break
-				}
-			}
-			if !member {
-				return fmt.Errorf("Not a member")
-			}
+		return err
+	}
+	msgAuthor := msg.Author
+	if msg.ReplyTo != nil {
+		if err := updateRoomReplyCount(channelId, *msg.ReplyTo, -1, ss, colls); err != nil {
+			log.Println("Error updating reply count :", err)
 		}
 	}
-
-	if res, err := colls.RoomChannelMessagesCollection.UpdateByID(context.Background(), channelId, bson.M{
-		"$pull": bson.M{
-			"messages": bson.M{
-				"_id":    msgId,
-				"author": uid,
-			},
-		},
-	}); err != nil {
-		return err
-	} else if res.MatchedCount == 0 {
-		return fmt.Errorf("Delete failed")
+	// Replies can't be shown without the first message of the thread, so they are deleted with it
+	replies := []models.RoomChannelMessage{}
+	if msg.ReplyTo == nil && msg.ReplyCount > 0 {
+		repliesFilter := bson.M{"channel_id": channelId, "reply_to": msgId}
+		cursor, err := colls.RoomMessageCollection.Find(context.Background(), repliesFilter, options.Find().SetProjection(bson.M{"_id": 1}))
+		if err != nil {
+			return err
+		}
+		if err := cursor.All(context.Background(), &replies); err != nil {
+			return err
+		}
+		if err := deleteRoomMessages(repliesFilter, as, colls); err != nil {
+			return err
+		}
+	}
+	if msgAuthor != uid {
+		helpers.WriteRoomAuditLog(context.Background(), *colls, channel.RoomID, uid, "DELETE_MESSAGE", msgId, "Author: "+msgAuthor.Hex())
 	}
 
 	outBytes, err := json.Marshal(socketmodels.OutRoomMessageDelete{
@@ -532,24 +625,152 @@ func roomMessageDelete(b []byte, conn *websocket.Conn, uid primitive.ObjectID, s
 	})
 
 	as.DeleteChan <- attachmentserver.Delete{
-		MsgId: msgId,
-		Uid:   uid,
+		MsgId:      msgId,
+		Uid:        msgAuthor,
+		SharedFrom: msg.AttachmentID,
 	}
 
 	ss.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
 		Name: "channel:" + channelId.Hex(),
 		Data: outBytes,
 	}
+	for _, reply := range replies {
+		replyBytes, err := json.Marshal(socketmodels.OutRoomMessageDelete{
+			Type: "OUT_ROOM_MESSAGE_DELETE",
+			ID:   reply.ID.Hex(),
+		})
+		if err != nil {
+			return err
+		}
+		ss.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
+			Name: "channel:" + channelId.Hex(),
+			Data: replyBytes,
+		}
+	}
+
+	return nil
+}
+
+func roomMessageReact(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
+	var data socketmodels.RoomMessageReact
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	if err := helpers.ValidateReactionEmoji(data.Emoji); err != nil {
+		return err
+	}
+
+	channelId, err := primitive.ObjectIDFromHex(data.Channel)
+	if err != nil {
+		return err
+	}
+	msgId, err := primitive.ObjectIDFromHex(data.ID)
+	if err != nil {
+		return err
+	}
+
+	channel, _, err := checkRoomChannelAccess(channelId, uid, colls)
+	if err != nil {
+		return err
+	}
+	if err := helpers.CheckRoomMuted(context.Background(), *colls, channel.RoomID, uid); err != nil {
+		return err
+	}
+
+	msgFilter := bson.M{"_id": msgId, "channel_id": channelId}
+	if err := helpers.ToggleReaction(context.Background(), colls.RoomMessageCollection, msgFilter, data.Emoji, uid, data.Remove); err != nil {
+		return err
+	}
+
+	msg := &models.RoomChannelMessage{}
+	if err := colls.RoomMessageCollection.FindOne(context.Background(), msgFilter).Decode(&msg); err != nil {
+		return err
+	}
+
+	recvChan := make(chan map[primitive.ObjectID]struct{})
+	ss.GetSubscriptionUids <- socketserver.GetSubscriptionUids{
+		RecvChan: recvChan,
+		Name:     "channel:" + channelId.Hex(),
+	}
+	uidsInChannel := <-recvChan
+
+	// Users in the channel that blocked someone who reacted get their own copy without those reactions
+	reactorUids := []primitive.ObjectID{}
+	for _, reaction := range msg.Reactions {
+		reactorUids = append(reactorUids, reaction.Uids...)
+	}
+	subscriberUids := []primitive.ObjectID{}
+	for oi := range uidsInChannel {
+		subscriberUids = append(subscriberUids, oi)
+	}
+	blockers := []models.UserMessagingData{}
+	if len(reactorUids) > 0 && len(subscriberUids) > 0 {
+		cursor, err := colls.UserMessagingDataCollection.Find(context.Background(), bson.M{
+			"_id":     bson.M{"$in": subscriberUids},
+			"blocked": bson.M{"$in": reactorUids},
+		}, options.Find().SetProjection(bson.M{"blocked": 1}))
+		if err != nil {
+			return err
+		}
+		if err := cursor.All(context.Background(), &blockers); err != nil {
+			return err
+		}
+	}
+
+	exclude := make(map[primitive.ObjectID]bool)
+	for _, umd := range blockers {
+		exclude[umd.ID] = true
+		reactions := outReactions(helpers.FilterBlockedReactions(msg.Reactions, umd.Blocked))
+		ss.SendDataToUser <- socketserver.UserDataMessage{
+			Uid:  umd.ID,
+			Type: "OUT_ROOM_MESSAGE_UPDATE",
+			Data: socketmodels.OutRoomMessageUpdate{
+				Type:      "OUT_ROOM_MESSAGE_UPDATE",
+				Content:   msg.Content,
+				ID:        msgId.Hex(),
+				Edited:    msg.Edited,
+				RichText:  msg.RichText,
+				Rendered:  msg.Rendered,
+				Reactions: &reactions,
+			},
+		}
+	}
+
+	reactions := outReactions(msg.Reactions)
+	outBytes, err := json.Marshal(socketmodels.OutRoomMessageUpdate{
+		Type:      "OUT_ROOM_MESSAGE_UPDATE",
+		Content:   msg.Content,
+		ID:        msgId.Hex(),
+		Edited:    msg.Edited,
+		RichText:  msg.RichText,
+		Rendered:  msg.Rendered,
+		Reactions: &reactions,
+	})
+	if err != nil {
+		return err
+	}
+
+	ss.SendDataToSubscriptionExclusive <- socketserver.ExclusiveSubscriptionDataMessage{
+		Name:    "channel:" + channelId.Hex(),
+		Data:    outBytes,
+		Exclude: exclude,
+	}
 
 	return nil
 }
 
-func directMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
+func directMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, lps *linkpreviewserver.LinkPreviewServer, colls *db.Collections) error {
 	var data socketmodels.DirectMessage
 	if err := json.Unmarshal(b, &data); err != nil {
 		return err
 	}
 
+	return sendDirectMessage(data, primitive.NewObjectID(), uid, ss, lps, colls)
+}
+
+// Also used for scheduled messages, the same as sendRoomMessage
+func sendDirectMessage(data socketmodels.DirectMessage, msgId primitive.ObjectID, uid primitive.ObjectID, ss *socketserver.SocketServer, lps *linkpreviewserver.LinkPreviewServer, colls *db.Collections) error {
 	recipientId, err := primitive.ObjectIDFromHex(data.Recipient)
 	if err != nil {
 		return err
@@ -566,19 +787,28 @@ func directMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *s
 		}
 	}
 
-	msgId := primitive.NewObjectID()
+	replyTo, err := getDirectThreadRoot(uid, recipientId, data.ReplyTo, colls)
+	if err != nil {
+		return err
+	}
+	rendered := renderContent(data.Content, data.RichText)
+
+	if _, err := colls.DirectMessageCollection.InsertOne(context.Background(), models.DirectMessage{
+		ID:            msgId,
+		CreatedAt:     primitive.NewDateTimeFromTime(time.Now()),
+		UpdatedAt:     primitive.NewDateTimeFromTime(time.Now()),
+		Author:        uid,
+		Recipient:     recipientId,
+		Content:       data.Content,
+		HasAttachment: data.HasAttachment,
+		ReplyTo:       replyTo,
+		RichText:      data.RichText,
+		Rendered:      rendered,
+	}); err != nil {
+		return err
+	}
 
 	if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), recipientId, bson.M{
-		"$push": bson.M{
-			"messages": models.DirectMessage{
-				ID:            msgId,
-				CreatedAt:     primitive.NewDateTimeFromTime(time.Now()),
-				UpdatedAt:     primitive.NewDateTimeFromTime(time.Now()),
-				Author:        uid,
-				Content:       data.Content,
-				HasAttachment: data.HasAttachment,
-			},
-		},
 		"$addToSet": bson.M{
 			"messages_received_from": uid,
 		},
@@ -606,9 +836,20 @@ func directMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *s
 			Author:        uid.Hex(),
 			Recipient:     recipientId.Hex(),
 			HasAttachment: data.HasAttachment,
+			ReplyTo:       replyToHex(replyTo),
+			RichText:      data.RichText,
+			Rendered:      rendered,
 		},
 	}
 
+	queueLinkPreview(msgId, false, data.Content, lps)
+
+	if replyTo != nil {
+		if err := updateDirectReplyCount(*replyTo, uid, recipientId, 1, ss, colls); err != nil {
+			log.Println("Error updating reply count :", err)
+		}
+	}
+
 	if data.HasAttachment {
 		ss.SendDataToUser <- socketserver.UserDataMessage{
 			Type: "ATTACHMENT_REQUEST",
@@ -623,7 +864,7 @@ func directMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *s
 	return nil
 }
 
-func directMessageUpdate(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
+func directMessageUpdate(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, lps *linkpreviewserver.LinkPreviewServer, colls *db.Collections) error {
 	var data socketmodels.DirectMessageUpdate
 	if err := json.Unmarshal(b, &data); err != nil {
 		return err
@@ -647,19 +888,21 @@ func directMessageUpdate(b []byte, conn *websocket.Conn, uid primitive.ObjectID,
 		return err
 	}
 
-	if res, err := colls.UserMessagingDataCollection.UpdateOne(context.Background(), bson.M{
-		"_id":             recipientId,
-		"messages._id":    msgId,
-		"messages.author": uid,
-	}, bson.M{
-		"$set": bson.M{
-			"messages.$.content":    data.Content,
-			"messages.$.updated_at": primitive.NewDateTimeFromTime(time.Now()),
-		},
+	rendered := renderContent(data.Content, data.RichText)
+
+	if err := helpers.EditMessageContent(context.Background(), colls.DirectMessageCollection, bson.M{
+		"_id":       msgId,
+		"author":    uid,
+		"recipient": recipientId,
+		// missed calls have no content to edit
+		"missed_call": bson.M{"$ne": true},
+	}, data.Content, bson.M{
+		"rich_text": data.RichText,
+		"rendered":  rendered,
+		// Fetched again for the new content
+		"link_preview": nil,
 	}); err != nil {
 		return err
-	} else if res.MatchedCount == 0 {
-		return fmt.Errorf("Update failed")
 	}
 
 	msg := &socketmodels.OutDirectMessageUpdate{
@@ -667,6 +910,9 @@ func directMessageUpdate(b []byte, conn *websocket.Conn, uid primitive.ObjectID,
 		Content:   data.Content,
 		Author:    uid.Hex(),
 		Recipient: recipientId.Hex(),
+		Edited:    true,
+		RichText:  data.RichText,
+		Rendered:  rendered,
 	}
 	Uids := make(map[primitive.ObjectID]struct{})
 	Uids[uid] = struct{}{}
@@ -677,10 +923,12 @@ func directMessageUpdate(b []byte, conn *websocket.Conn, uid primitive.ObjectID,
 		Data: msg,
 	}
 
+	queueLinkPreview(msgId, false, data.Content, lps)
+
 	return nil
 }
 
-func directMessageDelete(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
+func directMessageDelete(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, colls *db.Collections) error {
 	var data socketmodels.DirectMessageDelete
 	if err := json.Unmarshal(b, &data); err != nil {
 		return err
@@ -696,31 +944,64 @@ func directMessageDelete(b []byte, conn *websocket.Conn, uid primitive.ObjectID,
 		return err
 	}
 
-	recipientMessagingData := &models.UserMessagingData{}
-	if err := colls.UserMessagingDataCollection.FindOneAndUpdate(context.Background(), bson.M{
-		"_id": recipientId,
-	}, bson.M{
-		"$pull": bson.M{
-			"messages": bson.M{
-				"_id":    msgId,
-				"author": uid,
-			},
-		},
-	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&recipientMessagingData); err != nil {
+	deleted := &models.DirectMessage{}
+	if err := colls.DirectMessageCollection.FindOneAndDelete(context.Background(), bson.M{
+		"_id":       msgId,
+		"author":    uid,
+		"recipient": recipientId,
+	}).Decode(&deleted); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return fmt.Errorf("Delete failed")
+		}
 		return err
-	} else {
-		wasOnlyMessage := checkAnythingReceivedFrom(*recipientMessagingData, uid)
-		if wasOnlyMessage {
-			if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), recipientId, bson.M{
+	}
+	if deleted.ReplyTo != nil {
+		if err := updateDirectReplyCount(*deleted.ReplyTo, uid, recipientId, -1, ss, colls); err != nil {
+			log.Println("Error updating reply count :", err)
+		}
+	}
+	// Replies can't be shown without the first message of the thread, so they are deleted with it
+	replies := []models.DirectMessage{}
+	if deleted.ReplyTo == nil && deleted.ReplyCount > 0 {
+		repliesFilter := bson.M{"reply_to": msgId}
+		cursor, err := colls.DirectMessageCollection.Find(context.Background(), repliesFilter, options.Find().SetProjection(bson.M{"_id": 1, "author": 1, "recipient": 1}))
+		if err != nil {
+			return err
+		}
+		if err := cursor.All(context.Background(), &replies); err != nil {
+			return err
+		}
+		if err := deleteDirectMessages(repliesFilter, as, colls); err != nil {
+			return err
+		}
+	}
+
+	// The other user may have replied in the thread, so if replies were deleted both directions are checked
+	senders := [][2]primitive.ObjectID{{uid, recipientId}}
+	if len(replies) > 0 {
+		senders = append(senders, [2]primitive.ObjectID{recipientId, uid})
+	}
+	for _, pair := range senders {
+		sender, receiver := pair[0], pair[1]
+		receiverMessagingData := &models.UserMessagingData{}
+		if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": receiver}).Decode(&receiverMessagingData); err != nil {
+			return err
+		}
+		anythingReceived, err := checkAnythingReceivedFrom(*receiverMessagingData, sender, colls)
+		if err != nil {
+			return err
+		}
+		if !anythingReceived {
+			if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), receiver, bson.M{
 				"$pull": bson.M{
-					"messages_received_from": uid,
+					"messages_received_from": sender,
 				},
 			}); err != nil {
 				return err
 			}
-			if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), uid, bson.M{
+			if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), sender, bson.M{
 				"$pull": bson.M{
-					"messages_sent_to": uid,
+					"messages_sent_to": receiver,
 				},
 			}); err != nil {
 				return err
@@ -728,104 +1009,325 @@ func directMessageDelete(b []byte, conn *websocket.Conn, uid primitive.ObjectID,
 		}
 	}
 
-	msg := &socketmodels.OutDirectMessageDelete{
-		ID:        msgId.Hex(),
-		Author:    uid.Hex(),
-		Recipient: recipientId.Hex(),
-	}
 	Uids := make(map[primitive.ObjectID]struct{})
 	Uids[uid] = struct{}{}
 	Uids[recipientId] = struct{}{}
 	ss.SendDataToUsers <- socketserver.UsersDataMessage{
 		Uids: Uids,
 		Type: "OUT_DIRECT_MESSAGE_DELETE",
-		Data: msg,
+		Data: &socketmodels.OutDirectMessageDelete{
+			ID:        msgId.Hex(),
+			Author:    uid.Hex(),
+			Recipient: recipientId.Hex(),
+		},
 	}
-
-	return nil
+	for _, reply := range replies {
+		ss.SendDataToUsers <- socketserver.UsersDataMessage{
+			Uids: Uids,
+			Type: "OUT_DIRECT_MESSAGE_DELETE",
+			Data: &socketmodels.OutDirectMessageDelete{
+				ID:        reply.ID.Hex(),
+				Author:    reply.Author.Hex(),
+				Recipient: reply.Recipient.Hex(),
+			},
+		}
+	}
+
+	return nil
 }
 
-func inviteToRoom(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
-	var data socketmodels.InviteToRoom
+func directMessageReact(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
+	var data socketmodels.DirectMessageReact
 	if err := json.Unmarshal(b, &data); err != nil {
 		return err
 	}
 
-	recipientId, err := primitive.ObjectIDFromHex(data.Recipient)
+	if err := helpers.ValidateReactionEmoji(data.Emoji); err != nil {
+		return err
+	}
+
+	converseId, err := primitive.ObjectIDFromHex(data.Uid)
+	if err != nil {
+		return err
+	}
+	msgId, err := primitive.ObjectIDFromHex(data.ID)
 	if err != nil {
 		return err
 	}
 
-	if recipientId == uid {
-		return fmt.Errorf("You cannot send an invitation to yourself")
+	converseMessagingData := &models.UserMessagingData{}
+	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": converseId}).Decode(&converseMessagingData); err != nil {
+		return err
+	}
+	for _, oi := range converseMessagingData.Blocked {
+		if oi == uid {
+			return fmt.Errorf("This user has blocked your account")
+		}
 	}
 
-	roomId, err := primitive.ObjectIDFromHex(data.RoomID)
-	if err != nil {
+	msgFilter := bson.M{
+		"_id": msgId,
+		"$or": bson.A{
+			bson.M{"author": uid, "recipient": converseId},
+			bson.M{"author": converseId, "recipient": uid},
+		},
+	}
+	if err := helpers.ToggleReaction(context.Background(), colls.DirectMessageCollection, msgFilter, data.Emoji, uid, data.Remove); err != nil {
 		return err
 	}
 
-	room := &models.Room{}
-	if err := colls.RoomCollection.FindOne(context.Background(), bson.M{"_id": roomId}).Decode(&room); err != nil {
+	msg := &models.DirectMessage{}
+	if err := colls.DirectMessageCollection.FindOne(context.Background(), msgFilter).Decode(&msg); err != nil {
 		return err
 	}
 
-	roomExternalData := &models.RoomExternalData{}
-	if err := colls.RoomExternalDataCollection.FindOne(context.Background(), bson.M{"_id": roomId}).Decode(&roomExternalData); err != nil {
+	reactions := outReactions(msg.Reactions)
+	Uids := make(map[primitive.ObjectID]struct{})
+	Uids[uid] = struct{}{}
+	Uids[converseId] = struct{}{}
+	ss.SendDataToUsers <- socketserver.UsersDataMessage{
+		Uids: Uids,
+		Type: "OUT_DIRECT_MESSAGE_UPDATE",
+		Data: socketmodels.OutDirectMessageUpdate{
+			ID:        msgId.Hex(),
+			Content:   msg.Content,
+			Author:    msg.Author.Hex(),
+			Recipient: msg.Recipient.Hex(),
+			Edited:    msg.Edited,
+			RichText:  msg.RichText,
+			Rendered:  msg.Rendered,
+			Reactions: &reactions,
+		},
+	}
+
+	return nil
+}
+
+func forwardMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
+	var data socketmodels.ForwardMessage
+	if err := json.Unmarshal(b, &data); err != nil {
 		return err
 	}
 
-	for _, oi := range roomExternalData.Banned {
-		if oi == recipientId {
-			return fmt.Errorf("You have banned this user. You must unban them to send an invite")
+	msgId, err := primitive.ObjectIDFromHex(data.ID)
+	if err != nil {
+		return err
+	}
+
+	// Find the message, checking the user can see it
+	var sourceChannel *models.RoomChannel
+	// Room messages are copied into a direct message, only the fields both have are used
+	var source models.DirectMessage
+	var origin models.ForwardOrigin
+	if data.Channel != "" {
+		channelId, err := primitive.ObjectIDFromHex(data.Channel)
+		if err != nil {
+			return err
+		}
+		if sourceChannel, _, err = checkRoomChannelAccess(channelId, uid, colls); err != nil {
+			return err
+		}
+		msg := &models.RoomChannelMessage{}
+		if err := colls.RoomMessageCollection.FindOne(context.Background(), bson.M{"_id": msgId, "channel_id": channelId}).Decode(&msg); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return fmt.Errorf("Message not found")
+			}
+			return err
+		}
+		if msg.Poll != nil {
+			return fmt.Errorf("Polls cannot be forwarded")
+		}
+		source = models.DirectMessage{
+			ID:            msg.ID,
+			Content:       msg.Content,
+			CreatedAt:     msg.CreatedAt,
+			Author:        msg.Author,
+			HasAttachment: msg.HasAttachment,
+			RichText:      msg.RichText,
+			Rendered:      msg.Rendered,
+			LinkPreview:   msg.LinkPreview,
+			ForwardedFrom: msg.ForwardedFrom,
+			AttachmentID:  msg.AttachmentID,
+		}
+		origin.ChannelID = &sourceChannel.ID
+		origin.RoomID = &sourceChannel.RoomID
+	} else {
+		otherUid, err := primitive.ObjectIDFromHex(data.Uid)
+		if err != nil {
+			return err
+		}
+		if err := colls.DirectMessageCollection.FindOne(context.Background(), bson.M{
+			"_id": msgId,
+			"$or": bson.A{
+				bson.M{"author": uid, "recipient": otherUid},
+				bson.M{"author": otherUid, "recipient": uid},
+			},
+		}).Decode(&source); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return fmt.Errorf("Message not found")
+			}
+			return err
+		}
+		if source.MissedCall {
+			return fmt.Errorf("Missed calls cannot be forwarded")
 		}
 	}
-	for _, oi := range roomExternalData.Members {
-		if oi == recipientId {
-			return fmt.Errorf("This user is already a member of the room")
+
+	origin.MsgID = source.ID
+	origin.Author = source.Author
+	origin.CreatedAt = source.CreatedAt
+	if source.ForwardedFrom != nil {
+		origin = *source.ForwardedFrom
+	}
+
+	// Forwarding a forward into somewhere else still has to follow the rules of the channel the message came from
+	restrictedBy := []*models.RoomChannel{}
+	if sourceChannel != nil {
+		restrictedBy = append(restrictedBy, sourceChannel)
+	}
+	if origin.ChannelID != nil && (sourceChannel == nil || *origin.ChannelID != sourceChannel.ID) {
+		originChannel := &models.RoomChannel{}
+		if err := colls.RoomChannelCollection.FindOne(context.Background(), bson.M{"_id": *origin.ChannelID}).Decode(&originChannel); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return fmt.Errorf("The channel this message was forwarded from no longer exists")
+			}
+			return err
 		}
+		restrictedBy = append(restrictedBy, originChannel)
 	}
 
-	if room.Author != uid {
-		return fmt.Errorf("Unauthorized")
+	// The attachment is shared with the original message, so it has to be complete
+	var attachmentId *primitive.ObjectID
+	if source.HasAttachment {
+		id := source.ID
+		if source.AttachmentID != nil {
+			id = *source.AttachmentID
+		}
+		metaData := &models.AttachmentData{}
+		if err := colls.AttachmentMetadataCollection.FindOne(context.Background(), bson.M{"_id": id}).Decode(&metaData); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return fmt.Errorf("The attachment could not be found")
+			}
+			return err
+		}
+		if metaData.Failed || metaData.Ratio != float32(1) {
+			return fmt.Errorf("The attachment has not finished uploading")
+		}
+		attachmentId = &id
+	}
+	attachmentIdHex := ""
+	if attachmentId != nil {
+		attachmentIdHex = attachmentId.Hex()
 	}
 
-	messagingData := &models.UserMessagingData{}
-	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": recipientId}).Decode(&messagingData); err != nil {
+	forwardId := primitive.NewObjectID()
+
+	if data.ToChannel != "" {
+		toChannelId, err := primitive.ObjectIDFromHex(data.ToChannel)
+		if err != nil {
+			return err
+		}
+		toChannel, permissions, err := checkRoomChannelAccess(toChannelId, uid, colls)
+		if err != nil {
+			return err
+		}
+		if permissions&models.PermissionSendMessages == 0 {
+			return fmt.Errorf("This channel is read only")
+		}
+		if attachmentId != nil && permissions&models.PermissionUploadAttachments == 0 {
+			return fmt.Errorf("You cannot upload attachments in this channel")
+		}
+		if err := helpers.CheckRoomMuted(context.Background(), *colls, toChannel.RoomID, uid); err != nil {
+			return err
+		}
+		for _, channel := range restrictedBy {
+			if err := checkForwardAudience(channel, toChannel, nil, colls); err != nil {
+				return err
+			}
+		}
+
+		if _, err := colls.RoomMessageCollection.InsertOne(context.Background(), models.RoomChannelMessage{
+			ID:            forwardId,
+			ChannelID:     toChannel.ID,
+			Content:       source.Content,
+			CreatedAt:     primitive.NewDateTimeFromTime(time.Now()),
+			UpdatedAt:     primitive.NewDateTimeFromTime(time.Now()),
+			Author:        uid,
+			HasAttachment: attachmentId != nil,
+			RichText:      source.RichText,
+			Rendered:      source.Rendered,
+			LinkPreview:   source.LinkPreview,
+			ForwardedFrom: &origin,
+			AttachmentID:  attachmentId,
+		}); err != nil {
+			return err
+		}
+
+		outBytes, err := json.Marshal(socketmodels.OutRoomMessage{
+			Type:          "OUT_ROOM_MESSAGE",
+			Content:       source.Content,
+			ID:            forwardId.Hex(),
+			Author:        uid.Hex(),
+			HasAttachment: attachmentId != nil,
+			RichText:      source.RichText,
+			Rendered:      source.Rendered,
+			ForwardedFrom: outForwardOrigin(origin),
+			AttachmentID:  attachmentIdHex,
+			LinkPreview:   source.LinkPreview,
+		})
+		if err != nil {
+			return err
+		}
+		ss.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
+			Name: "channel:" + toChannel.ID.Hex(),
+			Data: outBytes,
+		}
+
+		return nil
+	}
+
+	recipientId, err := primitive.ObjectIDFromHex(data.ToUid)
+	if err != nil {
 		return err
 	}
-	for _, oi := range messagingData.Blocked {
-		if oi == recipientId {
-			return fmt.Errorf("You have blocked this users account. You must unblock the user before sending them an invite")
-		}
+	if recipientId == uid {
+		return fmt.Errorf("You cannot forward messages to yourself")
 	}
 
 	recipientMessagingData := &models.UserMessagingData{}
 	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": recipientId}).Decode(&recipientMessagingData); err != nil {
 		return err
-	} else {
-		for _, oi := range recipientMessagingData.Blocked {
-			if oi == uid {
-				return fmt.Errorf("This user has blocked your account, you cannot send them invitations")
-			}
+	}
+	for _, oi := range recipientMessagingData.Blocked {
+		if oi == uid {
+			return fmt.Errorf("This user has blocked your account")
+		}
+	}
+	for _, channel := range restrictedBy {
+		if err := checkForwardAudience(channel, nil, &recipientId, colls); err != nil {
+			return err
 		}
 	}
 
-	invitationId := primitive.NewObjectID()
+	if _, err := colls.DirectMessageCollection.InsertOne(context.Background(), models.DirectMessage{
+		ID:            forwardId,
+		CreatedAt:     primitive.NewDateTimeFromTime(time.Now()),
+		UpdatedAt:     primitive.NewDateTimeFromTime(time.Now()),
+		Author:        uid,
+		Recipient:     recipientId,
+		Content:       source.Content,
+		HasAttachment: attachmentId != nil,
+		RichText:      source.RichText,
+		Rendered:      source.Rendered,
+		LinkPreview:   source.LinkPreview,
+		ForwardedFrom: &origin,
+		AttachmentID:  attachmentId,
+	}); err != nil {
+		return err
+	}
 
 	if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), recipientId, bson.M{
-		"$push": bson.M{
-			"invitations": models.Invitation{
-				ID:        invitationId,
-				CreatedAt: primitive.NewDateTimeFromTime(time.Now()),
-				Author:    uid,
-				RoomID:    roomId,
-				Accepted:  false,
-				Declined:  false,
-			},
-		},
 		"$addToSet": bson.M{
-			// invitations count as messages, even though they are stored in a seperate array
 			"messages_received_from": uid,
 		},
 	}); err != nil {
@@ -834,762 +1336,2232 @@ func inviteToRoom(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *so
 
 	if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), uid, bson.M{
 		"$addToSet": bson.M{
-			// invitations count as messages, even though they are stored in a seperate array
 			"messages_sent_to": recipientId,
 		},
 	}); err != nil {
 		return err
 	}
 
-	msg := &socketmodels.OutInvite{
-		ID:        invitationId.Hex(),
-		Author:    uid.Hex(),
-		Recipient: recipientId.Hex(),
-		RoomID:    roomId.Hex(),
-	}
 	Uids := make(map[primitive.ObjectID]struct{})
 	Uids[uid] = struct{}{}
 	Uids[recipientId] = struct{}{}
 	ss.SendDataToUsers <- socketserver.UsersDataMessage{
 		Uids: Uids,
-		Type: "OUT_ROOM_INVITATION",
-		Data: msg,
+		Type: "OUT_DIRECT_MESSAGE",
+		Data: socketmodels.OutDirectMessage{
+			ID:            forwardId.Hex(),
+			Content:       source.Content,
+			Author:        uid.Hex(),
+			Recipient:     recipientId.Hex(),
+			HasAttachment: attachmentId != nil,
+			RichText:      source.RichText,
+			Rendered:      source.Rendered,
+			ForwardedFrom: outForwardOrigin(origin),
+			AttachmentID:  attachmentIdHex,
+			LinkPreview:   source.LinkPreview,
+		},
 	}
 
 	return nil
 }
 
-func deleteInvitationToRoom(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
-	var data socketmodels.RoomInvitationDelete
+func pollVote(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
+	var data socketmodels.PollVote
 	if err := json.Unmarshal(b, &data); err != nil {
 		return err
 	}
 
-	invitationId, err := primitive.ObjectIDFromHex(data.ID)
+	channelId, err := primitive.ObjectIDFromHex(data.Channel)
 	if err != nil {
 		return err
 	}
-
-	messagingData := &models.UserMessagingData{}
-	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": uid}).Decode(&messagingData); err != nil {
+	msgId, err := primitive.ObjectIDFromHex(data.ID)
+	if err != nil {
 		return err
 	}
 
-	invitationIndex := -1
-	for i, inv := range messagingData.Invitations {
-		if inv.ID == invitationId {
-			invitationIndex = i
-			break
-		}
-	}
-	if invitationIndex == -1 {
-		return fmt.Errorf("Invitation not found")
+	channel, _, err := checkRoomChannelAccess(channelId, uid, colls)
+	if err != nil {
+		return err
 	}
-
-	if messagingData.Invitations[invitationIndex].Author != uid {
-		return fmt.Errorf("Unauthorized")
+	if err := helpers.CheckRoomMember(context.Background(), *colls, channel.RoomID, uid); err != nil {
+		if err == helpers.ErrRoomNotMember {
+			return fmt.Errorf("Only room members can vote")
+		}
+		return err
 	}
-
-	if err := colls.UserMessagingDataCollection.FindOneAndUpdate(context.Background(), bson.M{"_id": uid}, bson.M{
-		"$pull": bson.M{
-			"invitations": bson.M{
-				"_id":    invitationId,
-				"author": messagingData.Invitations[invitationIndex].Author,
-			},
-		},
-	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&messagingData); err != nil {
+	if err := helpers.CheckRoomMuted(context.Background(), *colls, channel.RoomID, uid); err != nil {
 		return err
-	} else {
-		if !checkAnythingReceivedFrom(*messagingData, messagingData.Invitations[invitationIndex].Author) {
-			if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), uid, bson.M{
-				"$pull": bson.M{
-					"messages_received_from": messagingData.Invitations[invitationIndex].Author,
-				},
-			}); err != nil {
-				return err
-			}
-		}
 	}
 
-	msg := &socketmodels.OutRoomInvitationDelete{
-		ID:        invitationId.Hex(),
-		Author:    uid.Hex(),
-		Recipient: data.Recipient,
-	}
-	Uids := make(map[primitive.ObjectID]struct{})
-	Uids[uid] = struct{}{}
-	Uids[messagingData.Invitations[invitationIndex].Author] = struct{}{}
-	ss.SendDataToUsers <- socketserver.UsersDataMessage{
-		Uids: Uids,
-		Type: "OUT_ROOM_INVITATION_DELETE",
-		Data: msg,
+	msg, err := helpers.VotePoll(context.Background(), colls.RoomMessageCollection, bson.M{"_id": msgId, "channel_id": channelId}, uid, data.Options)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return sendPollUpdate(msg, ss)
 }
 
-func invitationToRoomResponse(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
-	var data socketmodels.RoomInvitationResponse
+// The poll author or a moderator can close a poll before its close time
+func pollClose(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
+	var data socketmodels.PollClose
 	if err := json.Unmarshal(b, &data); err != nil {
 		return err
 	}
 
-	invitationId, err := primitive.ObjectIDFromHex(data.ID)
+	channelId, err := primitive.ObjectIDFromHex(data.Channel)
 	if err != nil {
 		return err
 	}
-
-	messagingData := &models.UserMessagingData{}
-	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": uid}).Decode(&messagingData); err != nil {
+	msgId, err := primitive.ObjectIDFromHex(data.ID)
+	if err != nil {
 		return err
 	}
 
-	invitationIndex := -1
-	for i, inv := range messagingData.Invitations {
-		if inv.ID == invitationId {
-			invitationIndex = i
-			break
-		}
+	channel, permissions, err := checkRoomChannelAccess(channelId, uid, colls)
+	if err != nil {
+		return err
 	}
-	if invitationIndex == -1 {
-		return fmt.Errorf("Invitation not found")
+
+	msgFilter := bson.M{"_id": msgId, "channel_id": channelId, "poll": bson.M{"$exists": true}}
+	isModerator := permissions&(models.PermissionsModeration|models.PermissionOwner) != 0
+	if !isModerator {
+		msgFilter["author"] = uid
 	}
 
-	authorMessagingData := &models.UserMessagingData{}
-	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": messagingData.Invitations[invitationIndex].Author}).Decode(&authorMessagingData); err != nil {
+	msg, err := helpers.ClosePoll(context.Background(), colls.RoomMessageCollection, msgFilter)
+	if err != nil {
 		return err
 	}
-	roomExternalData := &models.RoomExternalData{}
-	if err := colls.RoomExternalDataCollection.FindOne(context.Background(), bson.M{"_id": messagingData.Invitations[invitationIndex].RoomID}).Decode(&roomExternalData); err != nil {
+
+	if msg.Author != uid {
+		helpers.WriteRoomAuditLog(context.Background(), *colls, channel.RoomID, uid, "CLOSE_POLL", msgId, "Author: "+msg.Author.Hex())
+	}
+
+	return sendPollUpdate(msg, ss)
+}
+
+// Used for PIN and UNPIN. Room messages can be pinned by moderators or the author, direct messages by either user.
+func pinMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections, unpin bool) error {
+	var data socketmodels.Pin
+	if err := json.Unmarshal(b, &data); err != nil {
 		return err
 	}
-	roomInternalData := &models.RoomInternalData{}
-	if err := colls.RoomInternalDataCollection.FindOne(context.Background(), bson.M{"_id": messagingData.Invitations[invitationIndex].RoomID}).Decode(&roomInternalData); err != nil {
+
+	msgId, err := primitive.ObjectIDFromHex(data.ID)
+	if err != nil {
 		return err
 	}
 
-	var deleteIfErr error = nil
-	for _, oi := range roomExternalData.Banned {
-		if oi == uid {
-			deleteIfErr = fmt.Errorf("You can no longer accept this invitation, you have been banned from the room")
-			break
-		}
+	outType := "PINNED"
+	if unpin {
+		outType = "UNPINNED"
 	}
-	for _, oi := range roomExternalData.Members {
-		if oi == uid {
-			deleteIfErr = fmt.Errorf("You are already a member of this room")
-			break
+
+	if data.Channel != "" {
+		channelId, err := primitive.ObjectIDFromHex(data.Channel)
+		if err != nil {
+			return err
 		}
-	}
-	for _, oi := range authorMessagingData.Blocked {
-		if oi == uid {
-			deleteIfErr = fmt.Errorf("The sender of this invitation has blocked your account, invitation is no longer valid")
-			break
+
+		channel, permissions, err := checkRoomChannelAccess(channelId, uid, colls)
+		if err != nil {
+			return err
 		}
-	}
 
-	if deleteIfErr != nil {
-		if err := colls.UserMessagingDataCollection.FindOneAndUpdate(context.Background(), bson.M{"_id": uid}, bson.M{
-			"$pull": bson.M{
-				"invitations": bson.M{
-					"_id":    invitationId,
-					"author": messagingData.Invitations[invitationIndex].Author,
-				},
-			},
-		}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&messagingData); err != nil {
+		msg := &models.RoomChannelMessage{}
+		if err := colls.RoomMessageCollection.FindOne(context.Background(), bson.M{"_id": msgId, "channel_id": channelId}).Decode(&msg); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return fmt.Errorf("Message not found")
+			}
 			return err
 		}
-		if !checkAnythingReceivedFrom(*messagingData, messagingData.Invitations[invitationIndex].Author) {
-			if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), uid, bson.M{
-				"$pull": bson.M{
-					"messages_received_from": messagingData.Invitations[invitationIndex].Author,
-				},
-			}); err != nil {
+
+		isModerator := permissions&(models.PermissionsModeration|models.PermissionOwner) != 0
+		if !isModerator {
+			if msg.Author != uid {
+				return fmt.Errorf("Unauthorized")
+			}
+			if permissions&models.PermissionSendMessages == 0 {
+				return fmt.Errorf("This channel is read only")
+			}
+			if err := helpers.CheckRoomMuted(context.Background(), *colls, channel.RoomID, uid); err != nil {
 				return err
 			}
 		}
-		msg := &socketmodels.OutRoomInvitationDelete{
-			ID:        invitationId.Hex(),
-			Author:    messagingData.Invitations[invitationIndex].Author.Hex(),
-			Recipient: uid.Hex(),
-		}
-		Uids := make(map[primitive.ObjectID]struct{})
-		Uids[uid] = struct{}{}
-		Uids[messagingData.Invitations[invitationIndex].Author] = struct{}{}
-		ss.SendDataToUsers <- socketserver.UsersDataMessage{
-			Uids: Uids,
-			Type: "OUT_ROOM_INVITATION_DELETE",
-			Data: msg,
-		}
-		return deleteIfErr
-	}
-
-	if _, err := colls.UserMessagingDataCollection.UpdateOne(context.Background(), bson.M{
-		"_id":             messagingData.ID,
-		"invitations._id": invitationId,
-	}, bson.M{
-		"$set": bson.M{
-			"invitations.$.accepted": data.Accept,
-			"invitations.$.declined": !data.Accept,
-		},
-	}); err != nil {
-		return err
-	}
 
-	if data.Accept {
-		if _, err := colls.RoomExternalDataCollection.UpdateOne(context.Background(), bson.M{
-			"_id": messagingData.Invitations[invitationIndex].RoomID,
-		}, bson.M{
-			"$addToSet": bson.M{
-				"members": messagingData.ID,
-			},
-		}); err != nil {
+		scope := bson.M{"channel_id": channelId}
+		if unpin {
+			err = helpers.UnpinMessage(context.Background(), colls.RoomMessageCollection, scope, msgId)
+		} else {
+			err = helpers.PinMessage(context.Background(), colls.RoomMessageCollection, scope, msgId, uid)
+		}
+		if err != nil {
 			return err
 		}
-		for _, channelId := range roomInternalData.Channels {
-			recvChan := make(chan map[primitive.ObjectID]struct{})
-			ss.GetSubscriptionUids <- socketserver.GetSubscriptionUids{
-				RecvChan: recvChan,
-				Name:     "channel:" + channelId.Hex(),
-			}
-			uidsInChannel := <-recvChan
-			ss.SendDataToUsers <- socketserver.UsersDataMessage{
-				Uids: uidsInChannel,
-				Type: "MEMBER_ADDED",
-				Data: socketmodels.MemberAdded{
-					Uid:    uid.Hex(),
-					RoomID: messagingData.Invitations[invitationIndex].RoomID.Hex(),
-				},
+
+		if msg.Author != uid {
+			action := "PIN_MESSAGE"
+			if unpin {
+				action = "UNPIN_MESSAGE"
 			}
+			helpers.WriteRoomAuditLog(context.Background(), *colls, channel.RoomID, uid, action, msgId, "Author: "+msg.Author.Hex())
 		}
-	}
 
-	Uids := make(map[primitive.ObjectID]struct{})
-	Uids[uid] = struct{}{}
-	Uids[messagingData.Invitations[invitationIndex].Author] = struct{}{}
-	ss.SendDataToUsers <- socketserver.UsersDataMessage{
-		Uids: Uids,
-		Type: "OUT_ROOM_INVITATION_RESPONSE",
-		Data: socketmodels.OutRoomInvitationResponse{
-			ID:        invitationId.Hex(),
-			Author:    messagingData.Invitations[invitationIndex].Author.Hex(),
-			Recipient: uid.Hex(),
-			Accept:    data.Accept,
-		},
-	}
+		outBytes, err := json.Marshal(socketmodels.Pinned{
+			Type:    outType,
+			ID:      msgId.Hex(),
+			Channel: channelId.Hex(),
+			By:      uid.Hex(),
+		})
+		if err != nil {
+			return err
+		}
 
-	return nil
-}
+		ss.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
+			Name: "channel:" + channelId.Hex(),
+			Data: outBytes,
+		}
 
-func friendRequest(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
-	var data socketmodels.FriendRequest
-	if err := json.Unmarshal(b, &data); err != nil {
-		return err
+		return nil
 	}
 
-	recipientId, err := primitive.ObjectIDFromHex(data.Recipient)
+	converseId, err := primitive.ObjectIDFromHex(data.Uid)
 	if err != nil {
 		return err
 	}
 
-	if recipientId == uid {
-		return fmt.Errorf("You cannot send a friend request to yourself")
-	}
-
-	messagingData := &models.UserMessagingData{}
-	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": recipientId}).Decode(&messagingData); err != nil {
+	converseMessagingData := &models.UserMessagingData{}
+	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": converseId}).Decode(&converseMessagingData); err != nil {
 		return err
 	}
-	for _, oi := range messagingData.Blocked {
-		if oi == recipientId {
-			return fmt.Errorf("You have blocked this users account. You must unblock the user before sending them a friend request")
+	for _, oi := range converseMessagingData.Blocked {
+		if oi == uid {
+			return fmt.Errorf("This user has blocked your account")
 		}
 	}
 
-	for _, fr := range messagingData.FriendRequests {
-		if fr.Author == recipientId {
-			return fmt.Errorf("This user has already sent you a friend request")
-		}
+	scope := bson.M{
+		"$or": bson.A{
+			bson.M{"author": uid, "recipient": converseId},
+			bson.M{"author": converseId, "recipient": uid},
+		},
 	}
-
-	recipientMessagingData := &models.UserMessagingData{}
-	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": recipientId}).Decode(&recipientMessagingData); err != nil {
-		return err
+	if unpin {
+		err = helpers.UnpinMessage(context.Background(), colls.DirectMessageCollection, scope, msgId)
 	} else {
-		for _, oi := range recipientMessagingData.Blocked {
-			if oi == uid {
-				return fmt.Errorf("This user has blocked your account, you cannot send them friend requests")
-			}
-		}
-		for _, fr := range recipientMessagingData.FriendRequests {
-			if fr.Author == uid && !fr.Accepted && !fr.Declined {
-				return fmt.Errorf("You have already sent this user a friend request")
-			}
-		}
-	}
-
-	friendRequestId := primitive.NewObjectID()
-
-	if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), recipientId, bson.M{
-		"$push": bson.M{
-			"friend_requests": models.FriendRequest{
-				ID:        friendRequestId,
-				CreatedAt: primitive.NewDateTimeFromTime(time.Now()),
-				Author:    uid,
-				Accepted:  false,
-				Declined:  false,
-			},
-		},
-		"$addToSet": bson.M{
-			// friend requests count as messages, even though they are stored in a seperate array
-			"messages_received_from": uid,
-		},
-	}); err != nil {
-		return err
+		err = helpers.PinMessage(context.Background(), colls.DirectMessageCollection, scope, msgId, uid)
 	}
-
-	if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), uid, bson.M{
-		"$addToSet": bson.M{
-			// friend requests as messages, even though they are stored in a seperate array
-			"messages_sent_to": recipientId,
-		},
-	}); err != nil {
+	if err != nil {
 		return err
 	}
 
-	msg := &socketmodels.OutFriendRequest{
-		ID:        friendRequestId.Hex(),
-		Author:    uid.Hex(),
-		Recipient: recipientId.Hex(),
+	ss.SendDataToUser <- socketserver.UserDataMessage{
+		Uid:  uid,
+		Type: outType,
+		Data: socketmodels.Pinned{ID: msgId.Hex(), Uid: converseId.Hex(), By: uid.Hex()},
 	}
-	Uids := make(map[primitive.ObjectID]struct{})
-	Uids[uid] = struct{}{}
-	Uids[recipientId] = struct{}{}
-	ss.SendDataToUsers <- socketserver.UsersDataMessage{
-		Uids: Uids,
-		Type: "OUT_FRIEND_REQUEST",
-		Data: msg,
+	ss.SendDataToUser <- socketserver.UserDataMessage{
+		Uid:  converseId,
+		Type: outType,
+		Data: socketmodels.Pinned{ID: msgId.Hex(), Uid: uid.Hex(), By: uid.Hex()},
 	}
 
 	return nil
 }
 
-func deleteFriendRequest(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
-	var data socketmodels.OutFriendRequestDelete
+// Moves the users read marker for the channel or conversation forward. The other user in a conversation gets a read receipt.
+func markRead(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
+	var data socketmodels.MarkRead
 	if err := json.Unmarshal(b, &data); err != nil {
 		return err
 	}
 
-	friendRequestId, err := primitive.ObjectIDFromHex(data.ID)
+	msgId, err := primitive.ObjectIDFromHex(data.ID)
 	if err != nil {
 		return err
 	}
 
-	messagingData := &models.UserMessagingData{}
-	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": uid}).Decode(&messagingData); err != nil {
+	if data.Channel != "" {
+		channelId, err := primitive.ObjectIDFromHex(data.Channel)
+		if err != nil {
+			return err
+		}
+		if _, _, err := checkRoomChannelAccess(channelId, uid, colls); err != nil {
+			return err
+		}
+		if count, err := colls.RoomMessageCollection.CountDocuments(context.Background(), bson.M{"_id": msgId, "channel_id": channelId}); err != nil {
+			return err
+		} else if count == 0 {
+			return fmt.Errorf("Message not found")
+		}
+		_, err = helpers.MarkRead(context.Background(), *colls, uid, channelId, msgId)
 		return err
 	}
 
-	friendRequestIndex := -1
-	for i, fr := range messagingData.FriendRequests {
-		if fr.ID == friendRequestId {
-			friendRequestIndex = i
-			break
-		}
+	converseId, err := primitive.ObjectIDFromHex(data.Uid)
+	if err != nil {
+		return err
 	}
-	if friendRequestIndex == -1 {
-		return fmt.Errorf("Friend request not found")
+	if count, err := colls.DirectMessageCollection.CountDocuments(context.Background(), bson.M{
+		"_id": msgId,
+		"$or": bson.A{
+			bson.M{"author": uid, "recipient": converseId},
+			bson.M{"author": converseId, "recipient": uid},
+		},
+	}); err != nil {
+		return err
+	} else if count == 0 {
+		return fmt.Errorf("Message not found")
 	}
-	if messagingData.FriendRequests[friendRequestIndex].Author != uid {
-		return fmt.Errorf("Unauthorized")
+
+	moved, err := helpers.MarkRead(context.Background(), *colls, uid, converseId, msgId)
+	if err != nil || !moved {
+		return err
 	}
 
-	if err := colls.UserMessagingDataCollection.FindOneAndUpdate(context.Background(), bson.M{"_id": uid}, bson.M{
-		"$pull": bson.M{
-			"friend_requests": bson.M{
-				"_id":    friendRequestIndex,
-				"author": messagingData.FriendRequests[friendRequestIndex].Author,
-			},
-		},
-	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&messagingData); err != nil {
+	// Don't send receipts between users that have blocked each other
+	converseMessagingData := &models.UserMessagingData{}
+	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": converseId}).Decode(&converseMessagingData); err != nil {
 		return err
-	} else {
-		if !checkAnythingReceivedFrom(*messagingData, messagingData.FriendRequests[friendRequestIndex].Author) {
-			if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), uid, bson.M{
-				"$pull": bson.M{
-					"messages_received_from": messagingData.FriendRequests[friendRequestIndex].Author,
-				},
-			}); err != nil {
-				return err
-			}
+	}
+	for _, oi := range converseMessagingData.Blocked {
+		if oi == uid {
+			return nil
 		}
 	}
-
-	msg := &socketmodels.OutFriendRequestDelete{
-		ID:        friendRequestId.Hex(),
-		Author:    uid.Hex(),
-		Recipient: data.Recipient,
+	blocked, err := helpers.GetBlockedUids(context.Background(), *colls, uid)
+	if err != nil {
+		return err
 	}
-	Uids := make(map[primitive.ObjectID]struct{})
-	Uids[uid] = struct{}{}
-	Uids[messagingData.FriendRequests[friendRequestIndex].Author] = struct{}{}
-	ss.SendDataToUsers <- socketserver.UsersDataMessage{
-		Uids: Uids,
-		Type: "OUT_FRIEND_REQUEST_DELETE",
-		Data: msg,
+	for _, oi := range blocked {
+		if oi == converseId {
+			return nil
+		}
+	}
+
+	ss.SendDataToUser <- socketserver.UserDataMessage{
+		Uid:  converseId,
+		Type: "READ_RECEIPT",
+		Data: socketmodels.ReadReceipt{
+			Uid: uid.Hex(),
+			ID:  msgId.Hex(),
+		},
 	}
 
 	return nil
 }
 
-func friendRequestResponse(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
-	var data socketmodels.FriendRequestResponse
+// Used for TYPING_START and TYPING_STOP. Typing is hidden from users that blocked the typist, and from users banned from the room.
+func typing(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, ts *typingserver.TypingServer, colls *db.Collections, stop bool) error {
+	var data socketmodels.Typing
 	if err := json.Unmarshal(b, &data); err != nil {
 		return err
 	}
 
-	friendRequestId, err := primitive.ObjectIDFromHex(data.ID)
-	if err != nil {
-		return err
-	}
-
-	messagingData := &models.UserMessagingData{}
-	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": uid}).Decode(&messagingData); err != nil {
-		return err
-	}
+	if data.Channel != "" {
+		channelId, err := primitive.ObjectIDFromHex(data.Channel)
+		if err != nil {
+			return err
+		}
+		if stop {
+			ts.StopChan <- typingserver.InTyping{Uid: uid, Target: channelId, IsChannel: true}
+			return nil
+		}
 
-	friendRequestIndex := -1
-	for i, inv := range messagingData.FriendRequests {
-		if inv.ID == friendRequestId {
-			friendRequestIndex = i
-			break
+		channel, permissions, err := checkRoomChannelAccess(channelId, uid, colls)
+		if err != nil {
+			return err
+		}
+		if permissions&models.PermissionSendMessages == 0 {
+			return fmt.Errorf("This channel is read only")
+		}
+		if err := helpers.CheckRoomMuted(context.Background(), *colls, channel.RoomID, uid); err != nil {
+			return err
 		}
-	}
-	if friendRequestIndex == -1 {
-		return fmt.Errorf("Friend request not found")
-	}
-
-	frq := messagingData.FriendRequests[friendRequestIndex]
-
-	authorMessagingData := &models.UserMessagingData{}
-	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": messagingData.FriendRequests[friendRequestIndex].Author}).Decode(&authorMessagingData); err != nil {
-		return err
-	}
 
-	var deleteIfErr error = nil
-	for _, oi := range authorMessagingData.Blocked {
-		if oi == uid {
-			deleteIfErr = fmt.Errorf("The sender of this invitation has blocked your account, friend request is no longer valid")
-			break
+		recvChan := make(chan map[primitive.ObjectID]struct{})
+		ss.GetSubscriptionUids <- socketserver.GetSubscriptionUids{
+			RecvChan: recvChan,
+			Name:     "channel:" + channelId.Hex(),
 		}
-	}
-	if deleteIfErr != nil {
-		if err := colls.UserMessagingDataCollection.FindOneAndUpdate(context.Background(), bson.M{"_id": uid}, bson.M{
-			"$pull": bson.M{
-				"friend_requests": bson.M{
-					"_id":    friendRequestId,
-					"author": messagingData.Invitations[friendRequestIndex].Author,
-				},
-			},
-		}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&messagingData); err != nil {
+		uidsInChannel := <-recvChan
+		subscriberUids := []primitive.ObjectID{}
+		for oi := range uidsInChannel {
+			subscriberUids = append(subscriberUids, oi)
+		}
+
+		// Subscribers that can no longer see the channel are left out
+		viewerUids, err := helpers.FilterRoomChannelViewers(context.Background(), *colls, channel, subscriberUids)
+		if err != nil {
 			return err
 		}
-		if !checkAnythingReceivedFrom(*messagingData, messagingData.FriendRequests[friendRequestIndex].Author) {
-			if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), uid, bson.M{
-				"$pull": bson.M{
-					"messages_received_from": messagingData.FriendRequests[friendRequestIndex].Author,
-				},
-			}); err != nil {
+		exclude := make(map[primitive.ObjectID]bool)
+		for _, oi := range subscriberUids {
+			exclude[oi] = true
+		}
+		for _, oi := range viewerUids {
+			delete(exclude, oi)
+		}
+		if len(viewerUids) > 0 {
+			cursor, err := colls.UserMessagingDataCollection.Find(context.Background(), bson.M{
+				"_id":     bson.M{"$in": viewerUids},
+				"blocked": uid,
+			}, options.Find().SetProjection(bson.M{"_id": 1}))
+			if err != nil {
 				return err
 			}
+			blockers := []models.UserMessagingData{}
+			if err := cursor.All(context.Background(), &blockers); err != nil {
+				return err
+			}
+			for _, umd := range blockers {
+				exclude[umd.ID] = true
+			}
 		}
-		msg := &socketmodels.OutFriendRequestResponse{
-			ID:        friendRequestId.Hex(),
-			Author:    uid.Hex(),
-			Recipient: data.Recipient,
-		}
-		Uids := make(map[primitive.ObjectID]struct{})
-		Uids[uid] = struct{}{}
-		Uids[messagingData.FriendRequests[friendRequestIndex].Author] = struct{}{}
-		ss.SendDataToUsers <- socketserver.UsersDataMessage{
-			Uids: Uids,
-			Type: "OUT_FRIEND_REQUEST_DELETE",
-			Data: msg,
+
+		ts.StartChan <- typingserver.InTyping{
+			Uid:       uid,
+			Target:    channelId,
+			IsChannel: true,
+			Exclude:   exclude,
 		}
-		return deleteIfErr
+		return nil
 	}
 
-	if data.Accept {
-		if _, err := colls.UserMessagingDataCollection.UpdateOne(context.Background(), bson.M{
-			"_id":                 uid,
-			"friend_requests._id": friendRequestId,
-		}, bson.M{
-			"$set": bson.M{
-				"friend_requests.$.accepted": data.Accept,
-				"friend_requests.$.declined": !data.Accept,
-			},
-			"$addToSet": bson.M{
-				"friends": frq.Author,
-			},
-		}); err != nil {
-			return err
-		}
+	converseId, err := primitive.ObjectIDFromHex(data.Uid)
+	if err != nil {
+		return err
+	}
+	if stop {
+		ts.StopChan <- typingserver.InTyping{Uid: uid, Target: converseId}
+		return nil
+	}
 
-		if _, err := colls.UserMessagingDataCollection.UpdateOne(context.Background(), bson.M{
-			"_id": frq.Author,
-		}, bson.M{
-			"$addToSet": bson.M{
-				"friends": uid,
-			},
-		}); err != nil {
-			return err
+	// Ignored instead of returning an error, clients send these while the user types
+	converseMessagingData := &models.UserMessagingData{}
+	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": converseId}).Decode(&converseMessagingData); err != nil {
+		return err
+	}
+	for _, oi := range converseMessagingData.Blocked {
+		if oi == uid {
+			return nil
 		}
 	}
-
-	inv := &socketmodels.OutFriendRequestResponse{
-		ID:        friendRequestId.Hex(),
-		Author:    uid.Hex(),
-		Recipient: frq.Author.Hex(),
-		Accept:    data.Accept,
+	blocked, err := helpers.GetBlockedUids(context.Background(), *colls, uid)
+	if err != nil {
+		return err
 	}
-	Uids := make(map[primitive.ObjectID]struct{})
-	Uids[uid] = struct{}{}
-	Uids[frq.Author] = struct{}{}
-	ss.SendDataToUsers <- socketserver.UsersDataMessage{
-		Uids: Uids,
-		Type: "OUT_FRIEND_REQUEST_RESPONSE",
-		Data: inv,
+	for _, oi := range blocked {
+		if oi == converseId {
+			return nil
+		}
 	}
 
+	ts.StartChan <- typingserver.InTyping{Uid: uid, Target: converseId}
 	return nil
 }
 
-func blockUser(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, colls *db.Collections) error {
-	var data socketmodels.Block
+func scheduleMessage(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
+	var data socketmodels.ScheduleMessage
 	if err := json.Unmarshal(b, &data); err != nil {
 		return err
 	}
 
-	blockedUid, err := primitive.ObjectIDFromHex(data.Uid)
-	if err != nil {
-		return err
-	}
-
-	userMessagingData := &models.UserMessagingData{}
-	if err := colls.UserMessagingDataCollection.FindOneAndUpdate(context.Background(), bson.M{"_id": uid}, bson.M{
-		"$addToSet": bson.M{
-			"blocked": blockedUid,
-		},
-		"$pull": bson.M{
-			"friends": blockedUid,
-			"messages": bson.M{
-				"author": blockedUid,
-			},
-			"messages_sent_to":       blockedUid,
-			"messages_received_from": blockedUid,
-		},
-	}, options.FindOneAndUpdate().SetReturnDocument(options.Before)).Decode(&userMessagingData); err != nil {
-		return err
+	if strings.TrimSpace(data.Content) == "" {
+		return fmt.Errorf("You cannot submit an empty message")
 	}
-	for _, dm := range userMessagingData.Messages {
-		if dm.Author == blockedUid && dm.HasAttachment {
-			as.DeleteChan <- attachmentserver.Delete{
-				MsgId: dm.ID,
-				Uid:   blockedUid,
-			}
-		}
+	if len(data.Content) > 300 {
+		return fmt.Errorf("Max 300 characters")
 	}
 
-	blockedUserMessagingData := &models.UserMessagingData{}
-	if err := colls.UserMessagingDataCollection.FindOneAndUpdate(context.Background(), bson.M{"_id": blockedUid}, bson.M{
-		"$pull": bson.M{
-			"friends": uid,
-			"messages": bson.M{
-				"author": uid,
-			},
-			"messages_sent_to":       uid,
-			"messages_received_from": uid,
-		},
-	}, options.FindOneAndUpdate().SetReturnDocument(options.Before)).Decode(&blockedUserMessagingData); err != nil {
+	sendAt, err := helpers.GetScheduleTime(context.Background(), *colls, uid, data.SendAt)
+	if err != nil {
 		return err
 	}
-	for _, dm := range blockedUserMessagingData.Messages {
-		if dm.Author == uid && dm.HasAttachment {
-			as.DeleteChan <- attachmentserver.Delete{
-				MsgId: dm.ID,
-				Uid:   uid,
-			}
-		}
+
+	sentId := primitive.NewObjectID()
+	msg := models.ScheduledMessage{
+		ID:        primitive.NewObjectID(),
+		Uid:       uid,
+		Kind:      models.ScheduledKindMessage,
+		MsgID:     &sentId,
+		SendAt:    primitive.NewDateTimeFromTime(sendAt),
+		Content:   data.Content,
+		RichText:  data.RichText,
+		CreatedAt: primitive.NewDateTimeFromTime(time.Now()),
 	}
 
-	rooms := []models.Room{}
-	if cursor, err := colls.RoomCollection.Find(context.Background(), bson.M{"author": uid}); err != nil {
-		cursor.Close(context.Background())
-		return err
+	// Permissions are checked again when the message is sent, this is so the user finds out now if they can't send it
+	if data.Channel != "" {
+		channelId, err := primitive.ObjectIDFromHex(data.Channel)
+		if err != nil {
+			return err
+		}
+		_, permissions, err := checkRoomChannelAccess(channelId, uid, colls)
+		if err != nil {
+			return err
+		}
+		if permissions&models.PermissionSendMessages == 0 {
+			return fmt.Errorf("This channel is read only")
+		}
+		if msg.ReplyTo, err = getRoomThreadRoot(channelId, data.ReplyTo, colls); err != nil {
+			return err
+		}
+		msg.Target = channelId
+		msg.IsRoom = true
 	} else {
-		cursor.All(context.Background(), rooms)
-		defer cursor.Close(context.Background())
-		roomIds := []primitive.ObjectID{}
-		for _, r := range rooms {
-			roomIds = append(roomIds, r.ID)
-			internalData := &models.RoomInternalData{}
-			if err := colls.RoomInternalDataCollection.FindOne(context.Background(), bson.M{"_id": r.ID}).Decode(&internalData); err != nil {
-				return err
-			}
-			for _, oi := range internalData.Channels {
-				recvChan := make(chan map[primitive.ObjectID]struct{})
-				ss.GetSubscriptionUids <- socketserver.GetSubscriptionUids{
-					RecvChan: recvChan,
-					Name:     "channel:" + oi.Hex(),
-				}
-				uidsInChannel := <-recvChan
-				// Blocking a user also bans them from all the blockers rooms
-				ss.SendDataToUsers <- socketserver.UsersDataMessage{
-					Uids: uidsInChannel,
-					Data: socketmodels.Banned{
-						Banner: uid.Hex(),
-						Banned: data.Uid,
-						RoomID: r.ID.Hex(),
-					},
-					Type: "BANNED",
-				}
-				ss.RemoveUserFromSubscription <- socketserver.RemoveUserFromSubscription{
-					Name: "channel:" + oi.Hex(),
-					Uid:  blockedUid,
-				}
-				channelMessages := &models.RoomChannelMessages{}
-				if err := colls.RoomChannelMessagesCollection.FindOneAndUpdate(context.Background(), bson.M{"_id": oi}, bson.M{
-					"messages": bson.M{
-						"author": blockedUid,
-					},
-				}, options.FindOneAndUpdate().SetReturnDocument(options.Before)).Decode(&channelMessages); err != nil {
-					return err
-				}
-				for _, rcm := range channelMessages.Messages {
-					if rcm.Author == blockedUid && rcm.HasAttachment {
-						as.DeleteChan <- attachmentserver.Delete{
-							MsgId: rcm.ID,
-							Uid:   blockedUid,
-						}
-					}
-				}
+		recipientId, err := primitive.ObjectIDFromHex(data.Recipient)
+		if err != nil {
+			return err
+		}
+		if recipientId == uid {
+			return fmt.Errorf("You cannot message yourself")
+		}
+		recipientMessagingData := &models.UserMessagingData{}
+		if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": recipientId}).Decode(&recipientMessagingData); err != nil {
+			return err
+		}
+		for _, oi := range recipientMessagingData.Blocked {
+			if oi == uid {
+				return fmt.Errorf("This user has blocked your account")
 			}
 		}
-		if _, err := colls.RoomExternalDataCollection.UpdateMany(context.Background(), bson.M{"_id": bson.M{"$in": roomIds}}, bson.M{
-			"$pull": bson.M{
-				"members": blockedUid,
-			},
-			"$addToSet": bson.M{
-				"banned": blockedUid,
-			},
-		}); err != nil {
+		if msg.ReplyTo, err = getDirectThreadRoot(uid, recipientId, data.ReplyTo, colls); err != nil {
 			return err
 		}
+		msg.Target = recipientId
 	}
 
-	uids := make(map[primitive.ObjectID]struct{})
-	uids[uid] = struct{}{}
-	uids[blockedUid] = struct{}{}
+	if _, err := colls.ScheduledMessageCollection.InsertOne(context.Background(), msg); err != nil {
+		return err
+	}
 
-	ss.SendDataToUsers <- socketserver.UsersDataMessage{
-		Uids: uids,
-		Data: socketmodels.Blocked{
-			Blocker: uid.Hex(),
-		},
-		Type: "BLOCKED",
+	ss.SendDataToUser <- socketserver.UserDataMessage{
+		Uid:  uid,
+		Type: "SCHEDULED",
+		Data: msg,
 	}
 
 	return nil
 }
 
-func unblockUser(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, colls *db.Collections) error {
-	var data socketmodels.Block
+func scheduleReminder(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
+	var data socketmodels.ScheduleReminder
 	if err := json.Unmarshal(b, &data); err != nil {
 		return err
 	}
 
-	blockedUid, err := primitive.ObjectIDFromHex(data.Uid)
+	if len(data.Note) > 100 {
+		return fmt.Errorf("Max 100 characters")
+	}
+
+	msgId, err := primitive.ObjectIDFromHex(data.ID)
 	if err != nil {
 		return err
 	}
 
-	if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), uid, bson.M{
-		"$pull": bson.M{
-			"blocked": blockedUid,
-		},
-	}); err != nil {
+	remindAt, err := helpers.GetScheduleTime(context.Background(), *colls, uid, data.RemindAt)
+	if err != nil {
 		return err
 	}
 
-	uids := make(map[primitive.ObjectID]struct{})
-	uids[uid] = struct{}{}
-	uids[blockedUid] = struct{}{}
+	reminder := models.ScheduledMessage{
+		ID:        primitive.NewObjectID(),
+		Uid:       uid,
+		Kind:      models.ScheduledKindReminder,
+		SendAt:    primitive.NewDateTimeFromTime(remindAt),
+		Content:   strings.TrimSpace(data.Note),
+		MsgID:     &msgId,
+		CreatedAt: primitive.NewDateTimeFromTime(time.Now()),
+	}
 
-	ss.SendDataToUsers <- socketserver.UsersDataMessage{
-		Uids: uids,
-		Data: socketmodels.Blocked{
-			Blocker: uid.Hex(),
-		},
-		Type: "UNBLOCKED",
+	if data.Channel != "" {
+		channelId, err := primitive.ObjectIDFromHex(data.Channel)
+		if err != nil {
+			return err
+		}
+		reminder.Target = channelId
+		reminder.IsRoom = true
+	} else {
+		otherUid, err := primitive.ObjectIDFromHex(data.Uid)
+		if err != nil {
+			return err
+		}
+		reminder.Target = otherUid
+	}
+
+	if _, err := getReminderMessage(reminder, colls); err != nil {
+		return err
+	}
+
+	if _, err := colls.ScheduledMessageCollection.InsertOne(context.Background(), reminder); err != nil {
+		return err
+	}
+
+	ss.SendDataToUser <- socketserver.UserDataMessage{
+		Uid:  uid,
+		Type: "SCHEDULED",
+		Data: reminder,
 	}
 
 	return nil
 }
 
-func banUser(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, colls *db.Collections) error {
-	var data socketmodels.Ban
+func scheduledDelete(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
+	var data socketmodels.ScheduledDelete
 	if err := json.Unmarshal(b, &data); err != nil {
 		return err
 	}
 
-	bannedUid, err := primitive.ObjectIDFromHex(data.Uid)
+	id, err := primitive.ObjectIDFromHex(data.ID)
 	if err != nil {
 		return err
 	}
-	roomId, err := primitive.ObjectIDFromHex(data.RoomID)
-	if err != nil {
+
+	// Claimed messages are being sent by the dispatcher, unless the claim has expired
+	if res, err := colls.ScheduledMessageCollection.DeleteOne(context.Background(), bson.M{
+		"_id": id,
+		"uid": uid,
+		"$or": bson.A{
+			bson.M{"claimed_at": bson.M{"$exists": false}},
+			bson.M{"claimed_at": bson.M{"$lte": primitive.NewDateTimeFromTime(time.Now().Add(-messagescheduler.ClaimTimeout))}},
+		},
+	}); err != nil {
 		return err
+	} else if res.DeletedCount == 0 {
+		return fmt.Errorf("Scheduled message not found, it may have already been sent")
 	}
 
-	if _, err := colls.RoomExternalDataCollection.UpdateByID(context.Background(), roomId, bson.M{
-		"$addToSet": bson.M{
-			"banned": bannedUid,
-		},
-		"$pull": bson.M{
-			"members": bannedUid,
-		},
-	}); err != nil {
-		return err
+	ss.SendDataToUser <- socketserver.UserDataMessage{
+		Uid:  uid,
+		Type: "SCHEDULED_DELETED",
+		Data: socketmodels.ScheduledDone{ID: id.Hex()},
+	}
+
+	return nil
+}
+
+// Used by the message scheduler. Messages go through the same code as ROOM_MESSAGE and DIRECT_MESSAGE, so permissions are checked again.
+func DeliverScheduledMessage(ss *socketserver.SocketServer, lps *linkpreviewserver.LinkPreviewServer, colls *db.Collections) messagescheduler.Deliver {
+	return func(msg models.ScheduledMessage) error {
+		if msg.Kind == models.ScheduledKindReminder {
+			reminder, err := getReminderMessage(msg, colls)
+			if err != nil {
+				return err
+			}
+			reminder.ID = msg.ID.Hex()
+			reminder.Note = msg.Content
+			ss.SendDataToUser <- socketserver.UserDataMessage{
+				Uid:  msg.Uid,
+				Type: "REMINDER",
+				Data: reminder,
+			}
+			return nil
+		}
+
+		if msg.MsgID == nil {
+			return fmt.Errorf("Scheduled message has no message ID")
+		}
+		msgId := *msg.MsgID
+		collection := colls.DirectMessageCollection
+		if msg.IsRoom {
+			collection = colls.RoomMessageCollection
+		}
+		// A previous attempt already sent the message
+		if count, err := collection.CountDocuments(context.Background(), bson.M{"_id": msgId}, options.Count().SetLimit(1)); err != nil {
+			return err
+		} else if count > 0 {
+			return nil
+		}
+
+		if msg.IsRoom {
+			return sendRoomMessage(socketmodels.RoomMessage{
+				Content:  msg.Content,
+				Channel:  msg.Target.Hex(),
+				ReplyTo:  replyToHex(msg.ReplyTo),
+				RichText: msg.RichText,
+			}, msgId, msg.Uid, ss, lps, colls)
+		}
+
+		return sendDirectMessage(socketmodels.DirectMessage{
+			Content:   msg.Content,
+			Recipient: msg.Target.Hex(),
+			ReplyTo:   replyToHex(msg.ReplyTo),
+			RichText:  msg.RichText,
+		}, msgId, msg.Uid, ss, lps, colls)
+	}
+}
+
+func inviteToRoom(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
+	var data socketmodels.InviteToRoom
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	recipientId, err := primitive.ObjectIDFromHex(data.Recipient)
+	if err != nil {
+		return err
+	}
+
+	if recipientId == uid {
+		return fmt.Errorf("You cannot send an invitation to yourself")
+	}
+
+	roomId, err := primitive.ObjectIDFromHex(data.RoomID)
+	if err != nil {
+		return err
+	}
+
+	recipientPermissions, roomExternalData, err := helpers.GetRoomPermissionsAndExternalData(context.Background(), *colls, roomId, recipientId)
+	if err != nil && err != helpers.ErrRoomNotMember {
+		if err == helpers.ErrRoomBanned {
+			return fmt.Errorf("You have banned this user. You must unban them to send an invite")
+		}
+		return err
+	}
+	if recipientPermissions&models.PermissionOwner != 0 || helpers.IsRoomMember(roomExternalData, recipientId) {
+		return fmt.Errorf("This user is already a member of the room")
+	}
+
+	if err := helpers.CheckRoomPermission(context.Background(), *colls, roomId, uid, models.PermissionInvite); err != nil {
+		return err
+	}
+
+	messagingData := &models.UserMessagingData{}
+	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": recipientId}).Decode(&messagingData); err != nil {
+		return err
+	}
+	for _, oi := range messagingData.Blocked {
+		if oi == recipientId {
+			return fmt.Errorf("You have blocked this users account. You must unblock the user before sending them an invite")
+		}
+	}
+
+	recipientMessagingData := &models.UserMessagingData{}
+	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": recipientId}).Decode(&recipientMessagingData); err != nil {
+		return err
+	} else {
+		for _, oi := range recipientMessagingData.Blocked {
+			if oi == uid {
+				return fmt.Errorf("This user has blocked your account, you cannot send them invitations")
+			}
+		}
+	}
+
+	invitationId := primitive.NewObjectID()
+
+	if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), recipientId, bson.M{
+		"$push": bson.M{
+			"invitations": models.Invitation{
+				ID:        invitationId,
+				CreatedAt: primitive.NewDateTimeFromTime(time.Now()),
+				Author:    uid,
+				RoomID:    roomId,
+				Accepted:  false,
+				Declined:  false,
+			},
+		},
+		"$addToSet": bson.M{
+			// invitations count as messages, even though they are stored in a seperate array
+			"messages_received_from": uid,
+		},
+	}); err != nil {
+		return err
+	}
+
+	if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), uid, bson.M{
+		"$addToSet": bson.M{
+			// invitations count as messages, even though they are stored in a seperate array
+			"messages_sent_to": recipientId,
+		},
+	}); err != nil {
+		return err
+	}
+
+	msg := &socketmodels.OutInvite{
+		ID:        invitationId.Hex(),
+		Author:    uid.Hex(),
+		Recipient: recipientId.Hex(),
+		RoomID:    roomId.Hex(),
+	}
+	Uids := make(map[primitive.ObjectID]struct{})
+	Uids[uid] = struct{}{}
+	Uids[recipientId] = struct{}{}
+	ss.SendDataToUsers <- socketserver.UsersDataMessage{
+		Uids: Uids,
+		Type: "OUT_ROOM_INVITATION",
+		Data: msg,
+	}
+
+	return nil
+}
+
+func deleteInvitationToRoom(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
+	var data socketmodels.RoomInvitationDelete
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	invitationId, err := primitive.ObjectIDFromHex(data.ID)
+	if err != nil {
+		return err
+	}
+
+	messagingData := &models.UserMessagingData{}
+	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": uid}).Decode(&messagingData); err != nil {
+		return err
+	}
+
+	invitationIndex := -1
+	for i, inv := range messagingData.Invitations {
+		if inv.ID == invitationId {
+			invitationIndex = i
+			break
+		}
+	}
+	if invitationIndex == -1 {
+		return fmt.Errorf("Invitation not found")
+	}
+
+	if messagingData.Invitations[invitationIndex].Author != uid {
+		return fmt.Errorf("Unauthorized")
+	}
+
+	if err := colls.UserMessagingDataCollection.FindOneAndUpdate(context.Background(), bson.M{"_id": uid}, bson.M{
+		"$pull": bson.M{
+			"invitations": bson.M{
+				"_id":    invitationId,
+				"author": messagingData.Invitations[invitationIndex].Author,
+			},
+		},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&messagingData); err != nil {
+		return err
+	} else {
+		if anythingReceived, err := checkAnythingReceivedFrom(*messagingData, messagingData.Invitations[invitationIndex].Author, colls); err != nil {
+			return err
+		} else if !anythingReceived {
+			if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), uid, bson.M{
+				"$pull": bson.M{
+					"messages_received_from": messagingData.Invitations[invitationIndex].Author,
+				},
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	msg := &socketmodels.OutRoomInvitationDelete{
+		ID:        invitationId.Hex(),
+		Author:    uid.Hex(),
+		Recipient: data.Recipient,
+	}
+	Uids := make(map[primitive.ObjectID]struct{})
+	Uids[uid] = struct{}{}
+	Uids[messagingData.Invitations[invitationIndex].Author] = struct{}{}
+	ss.SendDataToUsers <- socketserver.UsersDataMessage{
+		Uids: Uids,
+		Type: "OUT_ROOM_INVITATION_DELETE",
+		Data: msg,
+	}
+
+	return nil
+}
+
+func invitationToRoomResponse(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
+	var data socketmodels.RoomInvitationResponse
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	invitationId, err := primitive.ObjectIDFromHex(data.ID)
+	if err != nil {
+		return err
+	}
+
+	messagingData := &models.UserMessagingData{}
+	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": uid}).Decode(&messagingData); err != nil {
+		return err
+	}
+
+	invitationIndex := -1
+	for i, inv := range messagingData.Invitations {
+		if inv.ID == invitationId {
+			invitationIndex = i
+			break
+		}
+	}
+	if invitationIndex == -1 {
+		return fmt.Errorf("Invitation not found")
+	}
+
+	authorMessagingData := &models.UserMessagingData{}
+	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": messagingData.Invitations[invitationIndex].Author}).Decode(&authorMessagingData); err != nil {
+		return err
+	}
+	permissions, roomExternalData, err := helpers.GetRoomPermissionsAndExternalData(context.Background(), *colls, messagingData.Invitations[invitationIndex].RoomID, uid)
+	if err != nil && err != helpers.ErrRoomBanned && err != helpers.ErrRoomNotMember {
+		return err
+	}
+	roomInternalData := &models.RoomInternalData{}
+	if err := colls.RoomInternalDataCollection.FindOne(context.Background(), bson.M{"_id": messagingData.Invitations[invitationIndex].RoomID}).Decode(&roomInternalData); err != nil {
+		return err
+	}
+
+	var deleteIfErr error = nil
+	if err == helpers.ErrRoomBanned {
+		deleteIfErr = fmt.Errorf("You can no longer accept this invitation, you have been banned from the room")
+	}
+	if permissions&models.PermissionOwner != 0 || helpers.IsRoomMember(roomExternalData, uid) {
+		deleteIfErr = fmt.Errorf("You are already a member of this room")
+	}
+	for _, oi := range authorMessagingData.Blocked {
+		if oi == uid {
+			deleteIfErr = fmt.Errorf("The sender of this invitation has blocked your account, invitation is no longer valid")
+			break
+		}
+	}
+
+	if deleteIfErr != nil {
+		if err := colls.UserMessagingDataCollection.FindOneAndUpdate(context.Background(), bson.M{"_id": uid}, bson.M{
+			"$pull": bson.M{
+				"invitations": bson.M{
+					"_id":    invitationId,
+					"author": messagingData.Invitations[invitationIndex].Author,
+				},
+			},
+		}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&messagingData); err != nil {
+			return err
+		}
+		if anythingReceived, err := checkAnythingReceivedFrom(*messagingData, messagingData.Invitations[invitationIndex].Author, colls); err != nil {
+			return err
+		} else if !anythingReceived {
+			if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), uid, bson.M{
+				"$pull": bson.M{
+					"messages_received_from": messagingData.Invitations[invitationIndex].Author,
+				},
+			}); err != nil {
+				return err
+			}
+		}
+		msg := &socketmodels.OutRoomInvitationDelete{
+			ID:        invitationId.Hex(),
+			Author:    messagingData.Invitations[invitationIndex].Author.Hex(),
+			Recipient: uid.Hex(),
+		}
+		Uids := make(map[primitive.ObjectID]struct{})
+		Uids[uid] = struct{}{}
+		Uids[messagingData.Invitations[invitationIndex].Author] = struct{}{}
+		ss.SendDataToUsers <- socketserver.UsersDataMessage{
+			Uids: Uids,
+			Type: "OUT_ROOM_INVITATION_DELETE",
+			Data: msg,
+		}
+		return deleteIfErr
+	}
+
+	if _, err := colls.UserMessagingDataCollection.UpdateOne(context.Background(), bson.M{
+		"_id":             messagingData.ID,
+		"invitations._id": invitationId,
+	}, bson.M{
+		"$set": bson.M{
+			"invitations.$.accepted": data.Accept,
+			"invitations.$.declined": !data.Accept,
+		},
+	}); err != nil {
+		return err
+	}
+
+	if data.Accept {
+		if _, err := colls.RoomExternalDataCollection.UpdateOne(context.Background(), bson.M{
+			"_id": messagingData.Invitations[invitationIndex].RoomID,
+		}, bson.M{
+			"$addToSet": bson.M{
+				"members": messagingData.ID,
+			},
+		}); err != nil {
+			return err
+		}
+		for _, channelId := range roomInternalData.Channels {
+			recvChan := make(chan map[primitive.ObjectID]struct{})
+			ss.GetSubscriptionUids <- socketserver.GetSubscriptionUids{
+				RecvChan: recvChan,
+				Name:     "channel:" + channelId.Hex(),
+			}
+			uidsInChannel := <-recvChan
+			ss.SendDataToUsers <- socketserver.UsersDataMessage{
+				Uids: uidsInChannel,
+				Type: "MEMBER_ADDED",
+				Data: socketmodels.MemberAdded{
+					Uid:    uid.Hex(),
+					RoomID: messagingData.Invitations[invitationIndex].RoomID.Hex(),
+				},
+			}
+		}
+	}
+
+	Uids := make(map[primitive.ObjectID]struct{})
+	Uids[uid] = struct{}{}
+	Uids[messagingData.Invitations[invitationIndex].Author] = struct{}{}
+	ss.SendDataToUsers <- socketserver.UsersDataMessage{
+		Uids: Uids,
+		Type: "OUT_ROOM_INVITATION_RESPONSE",
+		Data: socketmodels.OutRoomInvitationResponse{
+			ID:        invitationId.Hex(),
+			Author:    messagingData.Invitations[invitationIndex].Author.Hex(),
+			Recipient: uid.Hex(),
+			Accept:    data.Accept,
+		},
+	}
+
+	return nil
+}
+
+func friendRequest(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
+	var data socketmodels.FriendRequest
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	recipientId, err := primitive.ObjectIDFromHex(data.Recipient)
+	if err != nil {
+		return err
+	}
+
+	if recipientId == uid {
+		return fmt.Errorf("You cannot send a friend request to yourself")
+	}
+
+	messagingData := &models.UserMessagingData{}
+	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": recipientId}).Decode(&messagingData); err != nil {
+		return err
+	}
+	for _, oi := range messagingData.Blocked {
+		if oi == recipientId {
+			return fmt.Errorf("You have blocked this users account. You must unblock the user before sending them a friend request")
+		}
+	}
+
+	for _, fr := range messagingData.FriendRequests {
+		if fr.Author == recipientId {
+			return fmt.Errorf("This user has already sent you a friend request")
+		}
+	}
+
+	recipientMessagingData := &models.UserMessagingData{}
+	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": recipientId}).Decode(&recipientMessagingData); err != nil {
+		return err
+	} else {
+		for _, oi := range recipientMessagingData.Blocked {
+			if oi == uid {
+				return fmt.Errorf("This user has blocked your account, you cannot send them friend requests")
+			}
+		}
+		for _, fr := range recipientMessagingData.FriendRequests {
+			if fr.Author == uid && !fr.Accepted && !fr.Declined {
+				return fmt.Errorf("You have already sent this user a friend request")
+			}
+		}
+	}
+
+	friendRequestId := primitive.NewObjectID()
+
+	if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), recipientId, bson.M{
+		"$push": bson.M{
+			"friend_requests": models.FriendRequest{
+				ID:        friendRequestId,
+				CreatedAt: primitive.NewDateTimeFromTime(time.Now()),
+				Author:    uid,
+				Accepted:  false,
+				Declined:  false,
+			},
+		},
+		"$addToSet": bson.M{
+			// friend requests count as messages, even though they are stored in a seperate array
+			"messages_received_from": uid,
+		},
+	}); err != nil {
+		return err
+	}
+
+	if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), uid, bson.M{
+		"$addToSet": bson.M{
+			// friend requests as messages, even though they are stored in a seperate array
+			"messages_sent_to": recipientId,
+		},
+	}); err != nil {
+		return err
+	}
+
+	msg := &socketmodels.OutFriendRequest{
+		ID:        friendRequestId.Hex(),
+		Author:    uid.Hex(),
+		Recipient: recipientId.Hex(),
+	}
+	Uids := make(map[primitive.ObjectID]struct{})
+	Uids[uid] = struct{}{}
+	Uids[recipientId] = struct{}{}
+	ss.SendDataToUsers <- socketserver.UsersDataMessage{
+		Uids: Uids,
+		Type: "OUT_FRIEND_REQUEST",
+		Data: msg,
+	}
+
+	return nil
+}
+
+func deleteFriendRequest(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
+	var data socketmodels.OutFriendRequestDelete
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	friendRequestId, err := primitive.ObjectIDFromHex(data.ID)
+	if err != nil {
+		return err
+	}
+
+	messagingData := &models.UserMessagingData{}
+	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": uid}).Decode(&messagingData); err != nil {
+		return err
+	}
+
+	friendRequestIndex := -1
+	for i, fr := range messagingData.FriendRequests {
+		if fr.ID == friendRequestId {
+			friendRequestIndex = i
+			break
+		}
+	}
+	if friendRequestIndex == -1 {
+		return fmt.Errorf("Friend request not found")
+	}
+	if messagingData.FriendRequests[friendRequestIndex].Author != uid {
+		return fmt.Errorf("Unauthorized")
+	}
+
+	if err := colls.UserMessagingDataCollection.FindOneAndUpdate(context.Background(), bson.M{"_id": uid}, bson.M{
+		"$pull": bson.M{
+			"friend_requests": bson.M{
+				"_id":    friendRequestIndex,
+				"author": messagingData.FriendRequests[friendRequestIndex].Author,
+			},
+		},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&messagingData); err != nil {
+		return err
+	} else {
+		if anythingReceived, err := checkAnythingReceivedFrom(*messagingData, messagingData.FriendRequests[friendRequestIndex].Author, colls); err != nil {
+			return err
+		} else if !anythingReceived {
+			if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), uid, bson.M{
+				"$pull": bson.M{
+					"messages_received_from": messagingData.FriendRequests[friendRequestIndex].Author,
+				},
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	msg := &socketmodels.OutFriendRequestDelete{
+		ID:        friendRequestId.Hex(),
+		Author:    uid.Hex(),
+		Recipient: data.Recipient,
+	}
+	Uids := make(map[primitive.ObjectID]struct{})
+	Uids[uid] = struct{}{}
+	Uids[messagingData.FriendRequests[friendRequestIndex].Author] = struct{}{}
+	ss.SendDataToUsers <- socketserver.UsersDataMessage{
+		Uids: Uids,
+		Type: "OUT_FRIEND_REQUEST_DELETE",
+		Data: msg,
+	}
+
+	return nil
+}
+
+func friendRequestResponse(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
+	var data socketmodels.FriendRequestResponse
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	friendRequestId, err := primitive.ObjectIDFromHex(data.ID)
+	if err != nil {
+		return err
+	}
+
+	messagingData := &models.UserMessagingData{}
+	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": uid}).Decode(&messagingData); err != nil {
+		return err
+	}
+
+	friendRequestIndex := -1
+	for i, inv := range messagingData.FriendRequests {
+		if inv.ID == friendRequestId {
+			friendRequestIndex = i
+			break
+		}
+	}
+	if friendRequestIndex == -1 {
+		return fmt.Errorf("Friend request not found")
+	}
+
+	frq := messagingData.FriendRequests[friendRequestIndex]
+
+	authorMessagingData := &models.UserMessagingData{}
+	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": messagingData.FriendRequests[friendRequestIndex].Author}).Decode(&authorMessagingData); err != nil {
+		return err
+	}
+
+	var deleteIfErr error = nil
+	for _, oi := range authorMessagingData.Blocked {
+		if oi == uid {
+			deleteIfErr = fmt.Errorf("The sender of this invitation has blocked your account, friend request is no longer valid")
+			break
+		}
+	}
+	if deleteIfErr != nil {
+		if err := colls.UserMessagingDataCollection.FindOneAndUpdate(context.Background(), bson.M{"_id": uid}, bson.M{
+			"$pull": bson.M{
+				"friend_requests": bson.M{
+					"_id":    friendRequestId,
+					"author": messagingData.Invitations[friendRequestIndex].Author,
+				},
+			},
+		}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&messagingData); err != nil {
+			return err
+		}
+		if anythingReceived, err := checkAnythingReceivedFrom(*messagingData, messagingData.FriendRequests[friendRequestIndex].Author, colls); err != nil {
+			return err
+		} else if !anythingReceived {
+			if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), uid, bson.M{
+				"$pull": bson.M{
+					"messages_received_from": messagingData.FriendRequests[friendRequestIndex].Author,
+				},
+			}); err != nil {
+				return err
+			}
+		}
+		msg := &socketmodels.OutFriendRequestResponse{
+			ID:        friendRequestId.Hex(),
+			Author:    uid.Hex(),
+			Recipient: data.Recipient,
+		}
+		Uids := make(map[primitive.ObjectID]struct{})
+		Uids[uid] = struct{}{}
+		Uids[messagingData.FriendRequests[friendRequestIndex].Author] = struct{}{}
+		ss.SendDataToUsers <- socketserver.UsersDataMessage{
+			Uids: Uids,
+			Type: "OUT_FRIEND_REQUEST_DELETE",
+			Data: msg,
+		}
+		return deleteIfErr
+	}
+
+	if data.Accept {
+		if _, err := colls.UserMessagingDataCollection.UpdateOne(context.Background(), bson.M{
+			"_id":                 uid,
+			"friend_requests._id": friendRequestId,
+		}, bson.M{
+			"$set": bson.M{
+				"friend_requests.$.accepted": data.Accept,
+				"friend_requests.$.declined": !data.Accept,
+			},
+			"$addToSet": bson.M{
+				"friends": frq.Author,
+			},
+		}); err != nil {
+			return err
+		}
+
+		if _, err := colls.UserMessagingDataCollection.UpdateOne(context.Background(), bson.M{
+			"_id": frq.Author,
+		}, bson.M{
+			"$addToSet": bson.M{
+				"friends": uid,
+			},
+		}); err != nil {
+			return err
+		}
+	}
+
+	inv := &socketmodels.OutFriendRequestResponse{
+		ID:        friendRequestId.Hex(),
+		Author:    uid.Hex(),
+		Recipient: frq.Author.Hex(),
+		Accept:    data.Accept,
+	}
+	Uids := make(map[primitive.ObjectID]struct{})
+	Uids[uid] = struct{}{}
+	Uids[frq.Author] = struct{}{}
+	ss.SendDataToUsers <- socketserver.UsersDataMessage{
+		Uids: Uids,
+		Type: "OUT_FRIEND_REQUEST_RESPONSE",
+		Data: inv,
+	}
+
+	return nil
+}
+
+func blockUser(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, cs *callserver.CallServer, rcs *roomcallserver.RoomCallServer, colls *db.Collections) error {
+	var data socketmodels.Block
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	blockedUid, err := primitive.ObjectIDFromHex(data.Uid)
+	if err != nil {
+		return err
+	}
+
+	userMessagingData := &models.UserMessagingData{}
+	if err := colls.UserMessagingDataCollection.FindOneAndUpdate(context.Background(), bson.M{"_id": uid}, bson.M{
+		"$addToSet": bson.M{
+			"blocked": blockedUid,
+		},
+		"$pull": bson.M{
+			"friends":                blockedUid,
+			"messages_sent_to":       blockedUid,
+			"messages_received_from": blockedUid,
+		},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.Before)).Decode(&userMessagingData); err != nil {
+		return err
+	}
+
+	if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), blockedUid, bson.M{
+		"$pull": bson.M{
+			"friends":                uid,
+			"messages_sent_to":       uid,
+			"messages_received_from": uid,
+		},
+	}); err != nil {
+		return err
+	}
+
+	if err := deleteDirectMessages(bson.M{
+		"$or": bson.A{
+			bson.M{"author": blockedUid, "recipient": uid},
+			bson.M{"author": uid, "recipient": blockedUid},
+		},
+	}, as, colls); err != nil {
+		return err
+	}
+
+	cs.CloseCallsBetweenChan <- callserver.CallsBetween{
+		UidA:   uid,
+		UidB:   blockedUid,
+		Reason: "BLOCKED",
+	}
+
+	rooms := []models.Room{}
+	if cursor, err := colls.RoomCollection.Find(context.Background(), bson.M{"author": uid}); err != nil {
+		return err
+	} else {
+		if err := cursor.All(context.Background(), &rooms); err != nil {
+			return err
+		}
+		roomIds := []primitive.ObjectID{}
+		channelIds := []primitive.ObjectID{}
+		for _, r := range rooms {
+			roomIds = append(roomIds, r.ID)
+			internalData := &models.RoomInternalData{}
+			if err := colls.RoomInternalDataCollection.FindOne(context.Background(), bson.M{"_id": r.ID}).Decode(&internalData); err != nil {
+				return err
+			}
+			ss.RemoveUserFromSubscription <- socketserver.RemoveUserFromSubscription{
+				Name: "room-display-data=" + r.ID.Hex(),
+				Uid:  blockedUid,
+			}
+			for _, oi := range internalData.Channels {
+				channelIds = append(channelIds, oi)
+				recvChan := make(chan map[primitive.ObjectID]struct{})
+				ss.GetSubscriptionUids <- socketserver.GetSubscriptionUids{
+					RecvChan: recvChan,
+					Name:     "channel:" + oi.Hex(),
+				}
+				uidsInChannel := <-recvChan
+				// Blocking a user also bans them from all the blockers rooms
+				ss.SendDataToUsers <- socketserver.UsersDataMessage{
+					Uids: uidsInChannel,
+					Data: socketmodels.Banned{
+						Banner: uid.Hex(),
+						Banned: data.Uid,
+						RoomID: r.ID.Hex(),
+					},
+					Type: "BANNED",
+				}
+				ss.RemoveUserFromSubscription <- socketserver.RemoveUserFromSubscription{
+					Name: "channel:" + oi.Hex(),
+					Uid:  blockedUid,
+				}
+				ss.RemoveUserFromSubscription <- socketserver.RemoveUserFromSubscription{
+					Name: "room-channel-data=" + oi.Hex(),
+					Uid:  blockedUid,
+				}
+			}
+			if err := deleteRoomMessages(bson.M{
+				"channel_id": bson.M{"$in": internalData.Channels},
+				"author":     blockedUid,
+			}, as, colls); err != nil {
+				return err
+			}
+		}
+		rcs.KickChan <- roomcallserver.InKick{
+			Uid:        blockedUid,
+			ChannelIDs: channelIds,
+		}
+		if _, err := colls.RoomExternalDataCollection.UpdateMany(context.Background(), bson.M{"_id": bson.M{"$in": roomIds}}, bson.M{
+			"$pull": bson.M{
+				"members": blockedUid,
+			},
+			"$addToSet": bson.M{
+				"banned": blockedUid,
+			},
+		}); err != nil {
+			return err
+		}
+		for _, oi := range roomIds {
+			helpers.WriteRoomAuditLog(context.Background(), *colls, oi, uid, "BAN", blockedUid, "Blocked by the room owner")
+		}
+	}
+
+	uids := make(map[primitive.ObjectID]struct{})
+	uids[uid] = struct{}{}
+	uids[blockedUid] = struct{}{}
+
+	ss.SendDataToUsers <- socketserver.UsersDataMessage{
+		Uids: uids,
+		Data: socketmodels.Blocked{
+			Blocker: uid.Hex(),
+		},
+		Type: "BLOCKED",
+	}
+
+	return nil
+}
+
+func unblockUser(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, colls *db.Collections) error {
+	var data socketmodels.Block
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	blockedUid, err := primitive.ObjectIDFromHex(data.Uid)
+	if err != nil {
+		return err
+	}
+
+	if _, err := colls.UserMessagingDataCollection.UpdateByID(context.Background(), uid, bson.M{
+		"$pull": bson.M{
+			"blocked": blockedUid,
+		},
+	}); err != nil {
+		return err
+	}
+
+	uids := make(map[primitive.ObjectID]struct{})
+	uids[uid] = struct{}{}
+	uids[blockedUid] = struct{}{}
+
+	ss.SendDataToUsers <- socketserver.UsersDataMessage{
+		Uids: uids,
+		Data: socketmodels.Blocked{
+			Blocker: uid.Hex(),
+		},
+		Type: "UNBLOCKED",
+	}
+
+	return nil
+}
+
+func banUser(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, cs *callserver.CallServer, rcs *roomcallserver.RoomCallServer, colls *db.Collections) error {
+	var data socketmodels.Ban
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	bannedUid, err := primitive.ObjectIDFromHex(data.Uid)
+	if err != nil {
+		return err
+	}
+	roomId, err := primitive.ObjectIDFromHex(data.RoomID)
+	if err != nil {
+		return err
+	}
+
+	if err := helpers.CheckRoomPermission(context.Background(), *colls, roomId, uid, models.PermissionBan); err != nil {
+		return err
+	}
+	if bannedUid == uid {
+		return fmt.Errorf("You cannot ban yourself")
+	}
+	room := &models.Room{}
+	if err := colls.RoomCollection.FindOne(context.Background(), bson.M{"_id": roomId}).Decode(&room); err != nil {
+		return err
+	}
+	if room.Author == bannedUid {
+		return fmt.Errorf("You cannot ban the owner of the room")
+	}
+	if err := helpers.CheckCanModerateUser(context.Background(), *colls, roomId, uid, bannedUid); err != nil {
+		return err
+	}
+
+	banRecord, err := helpers.NewRoomRestriction(bannedUid, uid, data.Reason, data.Duration)
+	if err != nil {
+		return err
+	}
+
+	// Remove the previous ban record if the user was already banned, the new one replaces it
+	if _, err := colls.RoomExternalDataCollection.UpdateByID(context.Background(), roomId, bson.M{
+		"$pull": bson.M{
+			"ban_records": bson.M{"uid": bannedUid},
+		},
+	}); err != nil {
+		return err
+	}
+	if _, err := colls.RoomExternalDataCollection.UpdateByID(context.Background(), roomId, bson.M{
+		"$addToSet": bson.M{
+			"banned": bannedUid,
+		},
+		"$push": bson.M{
+			"ban_records": banRecord,
+		},
+		"$pull": bson.M{
+			"members":          bannedUid,
+			"role_assignments": bson.M{"uid": bannedUid},
+		},
+	}); err != nil {
+		return err
+	}
+
+	internalData := &models.RoomInternalData{}
+	if err := colls.RoomInternalDataCollection.FindOne(context.Background(), bson.M{"_id": roomId}).Decode(&internalData); err != nil {
+		return err
+	}
+
+	uids := make(map[primitive.ObjectID]struct{})
+	uids[bannedUid] = struct{}{}
+	uids[uid] = struct{}{}
+
+	if err := deleteRoomMessages(bson.M{
+		"channel_id": bson.M{"$in": internalData.Channels},
+		"author":     bannedUid,
+	}, as, colls); err != nil {
+		return err
+	}
+
+	for oi := range removeFromRoomPresence(roomId, internalData.Channels, bannedUid, ss, rcs) {
+		uids[oi] = struct{}{}
+	}
+
+	cs.CloseCallsBetweenChan <- callserver.CallsBetween{
+		UidA:   uid,
+		UidB:   bannedUid,
+		Reason: "BANNED",
+	}
+
+	helpers.WriteRoomAuditLog(context.Background(), *colls, roomId, uid, "BAN", bannedUid, restrictionAuditDetails(banRecord))
+
+	ss.SendDataToUsers <- socketserver.UsersDataMessage{
+		Uids: uids,
+		Data: socketmodels.Banned{
+			Banner:    uid.Hex(),
+			Banned:    data.Uid,
+			RoomID:    data.RoomID,
+			Reason:    banRecord.Reason,
+			ExpiresAt: restrictionExpiresAt(banRecord),
+		},
+		Type: "BANNED",
+	}
+
+	return nil
+}
+
+func unbanUser(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, colls *db.Collections) error {
+	var data socketmodels.Ban
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	bannedUid, err := primitive.ObjectIDFromHex(data.Uid)
+	if err != nil {
+		return err
+	}
+	roomId, err := primitive.ObjectIDFromHex(data.RoomID)
+	if err != nil {
+		return err
+	}
+
+	if err := helpers.CheckRoomPermission(context.Background(), *colls, roomId, uid, models.PermissionBan); err != nil {
+		return err
+	}
+
+	if _, err := colls.RoomExternalDataCollection.UpdateByID(context.Background(), roomId, bson.M{
+		"$pull": bson.M{
+			"banned":      bannedUid,
+			"ban_records": bson.M{"uid": bannedUid},
+		},
+	}); err != nil {
+		return err
+	}
+
+	helpers.WriteRoomAuditLog(context.Background(), *colls, roomId, uid, "UNBAN", bannedUid, "")
+
+	uids, err := helpers.GetRoomChannelSubscriberUids(context.Background(), *colls, ss, roomId)
+	if err != nil {
+		return err
+	}
+	uids[bannedUid] = struct{}{}
+	uids[uid] = struct{}{}
+
+	ss.SendDataToUsers <- socketserver.UsersDataMessage{
+		Uids: uids,
+		Data: socketmodels.Banned{
+			Banner: uid.Hex(),
+			Banned: data.Uid,
+			RoomID: data.RoomID,
+		},
+		Type: "UNBANNED",
+	}
+
+	return nil
+}
+
+func kickUser(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, rcs *roomcallserver.RoomCallServer, colls *db.Collections) error {
+	var data socketmodels.Kick
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	kickedUid, err := primitive.ObjectIDFromHex(data.Uid)
+	if err != nil {
+		return err
+	}
+	roomId, err := primitive.ObjectIDFromHex(data.RoomID)
+	if err != nil {
+		return err
+	}
+
+	return kickFromRoom(roomId, kickedUid, uid, ss, rcs, colls)
+}
+
+func muteUser(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
+	var data socketmodels.Mute
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	mutedUid, err := primitive.ObjectIDFromHex(data.Uid)
+	if err != nil {
+		return err
+	}
+	roomId, err := primitive.ObjectIDFromHex(data.RoomID)
+	if err != nil {
+		return err
+	}
+
+	if err := helpers.CheckRoomPermission(context.Background(), *colls, roomId, uid, models.PermissionMute); err != nil {
+		return err
+	}
+	if mutedUid == uid {
+		return fmt.Errorf("You cannot mute yourself")
+	}
+	room := &models.Room{}
+	if err := colls.RoomCollection.FindOne(context.Background(), bson.M{"_id": roomId}).Decode(&room); err != nil {
+		return err
+	}
+	if room.Author == mutedUid {
+		return fmt.Errorf("You cannot mute the owner of the room")
+	}
+	if err := helpers.CheckCanModerateUser(context.Background(), *colls, roomId, uid, mutedUid); err != nil {
+		return err
+	}
+
+	mute, err := helpers.NewRoomRestriction(mutedUid, uid, data.Reason, data.Duration)
+	if err != nil {
+		return err
+	}
+
+	// Remove the previous mute if the user was already muted, the new one replaces it
+	if _, err := colls.RoomExternalDataCollection.UpdateByID(context.Background(), roomId, bson.M{
+		"$pull": bson.M{
+			"mutes": bson.M{"uid": mutedUid},
+		},
+	}); err != nil {
+		return err
+	}
+	if _, err := colls.RoomExternalDataCollection.UpdateByID(context.Background(), roomId, bson.M{
+		"$push": bson.M{
+			"mutes": mute,
+		},
+	}); err != nil {
+		return err
+	}
+
+	helpers.WriteRoomAuditLog(context.Background(), *colls, roomId, uid, "MUTE", mutedUid, restrictionAuditDetails(mute))
+
+	uids, err := helpers.GetRoomChannelSubscriberUids(context.Background(), *colls, ss, roomId)
+	if err != nil {
+		return err
+	}
+	uids[mutedUid] = struct{}{}
+	uids[uid] = struct{}{}
+
+	ss.SendDataToUsers <- socketserver.UsersDataMessage{
+		Uids: uids,
+		Data: socketmodels.Muted{
+			Muter:     uid.Hex(),
+			Muted:     data.Uid,
+			RoomID:    data.RoomID,
+			Reason:    mute.Reason,
+			ExpiresAt: restrictionExpiresAt(mute),
+		},
+		Type: "MUTED",
+	}
+
+	return nil
+}
+
+func unmuteUser(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, colls *db.Collections) error {
+	var data socketmodels.Mute
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	mutedUid, err := primitive.ObjectIDFromHex(data.Uid)
+	if err != nil {
+		return err
+	}
+	roomId, err := primitive.ObjectIDFromHex(data.RoomID)
+	if err != nil {
+		return err
+	}
+
+	if err := helpers.CheckRoomPermission(context.Background(), *colls, roomId, uid, models.PermissionMute); err != nil {
+		return err
+	}
+
+	if _, err := colls.RoomExternalDataCollection.UpdateByID(context.Background(), roomId, bson.M{
+		"$pull": bson.M{
+			"mutes": bson.M{"uid": mutedUid},
+		},
+	}); err != nil {
+		return err
+	}
+
+	helpers.WriteRoomAuditLog(context.Background(), *colls, roomId, uid, "UNMUTE", mutedUid, "")
+
+	uids, err := helpers.GetRoomChannelSubscriberUids(context.Background(), *colls, ss, roomId)
+	if err != nil {
+		return err
+	}
+	uids[mutedUid] = struct{}{}
+	uids[uid] = struct{}{}
+
+	ss.SendDataToUsers <- socketserver.UsersDataMessage{
+		Uids: uids,
+		Data: socketmodels.Muted{
+			Muter:  uid.Hex(),
+			Muted:  data.Uid,
+			RoomID: data.RoomID,
+		},
+		Type: "UNMUTED",
+	}
+
+	return nil
+}
+
+func callUser(b []byte, conn *websocket.Conn, uid primitive.ObjectID, cs *callserver.CallServer, colls *db.Collections) error {
+	var data socketmodels.CallUser
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	callUid, err := primitive.ObjectIDFromHex(data.Uid)
+	if err != nil {
+		return err
+	}
+
+	calledMessagingData := &models.UserMessagingData{}
+	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": callUid}).Decode(&calledMessagingData); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return fmt.Errorf("User not found")
+		}
+		return fmt.Errorf("Internal server error")
+	}
+
+	for _, oi := range calledMessagingData.Blocked {
+		if oi == uid {
+			return fmt.Errorf("This user blocked your account")
+		}
+	}
+	foundFriend := false
+	for _, oi := range calledMessagingData.Friends {
+		if oi == uid {
+			foundFriend = true
+			break
+		}
+	}
+	if !foundFriend {
+		return fmt.Errorf("You can only call users you are friends with")
+	}
+
+	cs.CallsPendingChan <- callserver.InCall{
+		Caller: uid,
+		Called: callUid,
+	}
+
+	return nil
+}
+
+func callUserResponse(b []byte, conn *websocket.Conn, uid primitive.ObjectID, cs *callserver.CallServer) error {
+	var data socketmodels.CallResponse
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	callerUid, err := primitive.ObjectIDFromHex(data.Caller)
+	if err != nil {
+		return err
+	}
+	calledUid, err := primitive.ObjectIDFromHex(data.Called)
+	if err != nil {
+		return err
+	}
+	if callerUid == uid && data.Accept {
+		return fmt.Errorf("You cannot accept a call to a another user on your own behalf")
+	}
+
+	cs.ResponseToCallChan <- callserver.InCallResponse{
+		Caller: callerUid,
+		Called: calledUid,
+		Accept: data.Accept,
+	}
+
+	return nil
+}
+
+func callLeave(b []byte, conn *websocket.Conn, uid primitive.ObjectID, cs *callserver.CallServer) error {
+	var data socketmodels.CallLeave
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	cs.LeaveCallChan <- uid
+
+	return nil
+}
+
+func callWebRTCOffer(b []byte, conn *websocket.Conn, uid primitive.ObjectID, cs *callserver.CallServer) error {
+	var data socketmodels.CallWebRTCOfferAnswer
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	cs.SendCallRecipientOffer <- callserver.CallerSignal{
+		Signal: data.Signal,
+		Caller: uid,
+
+		UserMediaStreamID: data.UserMediaStreamID,
+		UserMediaVid:      data.UserMediaVid,
+		DisplayMediaVid:   data.DisplayMediaVid,
+	}
+
+	return nil
+}
+
+func callWebRTCAnswer(b []byte, conn *websocket.Conn, uid primitive.ObjectID, cs *callserver.CallServer) error {
+	var data socketmodels.CallWebRTCOfferAnswer
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	cs.SendCalledAnswer <- callserver.CalledSignal{
+		Signal: data.Signal,
+		Called: uid,
+
+		UserMediaStreamID: data.UserMediaStreamID,
+		UserMediaVid:      data.UserMediaVid,
+		DisplayMediaVid:   data.DisplayMediaVid,
+	}
+
+	return nil
+}
+
+func callRecipientRequestReInitialization(b []byte, conn *websocket.Conn, uid primitive.ObjectID, cs *callserver.CallServer) error {
+	var data socketmodels.CallWebRTCRequestReInitialization
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	log.Println(uid, "requested reinitialization")
+
+	cs.CallRecipientRequestedReInitialization <- uid
+
+	return nil
+}
+
+func callMediaState(b []byte, conn *websocket.Conn, uid primitive.ObjectID, cs *callserver.CallServer) error {
+	var data socketmodels.CallMediaState
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	cs.MediaStateChan <- callserver.InMediaState{
+		Uid:        uid,
+		MediaState: data.MediaState,
+	}
+
+	return nil
+}
+
+func roomCallJoin(b []byte, conn *websocket.Conn, uid primitive.ObjectID, rcs *roomcallserver.RoomCallServer, colls *db.Collections) error {
+	var data socketmodels.RoomCallJoin
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	channelId, err := primitive.ObjectIDFromHex(data.Channel)
+	if err != nil {
+		return err
+	}
+
+	if _, _, err := checkRoomChannelAccess(channelId, uid, colls); err != nil {
+		return err
+	}
+
+	rcs.JoinChan <- roomcallserver.InJoin{
+		Uid:       uid,
+		ChannelID: channelId,
+	}
+
+	return nil
+}
+
+func roomCallLeave(b []byte, conn *websocket.Conn, uid primitive.ObjectID, rcs *roomcallserver.RoomCallServer) error {
+	var data socketmodels.RoomCallLeave
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	rcs.LeaveChan <- uid
+
+	return nil
+}
+
+func roomCallWebRTCOffer(b []byte, conn *websocket.Conn, uid primitive.ObjectID, rcs *roomcallserver.RoomCallServer) error {
+	var data socketmodels.RoomCallWebRTCOfferAnswer
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	peerUid, err := primitive.ObjectIDFromHex(data.Uid)
+	if err != nil {
+		return err
+	}
+
+	rcs.SendOfferChan <- roomcallserver.PeerSignal{
+		From:   uid,
+		To:     peerUid,
+		Signal: data.Signal,
+
+		UserMediaStreamID: data.UserMediaStreamID,
+		UserMediaVid:      data.UserMediaVid,
+		DisplayMediaVid:   data.DisplayMediaVid,
+	}
+
+	return nil
+}
+
+func roomCallWebRTCAnswer(b []byte, conn *websocket.Conn, uid primitive.ObjectID, rcs *roomcallserver.RoomCallServer) error {
+	var data socketmodels.RoomCallWebRTCOfferAnswer
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	peerUid, err := primitive.ObjectIDFromHex(data.Uid)
+	if err != nil {
+		return err
+	}
+
+	rcs.SendAnswerChan <- roomcallserver.PeerSignal{
+		From:   uid,
+		To:     peerUid,
+		Signal: data.Signal,
+
+		UserMediaStreamID: data.UserMediaStreamID,
+		UserMediaVid:      data.UserMediaVid,
+		DisplayMediaVid:   data.DisplayMediaVid,
+	}
+
+	return nil
+}
+
+func roomCallRequestReInitialization(b []byte, conn *websocket.Conn, uid primitive.ObjectID, rcs *roomcallserver.RoomCallServer) error {
+	var data socketmodels.RoomCallWebRTCRequestReInitialization
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	peerUid, err := primitive.ObjectIDFromHex(data.Uid)
+	if err != nil {
+		return err
+	}
+
+	rcs.RequestReInitializationChan <- roomcallserver.PeerReInitialization{
+		From: uid,
+		To:   peerUid,
+	}
+
+	return nil
+}
+
+func roomCallMediaState(b []byte, conn *websocket.Conn, uid primitive.ObjectID, rcs *roomcallserver.RoomCallServer) error {
+	var data socketmodels.RoomCallMediaState
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	rcs.MediaStateChan <- roomcallserver.InMediaState{
+		Uid:        uid,
+		MediaState: data.MediaState,
+	}
+
+	return nil
+}
+
+// helper function - finds the channel and gets the users permissions for the channel. Errors if the user is banned, a non-member of a private room, or cannot see the channel
+func checkRoomChannelAccess(channelId primitive.ObjectID, uid primitive.ObjectID, colls *db.Collections) (*models.RoomChannel, models.RoomPermission, error) {
+	channel := &models.RoomChannel{}
+	if err := colls.RoomChannelCollection.FindOne(context.Background(), bson.M{"_id": channelId}).Decode(&channel); err != nil {
+		return nil, 0, err
+	}
+
+	permissions, err := helpers.GetRoomChannelPermissions(context.Background(), *colls, channel, uid)
+	if err != nil {
+		return nil, 0, err
+	}
+	if permissions&models.PermissionViewChannel == 0 {
+		return nil, 0, fmt.Errorf("Channel not found")
+	}
+
+	return channel, permissions, nil
+}
+
+// helper function - removes a user from the room without banning them. Also used by the kick REST endpoint.
+func kickFromRoom(roomId primitive.ObjectID, kickedUid primitive.ObjectID, uid primitive.ObjectID, ss *socketserver.SocketServer, rcs *roomcallserver.RoomCallServer, colls *db.Collections) error {
+	if err := helpers.CheckRoomPermission(context.Background(), *colls, roomId, uid, models.PermissionKick); err != nil {
+		return err
+	}
+	if kickedUid == uid {
+		return fmt.Errorf("You cannot kick yourself")
+	}
+	room := &models.Room{}
+	if err := colls.RoomCollection.FindOne(context.Background(), bson.M{"_id": roomId}).Decode(&room); err != nil {
+		return err
+	}
+	if room.Author == kickedUid {
+		return fmt.Errorf("You cannot kick the owner of the room")
+	}
+	if err := helpers.CheckCanModerateUser(context.Background(), *colls, roomId, uid, kickedUid); err != nil {
+		return err
+	}
+
+	if _, err := colls.RoomExternalDataCollection.UpdateByID(context.Background(), roomId, bson.M{
+		"$pull": bson.M{
+			"members":          kickedUid,
+			"role_assignments": bson.M{"uid": kickedUid},
+		},
+	}); err != nil {
+		return err
+	}
+
+	helpers.WriteRoomAuditLog(context.Background(), *colls, roomId, uid, "KICK", kickedUid, "")
+
+	internalData := &models.RoomInternalData{}
+	if err := colls.RoomInternalDataCollection.FindOne(context.Background(), bson.M{"_id": roomId}).Decode(&internalData); err != nil {
+		return err
+	}
+
+	uids := removeFromRoomPresence(roomId, internalData.Channels, kickedUid, ss, rcs)
+	uids[kickedUid] = struct{}{}
+	uids[uid] = struct{}{}
+
+	ss.SendDataToUsers <- socketserver.UsersDataMessage{
+		Uids: uids,
+		Data: socketmodels.Kicked{
+			Kicker: uid.Hex(),
+			Kicked: kickedUid.Hex(),
+			RoomID: roomId.Hex(),
+		},
+		Type: "KICKED",
+	}
+
+	return nil
+}
+
+// helper function - parses rich text messages, nil for plain text
+func renderContent(content string, richText bool) []richtext.Node {
+	if !richText {
+		return nil
+	}
+	return richtext.Parse(content)
+}
+
+// helper function - queues the message for the link preview server if the content has a link
+func queueLinkPreview(msgId primitive.ObjectID, isRoom bool, content string, lps *linkpreviewserver.LinkPreviewServer) {
+	if linkpreview.FirstURL(content) == "" {
+		return
+	}
+	if !linkpreviewserver.Queue(lps, linkpreviewserver.QueuedMessage{MsgID: msgId, IsRoom: isRoom}) {
+		log.Println("Link preview queue full, skipped message:", msgId.Hex())
+	}
+}
+
+// helper function - parses the mentions in a room message. Mass mentions are dropped if the user isn't allowed to use them.
+func getRoomMentions(content string, permissions models.RoomPermission, colls *db.Collections) (helpers.Mentions, error) {
+	mentions, err := helpers.ParseMentions(context.Background(), *colls, content)
+	if err != nil {
+		return mentions, err
+	}
+	if permissions&(models.PermissionMentionEveryone|models.PermissionOwner) == 0 {
+		mentions.Mass = ""
+	}
+	return mentions, nil
+}
+
+// helper function - sends MENTION to the mentioned users that can see the channel, except users that blocked the author and users in skip
+func sendRoomMentions(channel *models.RoomChannel, msgId primitive.ObjectID, author primitive.ObjectID, content string, mentions helpers.Mentions, skip map[primitive.ObjectID]struct{}, ss *socketserver.SocketServer, colls *db.Collections) error {
+	named := make(map[primitive.ObjectID]struct{})
+	for _, oi := range mentions.Uids {
+		named[oi] = struct{}{}
+	}
+	mass := make(map[primitive.ObjectID]struct{})
+	if mentions.Mass != "" {
+		uids, err := helpers.GetRoomChannelSubscriberUids(context.Background(), *colls, ss, channel.RoomID)
+		if err != nil {
+			return err
+		}
+		mass = uids
+		if mentions.Mass == helpers.MassMentionEveryone {
+			room := &models.Room{}
+			if err := colls.RoomCollection.FindOne(context.Background(), bson.M{"_id": channel.RoomID}).Decode(&room); err != nil {
+				return err
+			}
+			externalData := &models.RoomExternalData{}
+			if err := colls.RoomExternalDataCollection.FindOne(context.Background(), bson.M{"_id": channel.RoomID}).Decode(&externalData); err != nil {
+				return err
+			}
+			mass[room.Author] = struct{}{}
+			for _, oi := range externalData.Members {
+				mass[oi] = struct{}{}
+			}
+		}
+	}
+
+	targets := []primitive.ObjectID{}
+	for oi := range named {
+		targets = append(targets, oi)
+	}
+	for oi := range mass {
+		if _, ok := named[oi]; !ok {
+			targets = append(targets, oi)
+		}
+	}
+	filtered := []primitive.ObjectID{}
+	for _, oi := range targets {
+		if _, ok := skip[oi]; !ok && oi != author {
+			filtered = append(filtered, oi)
+		}
+	}
+	if len(filtered) == 0 {
+		return nil
+	}
+
+	viewers, err := helpers.FilterRoomChannelViewers(context.Background(), *colls, channel, filtered)
+	if err != nil {
+		return err
+	}
+	if len(viewers) == 0 {
+		return nil
+	}
+	cursor, err := colls.UserMessagingDataCollection.Find(context.Background(), bson.M{
+		"_id":     bson.M{"$in": viewers},
+		"blocked": author,
+	}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	blockers := []models.UserMessagingData{}
+	if err := cursor.All(context.Background(), &blockers); err != nil {
+		return err
+	}
+	blockedAuthor := make(map[primitive.ObjectID]struct{})
+	for _, umd := range blockers {
+		blockedAuthor[umd.ID] = struct{}{}
+	}
+
+	namedUids := make(map[primitive.ObjectID]struct{})
+	massUids := make(map[primitive.ObjectID]struct{})
+	for _, oi := range viewers {
+		if _, ok := blockedAuthor[oi]; ok {
+			continue
+		}
+		if _, ok := named[oi]; ok {
+			namedUids[oi] = struct{}{}
+		} else {
+			massUids[oi] = struct{}{}
+		}
+	}
+
+	mention := socketmodels.Mention{
+		ID:      msgId.Hex(),
+		Channel: channel.ID.Hex(),
+		RoomID:  channel.RoomID.Hex(),
+		Author:  author.Hex(),
+		Content: content,
+	}
+	if len(namedUids) > 0 {
+		ss.SendDataToUsers <- socketserver.UsersDataMessage{
+			Uids: namedUids,
+			Type: "MENTION",
+			Data: mention,
+		}
+	}
+	if len(massUids) > 0 {
+		mention.MassMention = mentions.Mass
+		ss.SendDataToUsers <- socketserver.UsersDataMessage{
+			Uids: massUids,
+			Type: "MENTION",
+			Data: mention,
+		}
+	}
+
+	return nil
+}
+
+// helper function - formats the expiry for socket messages, empty if the restriction is permanent
+func restrictionExpiresAt(restriction models.RoomRestriction) string {
+	if restriction.ExpiresAt == nil {
+		return ""
 	}
+	return restriction.ExpiresAt.Time().Format(time.RFC3339)
+}
 
-	internalData := &models.RoomInternalData{}
-	if err := colls.RoomInternalDataCollection.FindOne(context.Background(), bson.M{"_id": roomId}).Decode(&internalData); err != nil {
-		return err
+// helper function - the reason and expiry, for the audit log
+func restrictionAuditDetails(restriction models.RoomRestriction) string {
+	details := restriction.Reason
+	if expiresAt := restrictionExpiresAt(restriction); expiresAt != "" {
+		details += " (expires " + expiresAt + ")"
 	}
+	return strings.TrimSpace(details)
+}
 
+// helper function - removes a user from the room subscriptions and room call. Returns the uids of the users that were in the channels.
+func removeFromRoomPresence(roomId primitive.ObjectID, channelIds []primitive.ObjectID, removeUid primitive.ObjectID, ss *socketserver.SocketServer, rcs *roomcallserver.RoomCallServer) map[primitive.ObjectID]struct{} {
 	uids := make(map[primitive.ObjectID]struct{})
-	uids[bannedUid] = struct{}{}
-	uids[uid] = struct{}{}
-
-	for _, oi := range internalData.Channels {
-		channelMessages := &models.RoomChannelMessages{}
-		if err := colls.RoomChannelMessagesCollection.FindOneAndUpdate(context.Background(), bson.M{"_id": oi}, bson.M{
-			"$pull": bson.M{
-				"messages": bson.M{
-					"author": bannedUid,
-				},
-			},
-		}, options.FindOneAndUpdate().SetReturnDocument(options.Before)).Decode(&channelMessages); err != nil {
-			return err
-		}
-		for _, rcm := range channelMessages.Messages {
-			if rcm.Author == bannedUid && rcm.HasAttachment {
-				as.DeleteChan <- attachmentserver.Delete{
-					MsgId: rcm.ID,
-					Uid:   bannedUid,
-				}
-			}
-		}
+	for _, oi := range channelIds {
 		recvChan := make(chan map[primitive.ObjectID]struct{})
 		ss.GetSubscriptionUids <- socketserver.GetSubscriptionUids{
 			RecvChan: recvChan,
@@ -1601,229 +3573,383 @@ func banUser(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *sockets
 		}
 		ss.RemoveUserFromSubscription <- socketserver.RemoveUserFromSubscription{
 			Name: "channel:" + oi.Hex(),
-			Uid:  bannedUid,
+			Uid:  removeUid,
+		}
+		ss.RemoveUserFromSubscription <- socketserver.RemoveUserFromSubscription{
+			Name: "room-channel-data=" + oi.Hex(),
+			Uid:  removeUid,
 		}
 	}
-
-	ss.SendDataToUsers <- socketserver.UsersDataMessage{
-		Uids: uids,
-		Data: socketmodels.Banned{
-			Banner: uid.Hex(),
-			Banned: data.Uid,
-			RoomID: data.RoomID,
-		},
-		Type: "BANNED",
+	ss.RemoveUserFromSubscription <- socketserver.RemoveUserFromSubscription{
+		Name: "room-display-data=" + roomId.Hex(),
+		Uid:  removeUid,
 	}
-
-	return nil
+	rcs.KickChan <- roomcallserver.InKick{
+		Uid:        removeUid,
+		ChannelIDs: channelIds,
+	}
+	return uids
 }
 
-func unbanUser(b []byte, conn *websocket.Conn, uid primitive.ObjectID, ss *socketserver.SocketServer, as *attachmentserver.AttachmentServer, colls *db.Collections) error {
-	var data socketmodels.Ban
-	if err := json.Unmarshal(b, &data); err != nil {
-		return err
+// helper function - removes the subscribers of a channel that can no longer see it, and kicks them from the channels call
+func removeRoomChannelNonViewers(channel *models.RoomChannel, ss *socketserver.SocketServer, rcs *roomcallserver.RoomCallServer, colls *db.Collections) error {
+	subscriptionNames := []string{"channel:" + channel.ID.Hex(), "room-channel-data=" + channel.ID.Hex()}
+	subscribers := make(map[primitive.ObjectID]struct{})
+	for _, name := range subscriptionNames {
+		recvChan := make(chan map[primitive.ObjectID]struct{})
+		ss.GetSubscriptionUids <- socketserver.GetSubscriptionUids{
+			RecvChan: recvChan,
+			Name:     name,
+		}
+		for oi := range <-recvChan {
+			subscribers[oi] = struct{}{}
+		}
 	}
-
-	bannedUid, err := primitive.ObjectIDFromHex(data.Uid)
-	if err != nil {
-		return err
+	if len(subscribers) == 0 {
+		return nil
 	}
-	roomId, err := primitive.ObjectIDFromHex(data.RoomID)
+	uids := []primitive.ObjectID{}
+	for oi := range subscribers {
+		uids = append(uids, oi)
+	}
+	viewers, err := helpers.FilterRoomChannelViewers(context.Background(), *colls, channel, uids)
 	if err != nil {
 		return err
 	}
-
-	if _, err := colls.RoomExternalDataCollection.UpdateByID(context.Background(), roomId, bson.M{
-		"$pull": bson.M{
-			"banned": bannedUid,
-		},
-	}); err != nil {
-		return err
+	for _, oi := range viewers {
+		delete(subscribers, oi)
 	}
-
-	internalData := &models.RoomInternalData{}
-	if err := colls.RoomInternalDataCollection.FindOne(context.Background(), bson.M{"_id": roomId}).Decode(&internalData); err != nil {
-		return err
+	for oi := range subscribers {
+		for _, name := range subscriptionNames {
+			ss.RemoveUserFromSubscription <- socketserver.RemoveUserFromSubscription{
+				Name: name,
+				Uid:  oi,
+			}
+		}
+		rcs.KickChan <- roomcallserver.InKick{
+			Uid:        oi,
+			ChannelIDs: []primitive.ObjectID{channel.ID},
+		}
 	}
+	return nil
+}
 
-	uids := make(map[primitive.ObjectID]struct{})
-	uids[bannedUid] = struct{}{}
-	uids[uid] = struct{}{}
-
-	for _, oi := range internalData.Channels {
-		channelMessages := &models.RoomChannelMessages{}
-		if err := colls.RoomChannelMessagesCollection.FindOne(context.Background(), bson.M{"_id": oi}).Decode(&channelMessages); err != nil {
-			return err
-		}
-		recvChan := make(chan map[primitive.ObjectID]struct{})
-		ss.GetSubscriptionUids <- socketserver.GetSubscriptionUids{
-			RecvChan: recvChan,
-			Name:     "channel:" + oi.Hex(),
+// helper function - used to check if messages_sent_to/messages_received_from should have a uid pulled
+func checkAnythingReceivedFrom(messagingData models.UserMessagingData, sender primitive.ObjectID, colls *db.Collections) (bool, error) {
+	for _, inv := range messagingData.Invitations {
+		if inv.Author == sender {
+			return true, nil
 		}
-		uidsInChannel := <-recvChan
-		for oi2 := range uidsInChannel {
-			uids[oi2] = struct{}{}
+	}
+	for _, fr := range messagingData.FriendRequests {
+		if fr.Author == sender {
+			return true, nil
 		}
 	}
-
-	ss.SendDataToUsers <- socketserver.UsersDataMessage{
-		Uids: uids,
-		Data: socketmodels.Banned{
-			Banner: uid.Hex(),
-			Banned: data.Uid,
-		},
-		Type: "UNBANNED",
+	count, err := colls.DirectMessageCollection.CountDocuments(context.Background(), bson.M{
+		"author":    sender,
+		"recipient": messagingData.ID,
+	}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
 	}
-
-	return nil
+	return count > 0, nil
 }
 
-func callUser(b []byte, conn *websocket.Conn, uid primitive.ObjectID, cs *callserver.CallServer, colls *db.Collections) error {
-	var data socketmodels.CallUser
-	if err := json.Unmarshal(b, &data); err != nil {
-		return err
+// helper function - finds the message being replied to in the channel. Returns nil if replyToHex is empty.
+// Replies to replies are put in the thread of the first message.
+func getRoomThreadRoot(channelId primitive.ObjectID, replyToHex string, colls *db.Collections) (*primitive.ObjectID, error) {
+	if replyToHex == "" {
+		return nil, nil
 	}
-
-	callUid, err := primitive.ObjectIDFromHex(data.Uid)
+	parentId, err := primitive.ObjectIDFromHex(replyToHex)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	calledMessagingData := &models.UserMessagingData{}
-	if err := colls.UserMessagingDataCollection.FindOne(context.Background(), bson.M{"_id": callUid}).Decode(&calledMessagingData); err != nil {
+	parent := &models.RoomChannelMessage{}
+	if err := colls.RoomMessageCollection.FindOne(context.Background(), bson.M{"_id": parentId, "channel_id": channelId}).Decode(&parent); err != nil {
 		if err == mongo.ErrNoDocuments {
-			return fmt.Errorf("User not found")
+			return nil, fmt.Errorf("The message you are replying to could not be found")
 		}
-		return fmt.Errorf("Internal server error")
+		return nil, err
 	}
+	if parent.ReplyTo != nil {
+		return parent.ReplyTo, nil
+	}
+	return &parent.ID, nil
+}
 
-	for _, oi := range calledMessagingData.Blocked {
-		if oi == uid {
-			return fmt.Errorf("This user blocked your account")
-		}
+// helper function - finds the message being replied to in the conversation. Returns nil if replyToHex is empty.
+// Replies to replies are put in the thread of the first message.
+func getDirectThreadRoot(uid primitive.ObjectID, recipientId primitive.ObjectID, replyToHex string, colls *db.Collections) (*primitive.ObjectID, error) {
+	if replyToHex == "" {
+		return nil, nil
 	}
-	foundFriend := false
-	for _, oi := range calledMessagingData.Friends {
-		if oi == uid {
-			foundFriend = true
-			break
+	parentId, err := primitive.ObjectIDFromHex(replyToHex)
+	if err != nil {
+		return nil, err
+	}
+	parent := &models.DirectMessage{}
+	if err := colls.DirectMessageCollection.FindOne(context.Background(), bson.M{
+		"_id": parentId,
+		"$or": bson.A{
+			bson.M{"author": uid, "recipient": recipientId},
+			bson.M{"author": recipientId, "recipient": uid},
+		},
+	}).Decode(&parent); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("The message you are replying to could not be found")
 		}
+		return nil, err
 	}
-	if !foundFriend {
-		return fmt.Errorf("You can only call users you are friends with")
+	if parent.ReplyTo != nil {
+		return parent.ReplyTo, nil
 	}
+	return &parent.ID, nil
+}
 
-	cs.CallsPendingChan <- callserver.InCall{
-		Caller: uid,
-		Called: callUid,
+// helper function - finds the message a reminder is for, checking that the user can still see it
+func getReminderMessage(reminder models.ScheduledMessage, colls *db.Collections) (*socketmodels.Reminder, error) {
+	if reminder.MsgID == nil {
+		return nil, fmt.Errorf("Message not found")
 	}
 
-	return nil
+	if reminder.IsRoom {
+		channel, _, err := checkRoomChannelAccess(reminder.Target, reminder.Uid, colls)
+		if err != nil {
+			return nil, err
+		}
+		msg := &models.RoomChannelMessage{}
+		if err := colls.RoomMessageCollection.FindOne(context.Background(), bson.M{"_id": *reminder.MsgID, "channel_id": channel.ID}).Decode(&msg); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return nil, fmt.Errorf("Message not found")
+			}
+			return nil, err
+		}
+		return &socketmodels.Reminder{
+			MsgID:   msg.ID.Hex(),
+			Channel: channel.ID.Hex(),
+			RoomID:  channel.RoomID.Hex(),
+			Author:  msg.Author.Hex(),
+			Content: msg.Content,
+		}, nil
+	}
+
+	msg := &models.DirectMessage{}
+	if err := colls.DirectMessageCollection.FindOne(context.Background(), bson.M{
+		"_id": *reminder.MsgID,
+		"$or": bson.A{
+			bson.M{"author": reminder.Uid, "recipient": reminder.Target},
+			bson.M{"author": reminder.Target, "recipient": reminder.Uid},
+		},
+	}).Decode(&msg); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("Message not found")
+		}
+		return nil, err
+	}
+	return &socketmodels.Reminder{
+		MsgID:   msg.ID.Hex(),
+		Uid:     reminder.Target.Hex(),
+		Author:  msg.Author.Hex(),
+		Content: msg.Content,
+	}, nil
 }
 
-func callUserResponse(b []byte, conn *websocket.Conn, uid primitive.ObjectID, cs *callserver.CallServer) error {
-	var data socketmodels.CallResponse
-	if err := json.Unmarshal(b, &data); err != nil {
-		return err
-	}
-
-	callerUid, err := primitive.ObjectIDFromHex(data.Caller)
-	if err != nil {
+// helper function - changes the reply count of the first message in a thread and sends the new count to the channel
+func updateRoomReplyCount(channelId primitive.ObjectID, parentId primitive.ObjectID, inc int, ss *socketserver.SocketServer, colls *db.Collections) error {
+	parent := &models.RoomChannelMessage{}
+	if err := colls.RoomMessageCollection.FindOneAndUpdate(context.Background(), bson.M{"_id": parentId}, bson.M{
+		"$inc": bson.M{"reply_count": inc},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&parent); err != nil {
+		// the first message may have been deleted already
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
 		return err
 	}
-	calledUid, err := primitive.ObjectIDFromHex(data.Called)
+	outBytes, err := json.Marshal(socketmodels.OutRoomMessageReplyCount{
+		Type:       "OUT_ROOM_MESSAGE_REPLY_COUNT",
+		ID:         parentId.Hex(),
+		ReplyCount: parent.ReplyCount,
+	})
 	if err != nil {
 		return err
 	}
-	if callerUid == uid && data.Accept {
-		return fmt.Errorf("You cannot accept a call to a another user on your own behalf")
-	}
-
-	cs.ResponseToCallChan <- callserver.InCallResponse{
-		Caller: callerUid,
-		Called: calledUid,
-		Accept: data.Accept,
+	ss.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
+		Name: "channel:" + channelId.Hex(),
+		Data: outBytes,
 	}
-
 	return nil
 }
 
-func callLeave(b []byte, conn *websocket.Conn, uid primitive.ObjectID, cs *callserver.CallServer) error {
-	var data socketmodels.CallLeave
-	if err := json.Unmarshal(b, &data); err != nil {
+// helper function - changes the reply count of the first message in a thread and sends the new count to both users
+func updateDirectReplyCount(parentId primitive.ObjectID, uid primitive.ObjectID, recipientId primitive.ObjectID, inc int, ss *socketserver.SocketServer, colls *db.Collections) error {
+	parent := &models.DirectMessage{}
+	if err := colls.DirectMessageCollection.FindOneAndUpdate(context.Background(), bson.M{"_id": parentId}, bson.M{
+		"$inc": bson.M{"reply_count": inc},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&parent); err != nil {
+		// the first message may have been deleted already
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
 		return err
 	}
-
-	cs.LeaveCallChan <- uid
-
+	Uids := make(map[primitive.ObjectID]struct{})
+	Uids[uid] = struct{}{}
+	Uids[recipientId] = struct{}{}
+	ss.SendDataToUsers <- socketserver.UsersDataMessage{
+		Uids: Uids,
+		Type: "OUT_DIRECT_MESSAGE_REPLY_COUNT",
+		Data: socketmodels.OutDirectMessageReplyCount{
+			ID:         parentId.Hex(),
+			ReplyCount: parent.ReplyCount,
+		},
+	}
 	return nil
 }
 
-func callWebRTCOffer(b []byte, conn *websocket.Conn, uid primitive.ObjectID, cs *callserver.CallServer) error {
-	var data socketmodels.CallWebRTCOfferAnswer
-	if err := json.Unmarshal(b, &data); err != nil {
+// helper function - messages from private rooms and hidden channels can only be forwarded to people that can already see them.
+// Either toChannel or toUid should be set.
+func checkForwardAudience(source *models.RoomChannel, toChannel *models.RoomChannel, toUid *primitive.ObjectID, colls *db.Collections) error {
+	public, err := helpers.IsRoomChannelPublic(context.Background(), *colls, source)
+	if err != nil {
 		return err
 	}
+	if public {
+		return nil
+	}
 
-	cs.SendCallRecipientOffer <- callserver.CallerSignal{
-		Signal: data.Signal,
-		Caller: uid,
-
-		UserMediaStreamID: data.UserMediaStreamID,
-		UserMediaVid:      data.UserMediaVid,
-		DisplayMediaVid:   data.DisplayMediaVid,
+	audience := []primitive.ObjectID{}
+	if toChannel != nil {
+		targetPublic, err := helpers.IsRoomChannelPublic(context.Background(), *colls, toChannel)
+		if err != nil {
+			return err
+		}
+		if targetPublic {
+			return fmt.Errorf("Messages from private rooms and hidden channels cannot be forwarded to public channels")
+		}
+		if audience, err = helpers.GetRoomChannelAudience(context.Background(), *colls, toChannel); err != nil {
+			return err
+		}
+	} else {
+		audience = append(audience, *toUid)
 	}
 
+	viewers, err := helpers.FilterRoomChannelViewers(context.Background(), *colls, source, audience)
+	if err != nil {
+		return err
+	}
+	if len(viewers) != len(audience) {
+		return fmt.Errorf("This message cannot be forwarded to people that cannot see the channel it is from")
+	}
 	return nil
 }
 
-func callWebRTCAnswer(b []byte, conn *websocket.Conn, uid primitive.ObjectID, cs *callserver.CallServer) error {
-	var data socketmodels.CallWebRTCOfferAnswer
-	if err := json.Unmarshal(b, &data); err != nil {
-		return err
+// helper function - converts the forward origin for socket messages
+func outForwardOrigin(origin models.ForwardOrigin) *socketmodels.ForwardOrigin {
+	out := &socketmodels.ForwardOrigin{
+		ID:        origin.MsgID.Hex(),
+		Author:    origin.Author.Hex(),
+		CreatedAt: origin.CreatedAt.Time().Format(time.RFC3339),
 	}
-
-	cs.SendCalledAnswer <- callserver.CalledSignal{
-		Signal: data.Signal,
-		Called: uid,
-
-		UserMediaStreamID: data.UserMediaStreamID,
-		UserMediaVid:      data.UserMediaVid,
-		DisplayMediaVid:   data.DisplayMediaVid,
+	if origin.ChannelID != nil {
+		out.Channel = origin.ChannelID.Hex()
 	}
-
-	return nil
+	if origin.RoomID != nil {
+		out.RoomID = origin.RoomID.Hex()
+	}
+	return out
 }
 
-func callRecipientRequestReInitialization(b []byte, conn *websocket.Conn, uid primitive.ObjectID, cs *callserver.CallServer) error {
-	var data socketmodels.CallWebRTCRequestReInitialization
-	if err := json.Unmarshal(b, &data); err != nil {
+// helper function - sends the polls tallies to the channel
+func sendPollUpdate(msg *models.RoomChannelMessage, ss *socketserver.SocketServer) error {
+	outBytes, err := json.Marshal(socketmodels.OutPollUpdate{
+		Type: "OUT_POLL_UPDATE",
+		ID:   msg.ID.Hex(),
+		Poll: helpers.OutPoll(msg.Poll),
+	})
+	if err != nil {
 		return err
 	}
+	ss.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
+		Name: "channel:" + msg.ChannelID.Hex(),
+		Data: outBytes,
+	}
+	return nil
+}
 
-	log.Println(uid, "requested reinitialization")
+// helper function - converts reactions for socket messages
+func outReactions(reactions []models.MessageReaction) []socketmodels.Reaction {
+	out := []socketmodels.Reaction{}
+	for _, reaction := range reactions {
+		uids := []string{}
+		for _, oi := range reaction.Uids {
+			uids = append(uids, oi.Hex())
+		}
+		out = append(out, socketmodels.Reaction{Emoji: reaction.Emoji, Uids: uids})
+	}
+	return out
+}
 
-	cs.CallRecipientRequestedReInitialization <- uid
+// helper function - empty string for messages that aren't replies
+func replyToHex(replyTo *primitive.ObjectID) string {
+	if replyTo == nil {
+		return ""
+	}
+	return replyTo.Hex()
+}
 
+// helper function - deletes the room messages matching the filter, and their attachments
+func deleteRoomMessages(filter bson.M, as *attachmentserver.AttachmentServer, colls *db.Collections) error {
+	attachmentFilter := bson.M{"has_attachment": true}
+	for k, v := range filter {
+		attachmentFilter[k] = v
+	}
+	cursor, err := colls.RoomMessageCollection.Find(context.Background(), attachmentFilter)
+	if err != nil {
+		return err
+	}
+	withAttachments := []models.RoomChannelMessage{}
+	if err := cursor.All(context.Background(), &withAttachments); err != nil {
+		return err
+	}
+	if _, err := colls.RoomMessageCollection.DeleteMany(context.Background(), filter); err != nil {
+		return err
+	}
+	for _, rcm := range withAttachments {
+		as.DeleteChan <- attachmentserver.Delete{
+			MsgId:      rcm.ID,
+			Uid:        rcm.Author,
+			SharedFrom: rcm.AttachmentID,
+		}
+	}
 	return nil
 }
 
-// helper function - used to check if messages_sent_to/messages_received_from should have a uid pulled
-func checkAnythingReceivedFrom(messagingData models.UserMessagingData, sender primitive.ObjectID) bool {
-	for _, inv := range messagingData.Invitations {
-		if inv.Author == sender {
-			return true
-		}
+// helper function - deletes the direct messages matching the filter, and their attachments
+func deleteDirectMessages(filter bson.M, as *attachmentserver.AttachmentServer, colls *db.Collections) error {
+	attachmentFilter := bson.M{"has_attachment": true}
+	for k, v := range filter {
+		attachmentFilter[k] = v
 	}
-	for _, msg := range messagingData.Messages {
-		if msg.Author == sender {
-			return true
-		}
+	cursor, err := colls.DirectMessageCollection.Find(context.Background(), attachmentFilter)
+	if err != nil {
+		return err
 	}
-	for _, fr := range messagingData.FriendRequests {
-		if fr.Author == sender {
-			return true
+	withAttachments := []models.DirectMessage{}
+	if err := cursor.All(context.Background(), &withAttachments); err != nil {
+		return err
+	}
+	if _, err := colls.DirectMessageCollection.DeleteMany(context.Background(), filter); err != nil {
+		return err
+	}
+	for _, dm := range withAttachments {
+		as.DeleteChan <- attachmentserver.Delete{
+			MsgId:      dm.ID,
+			Uid:        dm.Author,
+			SharedFrom: dm.AttachmentID,
 		}
 	}
-	return false
+	return nil
 }
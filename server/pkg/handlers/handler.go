@@ -10,7 +10,11 @@ import (
 	"github.com/web-stuff-98/electron-social-chat/pkg/attachmentserver"
 	"github.com/web-stuff-98/electron-social-chat/pkg/callserver"
 	"github.com/web-stuff-98/electron-social-chat/pkg/db"
+	"github.com/web-stuff-98/electron-social-chat/pkg/helpers"
+	"github.com/web-stuff-98/electron-social-chat/pkg/linkpreviewserver"
+	"github.com/web-stuff-98/electron-social-chat/pkg/roomcallserver"
 	"github.com/web-stuff-98/electron-social-chat/pkg/socketserver"
+	"github.com/web-stuff-98/electron-social-chat/pkg/typingserver"
 
 	"go.mongodb.org/mongo-driver/mongo"
 )
@@ -22,15 +26,36 @@ func responseMessage(w http.ResponseWriter, c int, m string) {
 	return
 }
 
+// For errors returned from helpers.CheckRoomPermission and helpers.GetRoomPermissions
+func roomPermissionErrorResponse(w http.ResponseWriter, err error) {
+	switch err {
+	case mongo.ErrNoDocuments:
+		responseMessage(w, http.StatusNotFound, "Room not found")
+	case helpers.ErrRoomBanned:
+		responseMessage(w, http.StatusUnauthorized, "You are banned from this room")
+	case helpers.ErrRoomNotMember:
+		responseMessage(w, http.StatusForbidden, "You are not a member of this room")
+	case helpers.ErrRoomMissingPermission:
+		responseMessage(w, http.StatusUnauthorized, "Unauthorized")
+	case helpers.ErrRoomTargetModerator:
+		responseMessage(w, http.StatusForbidden, err.Error())
+	default:
+		responseMessage(w, http.StatusInternalServerError, "Internal error")
+	}
+}
+
 type handler struct {
-	DB               *mongo.Database
-	Collections      *db.Collections
-	RedisClient      *redis.Client
-	SocketServer     *socketserver.SocketServer
-	AttachmentServer *attachmentserver.AttachmentServer
-	CallServer       *callserver.CallServer
+	DB                *mongo.Database
+	Collections       *db.Collections
+	RedisClient       *redis.Client
+	SocketServer      *socketserver.SocketServer
+	AttachmentServer  *attachmentserver.AttachmentServer
+	CallServer        *callserver.CallServer
+	RoomCallServer    *roomcallserver.RoomCallServer
+	TypingServer      *typingserver.TypingServer
+	LinkPreviewServer *linkpreviewserver.LinkPreviewServer
 }
 
-func New(db *mongo.Database, collections *db.Collections, redisClient *redis.Client, socketServer *socketserver.SocketServer, attachmentServer *attachmentserver.AttachmentServer, callServer *callserver.CallServer) handler {
-	return handler{db, collections, redisClient, socketServer, attachmentServer, callServer}
+func New(db *mongo.Database, collections *db.Collections, redisClient *redis.Client, socketServer *socketserver.SocketServer, attachmentServer *attachmentserver.AttachmentServer, callServer *callserver.CallServer, roomCallServer *roomcallserver.RoomCallServer, typingServer *typingserver.TypingServer, linkPreviewServer *linkpreviewserver.LinkPreviewServer) handler {
+	return handler{db, collections, redisClient, socketServer, attachmentServer, callServer, roomCallServer, typingServer, linkPreviewServer}
 }
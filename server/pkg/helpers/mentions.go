@@ -0,0 +1,83 @@
+package helpers
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/web-stuff-98/electron-social-chat/pkg/db"
+	"github.com/web-stuff-98/electron-social-chat/pkg/db/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	Mentions are written as @username, or @here/@everyone for mass mentions.
+	@here is everyone currently in one of the rooms channels, @everyone is
+	every member of the room. A mention has to be at the start of the message
+	or after whitespace, so email addresses aren't picked up.
+*/
+
+const (
+	MaxMentionsPerMessage = 20
+
+	MassMentionHere     = "here"
+	MassMentionEveryone = "everyone"
+)
+
+var mentionRegex = regexp.MustCompile(`(?:^|\s)@([^\s@]+)`)
+
+type Mentions struct {
+	// Users mentioned by name. Names that don't belong to a user are ignored.
+	Uids []primitive.ObjectID
+	// MassMentionHere, MassMentionEveryone or empty
+	Mass string
+}
+
+func ParseMentions(ctx context.Context, collections db.Collections, content string) (Mentions, error) {
+	mentions := Mentions{Uids: []primitive.ObjectID{}}
+	names := []string{}
+	namesUnique := make(map[string]struct{})
+	for _, match := range mentionRegex.FindAllStringSubmatch(content, -1) {
+		name := strings.ToLower(strings.TrimRight(match[1], ".,!?:;)'\""))
+		switch name {
+		case "":
+			continue
+		case MassMentionEveryone:
+			mentions.Mass = MassMentionEveryone
+			continue
+		case MassMentionHere:
+			if mentions.Mass == "" {
+				mentions.Mass = MassMentionHere
+			}
+			continue
+		}
+		if _, ok := namesUnique[name]; ok || len(names) == MaxMentionsPerMessage {
+			continue
+		}
+		namesUnique[name] = struct{}{}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return mentions, nil
+	}
+
+	// Usernames are unique regardless of case
+	patterns := bson.A{}
+	for _, name := range names {
+		patterns = append(patterns, primitive.Regex{Pattern: "^" + regexp.QuoteMeta(name) + "$", Options: "i"})
+	}
+	cursor, err := collections.UserCollection.Find(ctx, bson.M{"username": bson.M{"$in": patterns}}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return mentions, err
+	}
+	users := []models.User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return mentions, err
+	}
+	for _, u := range users {
+		mentions.Uids = append(mentions.Uids, u.ID)
+	}
+	return mentions, nil
+}
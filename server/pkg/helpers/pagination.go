@@ -0,0 +1,50 @@
+package helpers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+	Message history is paged from newest to oldest using the ID of the oldest
+	message the client already has as the cursor. ObjectIDs are created in
+	order, so "before" is the same as "older than". Each page is returned
+	oldest first.
+*/
+
+const (
+	DefaultMessagePageSize = 50
+	MaxMessagePageSize     = 100
+)
+
+type MessagePage struct {
+	// primitive.NilObjectID for the newest page
+	Before primitive.ObjectID
+	Limit  int
+}
+
+// Reads the "before" and "limit" query params
+func GetMessagePageFromRequest(r *http.Request) (MessagePage, error) {
+	page := MessagePage{Limit: DefaultMessagePageSize}
+	if before := r.URL.Query().Get("before"); before != "" {
+		oid, err := primitive.ObjectIDFromHex(before)
+		if err != nil {
+			return page, fmt.Errorf("Invalid cursor")
+		}
+		page.Before = oid
+	}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 1 {
+			return page, fmt.Errorf("Invalid limit")
+		}
+		if l > MaxMessagePageSize {
+			l = MaxMessagePageSize
+		}
+		page.Limit = l
+	}
+	return page, nil
+}
@@ -0,0 +1,69 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	Pinned messages are marked with pinned_at/pinned_by on the message itself. The
+	scope filter matches every message in the channel or conversation, so the same
+	functions are used for room messages and direct messages.
+*/
+
+const MaxPinnedMessages = 50
+
+func PinMessage(ctx context.Context, collection *mongo.Collection, scope bson.M, msgId primitive.ObjectID, uid primitive.ObjectID) error {
+	count, err := collection.CountDocuments(ctx, withFilter(scope, bson.M{"pinned_at": bson.M{"$exists": true}}))
+	if err != nil {
+		return err
+	}
+	if count >= MaxPinnedMessages {
+		return fmt.Errorf("You cannot pin more than %d messages", MaxPinnedMessages)
+	}
+	res, err := collection.UpdateOne(ctx, withFilter(scope, bson.M{"_id": msgId, "pinned_at": bson.M{"$exists": false}}), bson.M{
+		"$set": bson.M{
+			"pinned_at": primitive.NewDateTimeFromTime(time.Now()),
+			"pinned_by": uid,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("Message not found, or it is already pinned")
+	}
+	return nil
+}
+
+func UnpinMessage(ctx context.Context, collection *mongo.Collection, scope bson.M, msgId primitive.ObjectID) error {
+	res, err := collection.UpdateOne(ctx, withFilter(scope, bson.M{"_id": msgId, "pinned_at": bson.M{"$exists": true}}), bson.M{
+		"$unset": bson.M{"pinned_at": "", "pinned_by": ""},
+	})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("Message not found, or it isn't pinned")
+	}
+	return nil
+}
+
+// Decodes the pinned messages into results, most recently pinned first
+func GetPinnedMessages(ctx context.Context, collection *mongo.Collection, scope bson.M, results interface{}) error {
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "pinned_at", Value: -1}})
+	findOptions.SetLimit(MaxPinnedMessages)
+	findOptions.SetProjection(bson.M{"revisions": 0})
+	cursor, err := collection.Find(ctx, withFilter(scope, bson.M{"pinned_at": bson.M{"$exists": true}}), findOptions)
+	if err != nil {
+		return err
+	}
+	return cursor.All(ctx, results)
+}
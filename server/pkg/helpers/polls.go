@@ -0,0 +1,172 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/web-stuff-98/electron-social-chat/pkg/db/models"
+	"github.com/web-stuff-98/electron-social-chat/pkg/socketmodels"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	Polls are room messages with the votes stored on each option, the same
+	as reactions. Votes replace all of the users previous votes in a single
+	update, so a user can never end up with two votes on a single choice poll.
+*/
+
+const (
+	MinPollOptions      = 2
+	MaxPollOptions      = 10
+	MaxPollOptionLength = 100
+)
+
+// Validates the options and the optional RFC3339 close time
+func NewPoll(pollOptions []string, multipleChoice bool, closesAt string) (*models.Poll, error) {
+	if len(pollOptions) < MinPollOptions || len(pollOptions) > MaxPollOptions {
+		return nil, fmt.Errorf("Polls must have between %d and %d options", MinPollOptions, MaxPollOptions)
+	}
+	poll := &models.Poll{
+		Options:        []models.PollOption{},
+		MultipleChoice: multipleChoice,
+	}
+	seen := make(map[string]struct{})
+	for _, text := range pollOptions {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			return nil, fmt.Errorf("Poll options cannot be empty")
+		}
+		if utf8.RuneCountInString(text) > MaxPollOptionLength {
+			return nil, fmt.Errorf("Poll options max %d characters", MaxPollOptionLength)
+		}
+		if _, ok := seen[strings.ToLower(text)]; ok {
+			return nil, fmt.Errorf("Poll options must be different")
+		}
+		seen[strings.ToLower(text)] = struct{}{}
+		poll.Options = append(poll.Options, models.PollOption{Text: text, Votes: []primitive.ObjectID{}})
+	}
+	if closesAt != "" {
+		t, err := time.Parse(time.RFC3339, closesAt)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid close time")
+		}
+		if !t.After(time.Now()) {
+			return nil, fmt.Errorf("The close time must be in the future")
+		}
+		closesAtDate := primitive.NewDateTimeFromTime(t)
+		poll.ClosesAt = &closesAtDate
+	}
+	return poll, nil
+}
+
+// Replaces the users votes on the poll matched by the filter, returns the updated message
+func VotePoll(ctx context.Context, collection *mongo.Collection, filter bson.M, uid primitive.ObjectID, choices []int) (*models.RoomChannelMessage, error) {
+	msg := &models.RoomChannelMessage{}
+	if err := collection.FindOne(ctx, filter).Decode(&msg); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("Message not found")
+		}
+		return nil, err
+	}
+	if msg.Poll == nil {
+		return nil, fmt.Errorf("This message is not a poll")
+	}
+	if len(choices) > 1 && !msg.Poll.MultipleChoice {
+		return nil, fmt.Errorf("You can only vote for one option")
+	}
+	chosen := make(map[int]struct{})
+	for _, i := range choices {
+		if i < 0 || i >= len(msg.Poll.Options) {
+			return nil, fmt.Errorf("Invalid option")
+		}
+		if _, ok := chosen[i]; ok {
+			return nil, fmt.Errorf("You can only vote for each option once")
+		}
+		chosen[i] = struct{}{}
+	}
+
+	// Rebuilds every options votes with the user added or removed
+	votes := func(option string) bson.M {
+		return bson.M{"$arrayElemAt": bson.A{"$poll.options." + option, "$$i"}}
+	}
+	choicesArray := bson.A{}
+	for i := range chosen {
+		choicesArray = append(choicesArray, i)
+	}
+	update := bson.A{bson.M{"$set": bson.M{"poll.options": bson.M{
+		"$map": bson.M{
+			"input": bson.M{"$range": bson.A{0, bson.M{"$size": "$poll.options"}}},
+			"as":    "i",
+			"in": bson.M{
+				"text": votes("text"),
+				"votes": bson.M{"$cond": bson.A{
+					bson.M{"$in": bson.A{"$$i", choicesArray}},
+					bson.M{"$setUnion": bson.A{votes("votes"), bson.A{uid}}},
+					bson.M{"$setDifference": bson.A{votes("votes"), bson.A{uid}}},
+				}},
+			},
+		},
+	}}}}
+
+	if err := collection.FindOneAndUpdate(ctx, withFilter(filter, openPollFilter()), update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&msg); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("This poll has closed")
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Closes the poll matched by the filter, returns the updated message
+func ClosePoll(ctx context.Context, collection *mongo.Collection, filter bson.M) (*models.RoomChannelMessage, error) {
+	msg := &models.RoomChannelMessage{}
+	if err := collection.FindOneAndUpdate(ctx, withFilter(filter, bson.M{"poll.closed": false}), bson.M{
+		"$set": bson.M{"poll.closed": true},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&msg); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("Poll not found, or it is already closed")
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Polls that haven't been closed and haven't reached their close time
+func openPollFilter() bson.M {
+	return bson.M{
+		"poll.closed": false,
+		"$or": bson.A{
+			bson.M{"poll.closes_at": bson.M{"$exists": false}},
+			bson.M{"poll.closes_at": bson.M{"$gt": primitive.NewDateTimeFromTime(time.Now())}},
+		},
+	}
+}
+
+func OutPoll(poll *models.Poll) *socketmodels.Poll {
+	if poll == nil {
+		return nil
+	}
+	out := &socketmodels.Poll{
+		Options:        []socketmodels.PollOption{},
+		MultipleChoice: poll.MultipleChoice,
+		Closed:         poll.Closed,
+	}
+	if poll.ClosesAt != nil {
+		out.ClosesAt = poll.ClosesAt.Time().Format(time.RFC3339)
+	}
+	for _, option := range poll.Options {
+		votes := []string{}
+		for _, oi := range option.Votes {
+			votes = append(votes, oi.Hex())
+		}
+		out.Options = append(out.Options, socketmodels.PollOption{Text: option.Text, Votes: votes})
+	}
+	return out
+}
@@ -0,0 +1,128 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/web-stuff-98/electron-social-chat/pkg/db"
+	"github.com/web-stuff-98/electron-social-chat/pkg/db/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/*
+	Reactions are stored on the message as one entry per emoji with the uids
+	of the users that reacted, so the count is the length of the uids. The
+	same functions are used for room messages and direct messages.
+*/
+
+const MaxReactionsPerMessage = 20
+
+// Emojis can be made of several runes (skin tones, flags, ZWJ sequences), so only the length is limited
+func ValidateReactionEmoji(emoji string) error {
+	if emoji == "" || strings.TrimSpace(emoji) != emoji || strings.ContainsAny(emoji, " $.") {
+		return fmt.Errorf("Invalid reaction")
+	}
+	if utf8.RuneCountInString(emoji) > 10 || len(emoji) > 40 {
+		return fmt.Errorf("Invalid reaction")
+	}
+	return nil
+}
+
+// Adds or removes the users reaction on the message matched by the filter
+func ToggleReaction(ctx context.Context, collection *mongo.Collection, filter bson.M, emoji string, uid primitive.ObjectID, remove bool) error {
+	if remove {
+		res, err := collection.UpdateOne(ctx, withFilter(filter, bson.M{"reactions.emoji": emoji}), bson.M{
+			"$pull": bson.M{"reactions.$.uids": uid},
+		})
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return fmt.Errorf("Reaction not found")
+		}
+		// Remove emojis nobody is reacting with anymore
+		_, err = collection.UpdateOne(ctx, filter, bson.M{
+			"$pull": bson.M{"reactions": bson.M{"uids": bson.M{"$size": 0}}},
+		})
+		return err
+	}
+
+	// Someone already reacted with the emoji
+	res, err := collection.UpdateOne(ctx, withFilter(filter, bson.M{"reactions.emoji": emoji}), bson.M{
+		"$addToSet": bson.M{"reactions.$.uids": uid},
+	})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount > 0 {
+		return nil
+	}
+
+	// First reaction with the emoji. Messages without any reactions can have null instead of an array.
+	if _, err := collection.UpdateOne(ctx, withFilter(filter, bson.M{"reactions": nil}), bson.M{
+		"$set": bson.M{"reactions": []models.MessageReaction{}},
+	}); err != nil {
+		return err
+	}
+	res, err = collection.UpdateOne(ctx, withFilter(filter, bson.M{
+		"reactions.emoji": bson.M{"$ne": emoji},
+		fmt.Sprintf("reactions.%d", MaxReactionsPerMessage-1): bson.M{"$exists": false},
+	}), bson.M{
+		"$push": bson.M{"reactions": models.MessageReaction{
+			Emoji: emoji,
+			Uids:  []primitive.ObjectID{uid},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("Message not found, or it has too many reactions")
+	}
+	return nil
+}
+
+// Removes reactions from users in blocked, and emojis left with no reactions
+func FilterBlockedReactions(reactions []models.MessageReaction, blocked []primitive.ObjectID) []models.MessageReaction {
+	blockedMap := make(map[primitive.ObjectID]struct{})
+	for _, oi := range blocked {
+		blockedMap[oi] = struct{}{}
+	}
+	out := []models.MessageReaction{}
+	for _, reaction := range reactions {
+		uids := []primitive.ObjectID{}
+		for _, oi := range reaction.Uids {
+			if _, ok := blockedMap[oi]; !ok {
+				uids = append(uids, oi)
+			}
+		}
+		if len(uids) > 0 {
+			out = append(out, models.MessageReaction{Emoji: reaction.Emoji, Uids: uids})
+		}
+	}
+	return out
+}
+
+func withFilter(filter bson.M, extra bson.M) bson.M {
+	out := bson.M{}
+	for k, v := range filter {
+		out[k] = v
+	}
+	for k, v := range extra {
+		out[k] = v
+	}
+	return out
+}
+
+// The users the user has blocked, for hiding their reactions
+func GetBlockedUids(ctx context.Context, collections db.Collections, uid primitive.ObjectID) ([]primitive.ObjectID, error) {
+	messagingData := &models.UserMessagingData{}
+	if err := collections.UserMessagingDataCollection.FindOne(ctx, bson.M{"_id": uid}).Decode(&messagingData); err != nil {
+		return nil, err
+	}
+	return messagingData.Blocked, nil
+}
@@ -0,0 +1,90 @@
+package helpers
+
+import (
+	"context"
+	"time"
+
+	"github.com/web-stuff-98/electron-social-chat/pkg/db"
+	"github.com/web-stuff-98/electron-social-chat/pkg/db/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	Read markers store the newest message each user has read in a channel or
+	conversation. ObjectIDs are created in order, so anything with a greater ID
+	than the marker is unread. Markers only move forward, so marking an older
+	message as read does nothing.
+*/
+
+// Returns false if the marker was already at or past the message
+func MarkRead(ctx context.Context, collections db.Collections, uid primitive.ObjectID, target primitive.ObjectID, msgId primitive.ObjectID) (bool, error) {
+	res, err := collections.ReadMarkerCollection.UpdateOne(ctx, bson.M{
+		"uid":       uid,
+		"target":    target,
+		"last_read": bson.M{"$lt": msgId},
+	}, bson.M{
+		"$set": bson.M{
+			"last_read":  msgId,
+			"updated_at": primitive.NewDateTimeFromTime(time.Now()),
+		},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		// The upsert conflicts with the unique index when the marker is already newer
+		if mongo.IsDuplicateKeyError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return res.ModifiedCount > 0 || res.UpsertedCount > 0, nil
+}
+
+// Maps each target to the users last read message. Targets without a marker are left out.
+func GetReadMarkers(ctx context.Context, collections db.Collections, uid primitive.ObjectID, targets []primitive.ObjectID) (map[primitive.ObjectID]primitive.ObjectID, error) {
+	cursor, err := collections.ReadMarkerCollection.Find(ctx, bson.M{"uid": uid, "target": bson.M{"$in": targets}})
+	if err != nil {
+		return nil, err
+	}
+	markers := []models.ReadMarker{}
+	if err := cursor.All(ctx, &markers); err != nil {
+		return nil, err
+	}
+	out := make(map[primitive.ObjectID]primitive.ObjectID)
+	for _, rm := range markers {
+		out[rm.Target] = rm.LastRead
+	}
+	return out, nil
+}
+
+// Counts the messages matched by the filter that are newer than the marker, grouped by field (channel_id, author...) in a single
+// aggregation. Targets without a marker count every message. Targets without unread messages are left out.
+func CountUnread(ctx context.Context, collection *mongo.Collection, filter bson.M, field string, targets []primitive.ObjectID, markers map[primitive.ObjectID]primitive.ObjectID) (map[primitive.ObjectID]int64, error) {
+	out := make(map[primitive.ObjectID]int64)
+	if len(targets) == 0 {
+		return out, nil
+	}
+	unreadFilter := bson.A{}
+	for _, oi := range targets {
+		unreadFilter = append(unreadFilter, bson.M{field: oi, "_id": bson.M{"$gt": markers[oi]}})
+	}
+	cursor, err := collection.Aggregate(ctx, bson.A{
+		bson.M{"$match": withFilter(filter, bson.M{"$or": unreadFilter})},
+		bson.M{"$group": bson.M{"_id": "$" + field, "count": bson.M{"$sum": 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	counts := []struct {
+		ID    primitive.ObjectID `bson:"_id"`
+		Count int64              `bson:"count"`
+	}{}
+	if err := cursor.All(ctx, &counts); err != nil {
+		return nil, err
+	}
+	for _, c := range counts {
+		out[c.ID] = c.Count
+	}
+	return out, nil
+}
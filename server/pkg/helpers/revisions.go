@@ -0,0 +1,55 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/web-stuff-98/electron-social-chat/pkg/db/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	Edits keep the previous content as a revision on the message, so moderators
+	can see what was said before it was changed. Only the most recent revisions
+	are kept so that messages edited over and over don't keep growing. The same
+	function is used for room messages and direct messages.
+*/
+
+const MaxRevisionsPerMessage = 50
+
+// Replaces the content of the message matched by the filter, and stores the old content as a revision.
+// Anything in set is also set on the message, for fields worked out from the content.
+func EditMessageContent(ctx context.Context, collection *mongo.Collection, filter bson.M, content string, set bson.M) error {
+	now := primitive.NewDateTimeFromTime(time.Now())
+	prev := &struct {
+		Content   string             `bson:"content"`
+		UpdatedAt primitive.DateTime `bson:"updated_at"`
+	}{}
+	if err := collection.FindOneAndUpdate(ctx, filter, bson.M{
+		"$set": withFilter(set, bson.M{
+			"content":    content,
+			"updated_at": now,
+			"edited":     true,
+		}),
+	}, options.FindOneAndUpdate().SetReturnDocument(options.Before)).Decode(&prev); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return fmt.Errorf("Update failed")
+		}
+		return err
+	}
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": filter["_id"]}, bson.M{
+		"$push": bson.M{"revisions": bson.M{
+			"$each": []models.MessageRevision{{
+				Content:    prev.Content,
+				CreatedAt:  prev.UpdatedAt,
+				ReplacedAt: now,
+			}},
+			"$slice": -MaxRevisionsPerMessage,
+		}},
+	})
+	return err
+}
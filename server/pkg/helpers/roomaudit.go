@@ -0,0 +1,29 @@
+package helpers
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/web-stuff-98/electron-social-chat/pkg/db"
+	"github.com/web-stuff-98/electron-social-chat/pkg/db/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Pass primitive.NilObjectID as the target for actions on the room itself. The action has
+// already happened by the time this is called, so a failed write is only logged.
+func WriteRoomAuditLog(ctx context.Context, collections db.Collections, roomId primitive.ObjectID, actor primitive.ObjectID, action string, target primitive.ObjectID, details string) {
+	auditLog := models.RoomAuditLog{
+		RoomID:    roomId,
+		Actor:     actor,
+		Action:    action,
+		Details:   details,
+		CreatedAt: primitive.NewDateTimeFromTime(time.Now()),
+	}
+	if target != primitive.NilObjectID {
+		auditLog.Target = &target
+	}
+	if _, err := collections.RoomAuditLogCollection.InsertOne(ctx, auditLog); err != nil {
+		log.Println("Error writing room audit log:", err)
+	}
+}
@@ -0,0 +1,344 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/web-stuff-98/electron-social-chat/pkg/db"
+	"github.com/web-stuff-98/electron-social-chat/pkg/db/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+	Every room permission check goes through here. The room author has every
+	permission, banned users and non-members of private rooms have none. Anyone
+	else gets the permissions of their assigned role, or the default role.
+
+	Channel overrides are applied on top of the room permissions, for checks
+	inside of a channel use the channel functions.
+*/
+
+var (
+	ErrRoomBanned            = fmt.Errorf("Banned")
+	ErrRoomNotMember         = fmt.Errorf("Not a member")
+	ErrRoomMissingPermission = fmt.Errorf("Unauthorized")
+	ErrRoomMuted             = fmt.Errorf("You are muted in this room")
+	ErrRoomTargetModerator   = fmt.Errorf("Only the owner of the room can do this to a moderator")
+)
+
+// Returns ErrRoomBanned or ErrRoomNotMember if the user cannot access the room at all
+func GetRoomPermissions(ctx context.Context, collections db.Collections, roomId primitive.ObjectID, uid primitive.ObjectID) (models.RoomPermission, error) {
+	permissions, _, err := GetRoomPermissionsAndExternalData(ctx, collections, roomId, uid)
+	return permissions, err
+}
+
+// Same as GetRoomPermissions, with the channel overrides applied
+func GetRoomChannelPermissions(ctx context.Context, collections db.Collections, channel *models.RoomChannel, uid primitive.ObjectID) (models.RoomPermission, error) {
+	permissions, externalData, err := GetRoomPermissionsAndExternalData(ctx, collections, channel.RoomID, uid)
+	if err != nil {
+		return 0, err
+	}
+	return ApplyChannelOverrides(channel, externalData, uid, permissions), nil
+}
+
+// Returns ErrRoomMissingPermission if the user doesn't have all the permission bits in the channel
+func CheckRoomChannelPermission(ctx context.Context, collections db.Collections, channel *models.RoomChannel, uid primitive.ObjectID, permission models.RoomPermission) error {
+	permissions, err := GetRoomChannelPermissions(ctx, collections, channel, uid)
+	if err != nil {
+		return err
+	}
+	if permissions&permission != permission {
+		return ErrRoomMissingPermission
+	}
+	return nil
+}
+
+// The IDs of the channels in the room the user can see, with the channel overrides applied
+func GetVisibleRoomChannelIDs(ctx context.Context, collections db.Collections, roomId primitive.ObjectID, uid primitive.ObjectID) ([]primitive.ObjectID, error) {
+	permissions, externalData, err := GetRoomPermissionsAndExternalData(ctx, collections, roomId, uid)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := collections.RoomChannelCollection.Find(ctx, bson.M{"room_id": roomId})
+	if err != nil {
+		return nil, err
+	}
+	channels := []models.RoomChannel{}
+	if err := cursor.All(ctx, &channels); err != nil {
+		return nil, err
+	}
+	channelIds := []primitive.ObjectID{}
+	for i := range channels {
+		if ApplyChannelOverrides(&channels[i], externalData, uid, permissions)&models.PermissionViewChannel != 0 {
+			channelIds = append(channelIds, channels[i].ID)
+		}
+	}
+	return channelIds, nil
+}
+
+// Leaves out the users that cannot see the channel
+func FilterRoomChannelViewers(ctx context.Context, collections db.Collections, channel *models.RoomChannel, uids []primitive.ObjectID) ([]primitive.ObjectID, error) {
+	room := &models.Room{}
+	if err := collections.RoomCollection.FindOne(ctx, bson.M{"_id": channel.RoomID}).Decode(&room); err != nil {
+		return nil, err
+	}
+	externalData := &models.RoomExternalData{}
+	if err := collections.RoomExternalDataCollection.FindOne(ctx, bson.M{"_id": channel.RoomID}).Decode(&externalData); err != nil {
+		return nil, err
+	}
+	viewers := []primitive.ObjectID{}
+	for _, uid := range uids {
+		if uid == room.Author {
+			viewers = append(viewers, uid)
+			continue
+		}
+		permissions, err := ResolveRoomPermissions(externalData, uid)
+		if err != nil {
+			continue
+		}
+		if ApplyChannelOverrides(channel, externalData, uid, permissions)&models.PermissionViewChannel != 0 {
+			viewers = append(viewers, uid)
+		}
+	}
+	return viewers, nil
+}
+
+// Channels that aren't hidden, in public rooms, can be seen by anyone that isn't banned
+func IsRoomChannelPublic(ctx context.Context, collections db.Collections, channel *models.RoomChannel) (bool, error) {
+	if channel.Hidden {
+		return false, nil
+	}
+	externalData := &models.RoomExternalData{}
+	if err := collections.RoomExternalDataCollection.FindOne(ctx, bson.M{"_id": channel.RoomID}).Decode(&externalData); err != nil {
+		return false, err
+	}
+	return !externalData.Private, nil
+}
+
+// Everyone that can see a channel that isn't public. Users outside of the room can't see it, so only
+// the room author, the members and users with a role are checked.
+func GetRoomChannelAudience(ctx context.Context, collections db.Collections, channel *models.RoomChannel) ([]primitive.ObjectID, error) {
+	room := &models.Room{}
+	if err := collections.RoomCollection.FindOne(ctx, bson.M{"_id": channel.RoomID}).Decode(&room); err != nil {
+		return nil, err
+	}
+	externalData := &models.RoomExternalData{}
+	if err := collections.RoomExternalDataCollection.FindOne(ctx, bson.M{"_id": channel.RoomID}).Decode(&externalData); err != nil {
+		return nil, err
+	}
+	candidates := map[primitive.ObjectID]struct{}{room.Author: {}}
+	for _, oi := range externalData.Members {
+		candidates[oi] = struct{}{}
+	}
+	for _, ra := range externalData.RoleAssignments {
+		candidates[ra.Uid] = struct{}{}
+	}
+	uids := []primitive.ObjectID{}
+	for oi := range candidates {
+		uids = append(uids, oi)
+	}
+	return FilterRoomChannelViewers(ctx, collections, channel, uids)
+}
+
+// Same as GetRoomPermissions, also returns the external data for checks that need more than the permissions
+func GetRoomPermissionsAndExternalData(ctx context.Context, collections db.Collections, roomId primitive.ObjectID, uid primitive.ObjectID) (models.RoomPermission, *models.RoomExternalData, error) {
+	room := &models.Room{}
+	if err := collections.RoomCollection.FindOne(ctx, bson.M{"_id": roomId}).Decode(&room); err != nil {
+		return 0, nil, err
+	}
+	externalData := &models.RoomExternalData{}
+	if err := collections.RoomExternalDataCollection.FindOne(ctx, bson.M{"_id": roomId}).Decode(&externalData); err != nil {
+		return 0, nil, err
+	}
+	if room.Author == uid {
+		return models.PermissionAllRoles | models.PermissionOwner, externalData, nil
+	}
+	permissions, err := ResolveRoomPermissions(externalData, uid)
+	return permissions, externalData, err
+}
+
+// Returns ErrRoomMissingPermission if the user doesn't have all the permission bits
+func CheckRoomPermission(ctx context.Context, collections db.Collections, roomId primitive.ObjectID, uid primitive.ObjectID, permission models.RoomPermission) error {
+	permissions, err := GetRoomPermissions(ctx, collections, roomId, uid)
+	if err != nil {
+		return err
+	}
+	if permissions&permission != permission {
+		return ErrRoomMissingPermission
+	}
+	return nil
+}
+
+// Returns ErrRoomTargetModerator if the target can moderate the room and the actor isn't the owner.
+// Users that are banned or can't access the room have no permissions, so they can always be moderated.
+func CheckCanModerateUser(ctx context.Context, collections db.Collections, roomId primitive.ObjectID, actor primitive.ObjectID, target primitive.ObjectID) error {
+	actorPermissions, err := GetRoomPermissions(ctx, collections, roomId, actor)
+	if err != nil {
+		return err
+	}
+	targetPermissions, err := GetRoomPermissions(ctx, collections, roomId, target)
+	if err != nil && err != ErrRoomBanned && err != ErrRoomNotMember {
+		return err
+	}
+	return CanModerateUser(actorPermissions, targetPermissions)
+}
+
+// For when the permissions have already been retrieved. Nobody can moderate the owner.
+func CanModerateUser(actorPermissions models.RoomPermission, targetPermissions models.RoomPermission) error {
+	if targetPermissions&models.PermissionOwner != 0 {
+		return ErrRoomTargetModerator
+	}
+	if targetPermissions&models.PermissionsModeration != 0 && actorPermissions&models.PermissionOwner == 0 {
+		return ErrRoomTargetModerator
+	}
+	return nil
+}
+
+// Returns ErrRoomNotMember unless the user is the room author or a member. Public rooms can be seen by anyone, this is for things only members can do.
+func CheckRoomMember(ctx context.Context, collections db.Collections, roomId primitive.ObjectID, uid primitive.ObjectID) error {
+	room := &models.Room{}
+	if err := collections.RoomCollection.FindOne(ctx, bson.M{"_id": roomId}).Decode(&room); err != nil {
+		return err
+	}
+	if room.Author == uid {
+		return nil
+	}
+	externalData := &models.RoomExternalData{}
+	if err := collections.RoomExternalDataCollection.FindOne(ctx, bson.M{"_id": roomId}).Decode(&externalData); err != nil {
+		return err
+	}
+	if IsRoomMember(externalData, uid) {
+		return nil
+	}
+	return ErrRoomNotMember
+}
+
+// For when the external data has already been retrieved. Does not check if the user is the room author.
+func IsRoomMember(externalData *models.RoomExternalData, uid primitive.ObjectID) bool {
+	for _, oi := range externalData.Members {
+		if oi == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns ErrRoomMuted if the user has a mute that hasn't expired yet
+func CheckRoomMuted(ctx context.Context, collections db.Collections, roomId primitive.ObjectID, uid primitive.ObjectID) error {
+	externalData := &models.RoomExternalData{}
+	if err := collections.RoomExternalDataCollection.FindOne(ctx, bson.M{"_id": roomId}).Decode(&externalData); err != nil {
+		return err
+	}
+	if IsRoomMuted(externalData, uid) {
+		return ErrRoomMuted
+	}
+	return nil
+}
+
+// Expired mutes are ignored, so that users aren't stuck waiting for the sweeper
+func IsRoomMuted(externalData *models.RoomExternalData, uid primitive.ObjectID) bool {
+	for _, m := range externalData.Mutes {
+		if m.Uid == uid && !RestrictionExpired(m, time.Now()) {
+			return true
+		}
+	}
+	return false
+}
+
+func RestrictionExpired(restriction models.RoomRestriction, now time.Time) bool {
+	return restriction.ExpiresAt != nil && !restriction.ExpiresAt.Time().After(now)
+}
+
+// Creates a restriction record from the duration in seconds, 0 for a permanent restriction
+func NewRoomRestriction(uid primitive.ObjectID, moderator primitive.ObjectID, reason string, duration int) (models.RoomRestriction, error) {
+	if duration < 0 {
+		return models.RoomRestriction{}, fmt.Errorf("Invalid duration")
+	}
+	if len(reason) > 200 {
+		return models.RoomRestriction{}, fmt.Errorf("Reason max 200 characters")
+	}
+	now := time.Now()
+	restriction := models.RoomRestriction{
+		Uid:       uid,
+		Moderator: moderator,
+		Reason:    strings.TrimSpace(reason),
+		CreatedAt: primitive.NewDateTimeFromTime(now),
+	}
+	if duration > 0 {
+		expiresAt := primitive.NewDateTimeFromTime(now.Add(time.Duration(duration) * time.Second))
+		restriction.ExpiresAt = &expiresAt
+	}
+	return restriction, nil
+}
+
+// For when the external data has already been retrieved. Does not check if the user is the room author.
+func ResolveRoomPermissions(externalData *models.RoomExternalData, uid primitive.ObjectID) (models.RoomPermission, error) {
+	for _, oi := range externalData.Banned {
+		if oi == uid {
+			return 0, ErrRoomBanned
+		}
+	}
+	if externalData.Private && !IsRoomMember(externalData, uid) {
+		return 0, ErrRoomNotMember
+	}
+
+	var roleId primitive.ObjectID
+	for _, ra := range externalData.RoleAssignments {
+		if ra.Uid == uid {
+			roleId = ra.RoleID
+			break
+		}
+	}
+	// Rooms created before roles existed have no default role
+	permissions := models.PermissionsMemberDefault
+	for _, role := range externalData.Roles {
+		if role.ID == roleId {
+			return role.Permissions &^ models.PermissionOwner, nil
+		}
+		if role.Default {
+			permissions = role.Permissions &^ models.PermissionOwner
+		}
+	}
+	return permissions, nil
+}
+
+// For when the external data has already been retrieved. Permissions should come from ResolveRoomPermissions.
+func ApplyChannelOverrides(channel *models.RoomChannel, externalData *models.RoomExternalData, uid primitive.ObjectID, permissions models.RoomPermission) models.RoomPermission {
+	permissions |= models.PermissionViewChannel | models.PermissionSendMessages
+	if permissions&(models.PermissionManageChannels|models.PermissionOwner) != 0 {
+		if channel.NoAttachments {
+			permissions &^= models.PermissionUploadAttachments
+		}
+		return permissions
+	}
+	if channel.Hidden && !IsRoomMember(externalData, uid) {
+		permissions &^= models.PermissionViewChannel | models.PermissionSendMessages | models.PermissionUploadAttachments
+	}
+	if channel.ReadOnly {
+		permissions &^= models.PermissionSendMessages | models.PermissionUploadAttachments
+	}
+	if channel.NoAttachments {
+		permissions &^= models.PermissionUploadAttachments
+	}
+	return permissions
+}
+
+// Roles created along with the room
+func DefaultRoomRoles() []models.RoomRole {
+	return []models.RoomRole{
+		{
+			ID:          primitive.NewObjectID(),
+			Name:        "Moderator",
+			Permissions: models.PermissionsModeratorDefault,
+		},
+		{
+			ID:          primitive.NewObjectID(),
+			Name:        "Member",
+			Permissions: models.PermissionsMemberDefault,
+			Default:     true,
+		},
+	}
+}
@@ -0,0 +1,69 @@
+package helpers
+
+import (
+	"testing"
+
+	"github.com/web-stuff-98/electron-social-chat/pkg/db/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCanModerateUser(t *testing.T) {
+	owner := models.PermissionAllRoles | models.PermissionOwner
+	moderator := models.PermissionsModeratorDefault
+	kicker := models.PermissionKick
+	member := models.PermissionsMemberDefault
+
+	tests := []struct {
+		name   string
+		actor  models.RoomPermission
+		target models.RoomPermission
+		want   error
+	}{
+		{"moderator on member", moderator, member, nil},
+		{"moderator on moderator", moderator, moderator, ErrRoomTargetModerator},
+		{"moderator on user with a single moderation permission", moderator, kicker, ErrRoomTargetModerator},
+		{"single moderation permission on moderator", kicker, moderator, ErrRoomTargetModerator},
+		{"moderator on owner", moderator, owner, ErrRoomTargetModerator},
+		{"owner on moderator", owner, moderator, nil},
+		{"owner on member", owner, member, nil},
+		{"moderator on banned user", moderator, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CanModerateUser(tt.actor, tt.target); got != tt.want {
+				t.Errorf("CanModerateUser(%b, %b) = %v, want %v", tt.actor, tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+// Moderators get their permissions from their role, so check it resolves to something that is protected
+func TestCanModerateUserWithRoles(t *testing.T) {
+	roles := DefaultRoomRoles()
+	modA := primitive.NewObjectID()
+	modB := primitive.NewObjectID()
+	member := primitive.NewObjectID()
+	externalData := &models.RoomExternalData{
+		Members: []primitive.ObjectID{modA, modB, member},
+		Roles:   roles,
+		RoleAssignments: []models.RoomRoleAssignment{
+			{Uid: modA, RoleID: roles[0].ID},
+			{Uid: modB, RoleID: roles[0].ID},
+		},
+	}
+
+	permissions := func(uid primitive.ObjectID) models.RoomPermission {
+		p, err := ResolveRoomPermissions(externalData, uid)
+		if err != nil {
+			t.Fatalf("ResolveRoomPermissions: %v", err)
+		}
+		return p
+	}
+
+	if err := CanModerateUser(permissions(modA), permissions(modB)); err != ErrRoomTargetModerator {
+		t.Errorf("moderator on moderator = %v, want ErrRoomTargetModerator", err)
+	}
+	if err := CanModerateUser(permissions(modA), permissions(member)); err != nil {
+		t.Errorf("moderator on member = %v, want nil", err)
+	}
+}
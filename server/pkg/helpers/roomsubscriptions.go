@@ -0,0 +1,31 @@
+package helpers
+
+import (
+	"context"
+
+	"github.com/web-stuff-98/electron-social-chat/pkg/db"
+	"github.com/web-stuff-98/electron-social-chat/pkg/db/models"
+	"github.com/web-stuff-98/electron-social-chat/pkg/socketserver"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Gets the uids of the users watching any of the rooms channels
+func GetRoomChannelSubscriberUids(ctx context.Context, collections db.Collections, ss *socketserver.SocketServer, roomId primitive.ObjectID) (map[primitive.ObjectID]struct{}, error) {
+	internalData := &models.RoomInternalData{}
+	if err := collections.RoomInternalDataCollection.FindOne(ctx, bson.M{"_id": roomId}).Decode(&internalData); err != nil {
+		return nil, err
+	}
+	uids := make(map[primitive.ObjectID]struct{})
+	for _, oi := range internalData.Channels {
+		recvChan := make(chan map[primitive.ObjectID]struct{})
+		ss.GetSubscriptionUids <- socketserver.GetSubscriptionUids{
+			RecvChan: recvChan,
+			Name:     "channel:" + oi.Hex(),
+		}
+		for oi2 := range <-recvChan {
+			uids[oi2] = struct{}{}
+		}
+	}
+	return uids, nil
+}
@@ -0,0 +1,38 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/web-stuff-98/electron-social-chat/pkg/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	MaxScheduledPerUser = 50
+	MaxScheduleAhead    = time.Hour * 24 * 365
+)
+
+// Parses the RFC3339 time for a scheduled message or reminder, and checks the user hasn't got too many scheduled already
+func GetScheduleTime(ctx context.Context, collections db.Collections, uid primitive.ObjectID, value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time")
+	}
+	if !t.After(time.Now()) {
+		return time.Time{}, fmt.Errorf("The time must be in the future")
+	}
+	if t.After(time.Now().Add(MaxScheduleAhead)) {
+		return time.Time{}, fmt.Errorf("You cannot schedule more than a year ahead")
+	}
+	count, err := collections.ScheduledMessageCollection.CountDocuments(ctx, bson.M{"uid": uid})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if count >= MaxScheduledPerUser {
+		return time.Time{}, fmt.Errorf("You cannot have more than %d scheduled messages and reminders", MaxScheduledPerUser)
+	}
+	return t, nil
+}
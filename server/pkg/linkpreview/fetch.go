@@ -0,0 +1,274 @@
+package linkpreview
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+	Fetching is done with a client that checks every address it connects to,
+	after DNS has been resolved, so a hostname that resolves to a private
+	address (or a redirect to one) is refused. Only http and https on the
+	usual ports are allowed, and the time and size of each fetch is limited.
+*/
+
+var (
+	ErrBlockedAddress = fmt.Errorf("Address not allowed")
+	ErrNotHTML        = fmt.Errorf("Not an HTML page")
+	ErrNoPreview      = fmt.Errorf("No preview data found")
+)
+
+const (
+	fetchTimeout    = time.Second * 5
+	maxBodyBytes    = 512 * 1024
+	maxRedirects    = 3
+	maxTitle        = 200
+	maxDescription  = 300
+	maxImageURL     = 2048
+	userAgentHeader = "electron-social-chat link preview"
+)
+
+type Preview struct {
+	URL         string `bson:"url" json:"url"`
+	Title       string `bson:"title" json:"title"`
+	Description string `bson:"description" json:"description"`
+	SiteName    string `bson:"site_name,omitempty" json:"site_name,omitempty"`
+	// The URL of the image, it isn't fetched by the server
+	Image string `bson:"image,omitempty" json:"image,omitempty"`
+}
+
+type Fetcher struct {
+	Client       *http.Client
+	MaxBodyBytes int64
+}
+
+// allowAddress is checked for every connection. Use PublicAddress outside of tests.
+func NewFetcher(allowAddress func(ip net.IP, port int) bool) *Fetcher {
+	dialer := &net.Dialer{
+		Timeout: fetchTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, portString, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			port, err := strconv.Atoi(portString)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !allowAddress(ip, port) {
+				return ErrBlockedAddress
+			}
+			return nil
+		},
+	}
+	transport := &http.Transport{
+		// Proxies would do their own DNS lookups, getting around the address check
+		Proxy:                  nil,
+		DialContext:            dialer.DialContext,
+		TLSHandshakeTimeout:    fetchTimeout,
+		ResponseHeaderTimeout:  fetchTimeout,
+		MaxResponseHeaderBytes: 64 * 1024,
+		DisableKeepAlives:      true,
+	}
+	return &Fetcher{
+		Client: &http.Client{
+			Timeout:   fetchTimeout,
+			Transport: transport,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= maxRedirects {
+					return fmt.Errorf("Too many redirects")
+				}
+				if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+					return ErrBlockedAddress
+				}
+				return nil
+			},
+		},
+		MaxBodyBytes: maxBodyBytes,
+	}
+}
+
+var blockedNetworks = func() []*net.IPNet {
+	cidrs := []string{
+		"0.0.0.0/8",       // "this" network
+		"100.64.0.0/10",   // carrier grade NAT
+		"192.0.0.0/24",    // IETF protocol assignments
+		"192.0.2.0/24",    // documentation
+		"198.18.0.0/15",   // benchmarking
+		"198.51.100.0/24", // documentation
+		"203.0.113.0/24",  // documentation
+		"240.0.0.0/4",     // reserved, and broadcast
+		"64:ff9b::/96",    // NAT64, can point at IPv4 private addresses
+		"2001:db8::/32",   // documentation
+	}
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// Only public unicast addresses on the standard web ports
+func PublicAddress(ip net.IP, port int) bool {
+	if port != 80 && port != 443 {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+var urlRegex = regexp.MustCompile(`https?://[^\s<>"'` + "`" + `]+`)
+
+// The first http or https URL in the content, or an empty string
+func FirstURL(content string) string {
+	rawURL := strings.TrimRight(urlRegex.FindString(content), ".,!?:;)]}'\"*~|")
+	if rawURL == "" {
+		return ""
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return u.String()
+}
+
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (*Preview, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, ErrBlockedAddress
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgentHeader)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	res, err := f.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("Unexpected status %d", res.StatusCode)
+	}
+	contentType := strings.ToLower(res.Header.Get("Content-Type"))
+	if !strings.Contains(contentType, "text/html") && !strings.Contains(contentType, "application/xhtml+xml") {
+		return nil, ErrNotHTML
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, f.MaxBodyBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	preview := parsePreview(string(body), res.Request.URL)
+	if preview.Title == "" && preview.Description == "" {
+		return nil, ErrNoPreview
+	}
+	preview.URL = u.String()
+	return preview, nil
+}
+
+var (
+	metaRegex  = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	attrRegex  = regexp.MustCompile(`(?s)([a-zA-Z:_-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+	titleRegex = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	spaceRegex = regexp.MustCompile(`\s+`)
+)
+
+// Reads the OpenGraph tags, falling back to the title and description tags
+func parsePreview(body string, pageURL *url.URL) *Preview {
+	if end := strings.Index(strings.ToLower(body), "</head>"); end != -1 {
+		body = body[:end]
+	}
+
+	meta := make(map[string]string)
+	for _, tag := range metaRegex.FindAllString(body, -1) {
+		attrs := make(map[string]string)
+		for _, m := range attrRegex.FindAllStringSubmatch(tag, -1) {
+			attrs[strings.ToLower(m[1])] = m[2] + m[3] + m[4]
+		}
+		key := attrs["property"]
+		if key == "" {
+			key = attrs["name"]
+		}
+		key = strings.ToLower(key)
+		if _, ok := meta[key]; key != "" && !ok {
+			meta[key] = attrs["content"]
+		}
+	}
+
+	preview := &Preview{
+		Title:       firstNonEmpty(meta["og:title"], meta["twitter:title"]),
+		Description: firstNonEmpty(meta["og:description"], meta["twitter:description"], meta["description"]),
+		SiteName:    meta["og:site_name"],
+	}
+	if preview.Title == "" {
+		if m := titleRegex.FindStringSubmatch(body); m != nil {
+			preview.Title = m[1]
+		}
+	}
+	preview.Title = cleanText(preview.Title, maxTitle)
+	preview.Description = cleanText(preview.Description, maxDescription)
+	preview.SiteName = cleanText(preview.SiteName, maxTitle)
+
+	if image := firstNonEmpty(meta["og:image"], meta["twitter:image"]); image != "" {
+		if imageURL, err := pageURL.Parse(html.UnescapeString(strings.TrimSpace(image))); err == nil &&
+			(imageURL.Scheme == "http" || imageURL.Scheme == "https") && len(imageURL.String()) <= maxImageURL {
+			preview.Image = imageURL.String()
+		}
+	}
+
+	return preview
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Unescapes entities, collapses whitespace and truncates to max runes
+func cleanText(s string, max int) string {
+	s = strings.TrimSpace(spaceRegex.ReplaceAllString(html.UnescapeString(s), " "))
+	if !utf8.ValidString(s) {
+		s = strings.ToValidUTF8(s, "")
+	}
+	if utf8.RuneCountInString(s) > max {
+		s = string([]rune(s)[:max])
+	}
+	return s
+}
@@ -0,0 +1,218 @@
+package linkpreview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func allowAll(ip net.IP, port int) bool {
+	return true
+}
+
+func serveHTML(body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, body)
+	}))
+}
+
+func TestFetchOpenGraph(t *testing.T) {
+	srv := serveHTML(`<html><head>
+		<title>Fallback title</title>
+		<meta property="og:title" content="Open &amp; Graph">
+		<meta property="og:description" content="  The   description ">
+		<meta property="og:site_name" content="Example">
+		<meta property="og:image" content="/images/preview.png">
+		<meta name="twitter:title" content="Twitter title">
+	</head><body></body></html>`)
+	defer srv.Close()
+
+	preview, err := NewFetcher(allowAll).Fetch(context.Background(), srv.URL+"/page")
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if preview.URL != srv.URL+"/page" {
+		t.Errorf("URL = %q", preview.URL)
+	}
+	if preview.Title != "Open & Graph" {
+		t.Errorf("Title = %q", preview.Title)
+	}
+	if preview.Description != "The description" {
+		t.Errorf("Description = %q", preview.Description)
+	}
+	if preview.SiteName != "Example" {
+		t.Errorf("SiteName = %q", preview.SiteName)
+	}
+	if preview.Image != srv.URL+"/images/preview.png" {
+		t.Errorf("Image = %q, want the relative URL resolved against the page", preview.Image)
+	}
+}
+
+func TestFetchTwitterTags(t *testing.T) {
+	srv := serveHTML(`<head>
+		<meta name="twitter:title" content='Twitter title'>
+		<meta name="twitter:description" content="Twitter description">
+		<meta name="twitter:image" content="https://cdn.example.com/card.png">
+	</head>`)
+	defer srv.Close()
+
+	preview, err := NewFetcher(allowAll).Fetch(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if preview.Title != "Twitter title" {
+		t.Errorf("Title = %q", preview.Title)
+	}
+	if preview.Description != "Twitter description" {
+		t.Errorf("Description = %q", preview.Description)
+	}
+	if preview.Image != "https://cdn.example.com/card.png" {
+		t.Errorf("Image = %q", preview.Image)
+	}
+}
+
+func TestFetchTitleAndDescriptionFallback(t *testing.T) {
+	srv := serveHTML(`<head>
+		<TITLE>Plain
+		title</TITLE>
+		<meta name="description" content="Plain description">
+	</head>`)
+	defer srv.Close()
+
+	preview, err := NewFetcher(allowAll).Fetch(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if preview.Title != "Plain title" {
+		t.Errorf("Title = %q", preview.Title)
+	}
+	if preview.Description != "Plain description" {
+		t.Errorf("Description = %q", preview.Description)
+	}
+	if preview.Image != "" {
+		t.Errorf("Image = %q, want none", preview.Image)
+	}
+}
+
+func TestFetchRejectsNonHTML(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"title":"<title>Not a page</title>"}`)
+	}))
+	defer srv.Close()
+
+	if _, err := NewFetcher(allowAll).Fetch(context.Background(), srv.URL); !errors.Is(err, ErrNotHTML) {
+		t.Fatalf("err = %v, want ErrNotHTML", err)
+	}
+}
+
+func TestFetchTruncatesBody(t *testing.T) {
+	head := "<head><title>Early title</title>"
+	srv := serveHTML(head + strings.Repeat(" ", 4096) + `<meta property="og:title" content="Late title"></head>`)
+	defer srv.Close()
+
+	f := NewFetcher(allowAll)
+	f.MaxBodyBytes = int64(len(head))
+	preview, err := f.Fetch(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if preview.Title != "Early title" {
+		t.Errorf("Title = %q, want the tag after MaxBodyBytes to be ignored", preview.Title)
+	}
+}
+
+func TestFetchRedirectLimit(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		http.Redirect(w, r, fmt.Sprintf("/redirect/%d", n), http.StatusFound)
+	}))
+	defer srv.Close()
+
+	if _, err := NewFetcher(allowAll).Fetch(context.Background(), srv.URL); err == nil {
+		t.Fatal("expected an error after too many redirects")
+	}
+	if requests != maxRedirects {
+		t.Errorf("requests = %d, want %d", requests, maxRedirects)
+	}
+}
+
+func TestFetchRedirectToBlockedAddress(t *testing.T) {
+	blocked := serveHTML(`<head><title>Internal</title></head>`)
+	defer blocked.Close()
+	blockedPort := blocked.Listener.Addr().(*net.TCPAddr).Port
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, blocked.URL, http.StatusFound)
+	}))
+	defer srv.Close()
+
+	f := NewFetcher(func(ip net.IP, port int) bool {
+		return port != blockedPort
+	})
+	if _, err := f.Fetch(context.Background(), srv.URL); !errors.Is(err, ErrBlockedAddress) {
+		t.Fatalf("err = %v, want ErrBlockedAddress", err)
+	}
+}
+
+func TestPublicAddress(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+		port int
+		want bool
+	}{
+		{"public http", "93.184.216.34", 80, true},
+		{"public https", "93.184.216.34", 443, true},
+		{"public ipv6", "2606:2800:220:1:248:1893:25c8:1946", 443, true},
+		{"non web port", "93.184.216.34", 8080, false},
+		{"ssh port", "93.184.216.34", 22, false},
+		{"loopback", "127.0.0.1", 80, false},
+		{"ipv6 loopback", "::1", 443, false},
+		{"rfc1918 10/8", "10.1.2.3", 80, false},
+		{"rfc1918 172.16/12", "172.16.5.4", 443, false},
+		{"rfc1918 192.168/16", "192.168.1.1", 80, false},
+		{"link local metadata", "169.254.169.254", 80, false},
+		{"nat64", "64:ff9b::a00:1", 80, false},
+		{"ipv6 ula", "fd12:3456:789a::1", 443, false},
+		{"unspecified", "0.0.0.0", 80, false},
+		{"carrier grade nat", "100.64.0.1", 80, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := PublicAddress(net.ParseIP(tt.ip), tt.port); got != tt.want {
+				t.Errorf("PublicAddress(%s, %d) = %v, want %v", tt.ip, tt.port, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirstURL(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"no links here", ""},
+		{"see https://example.com/page", "https://example.com/page"},
+		{"see https://example.com/page.", "https://example.com/page"},
+		{"(https://example.com/page)", "https://example.com/page"},
+		{"really? https://example.com/a?b=c!?", "https://example.com/a?b=c"},
+		{"first http://one.example.com, then https://two.example.com", "http://one.example.com"},
+		{`<a href="https://example.com/quoted">`, "https://example.com/quoted"},
+		{"ftp://example.com/file", ""},
+		{"https://", ""},
+	}
+	for _, tt := range tests {
+		if got := FirstURL(tt.content); got != tt.want {
+			t.Errorf("FirstURL(%q) = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package linkpreviewserver
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/web-stuff-98/electron-social-chat/pkg/db"
+	"github.com/web-stuff-98/electron-social-chat/pkg/db/models"
+	"github.com/web-stuff-98/electron-social-chat/pkg/linkpreview"
+	"github.com/web-stuff-98/electron-social-chat/pkg/socketmodels"
+	"github.com/web-stuff-98/electron-social-chat/pkg/socketserver"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	Fetches link previews for messages in the background, so sending a
+	message never waits on another website.
+
+	Messages are queued by the socket event handlers after being created or
+	edited. The preview is only stored if the message content is the same as
+	when the preview was fetched, so a slow fetch can't overwrite the preview
+	of a newer edit. When it's stored the message update event is sent out.
+*/
+
+const (
+	workers   = 4
+	queueSize = 100
+	// Longer than the fetchers own timeout, includes the database queries
+	jobTimeout = time.Second * 10
+)
+
+type LinkPreviewServer struct {
+	// Channel for queueing messages. Use Queue, so the socket handlers don't block when it's full.
+	QueueChan chan QueuedMessage
+	// Replaceable with a fetcher from linkpreview.NewFetcher that allows local addresses
+	Fetcher *linkpreview.Fetcher
+}
+
+/* --------------- STRUCTS --------------- */
+
+type QueuedMessage struct {
+	MsgID  primitive.ObjectID
+	IsRoom bool
+}
+
+func Init(ss *socketserver.SocketServer, colls *db.Collections) *LinkPreviewServer {
+	lps := &LinkPreviewServer{
+		QueueChan: make(chan QueuedMessage, queueSize),
+		Fetcher:   linkpreview.NewFetcher(linkpreview.PublicAddress),
+	}
+	runServer(ss, lps, colls)
+	return lps
+}
+
+func runServer(ss *socketserver.SocketServer, lps *LinkPreviewServer, colls *db.Collections) {
+	/* ----- Preview worker loops ----- */
+	for i := 0; i < workers; i++ {
+		go previewLoop(ss, lps, colls)
+	}
+}
+
+// Returns false if the queue is full, the message just won't get a preview
+func Queue(lps *LinkPreviewServer, msg QueuedMessage) bool {
+	select {
+	case lps.QueueChan <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+func previewLoop(ss *socketserver.SocketServer, lps *LinkPreviewServer, colls *db.Collections) {
+	for {
+		defer func() {
+			r := recover()
+			if r != nil {
+				log.Println("Recovered from panic in link preview loop:", r)
+			}
+			go previewLoop(ss, lps, colls)
+		}()
+		data := <-lps.QueueChan
+		if err := fetchPreview(ss, lps, colls, data); err != nil {
+			log.Println("Link preview error:", err)
+		}
+	}
+}
+
+func fetchPreview(ss *socketserver.SocketServer, lps *LinkPreviewServer, colls *db.Collections, data QueuedMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), jobTimeout)
+	defer cancel()
+
+	collection := colls.DirectMessageCollection
+	if data.IsRoom {
+		collection = colls.RoomMessageCollection
+	}
+
+	current := struct {
+		Content string `bson:"content"`
+	}{}
+	if err := collection.FindOne(ctx, bson.M{"_id": data.MsgID}, options.FindOne().SetProjection(bson.M{"content": 1})).Decode(&current); err != nil {
+		return ignoreDeleted(err)
+	}
+	content := current.Content
+
+	url := linkpreview.FirstURL(content)
+	if url == "" {
+		return nil
+	}
+	preview, err := lps.Fetcher.Fetch(ctx, url)
+	if err != nil {
+		// Most sites just won't have a preview, it isn't worth logging
+		return nil
+	}
+
+	// Only store the preview if the message wasn't edited during the fetch
+	res := collection.FindOneAndUpdate(ctx, bson.M{"_id": data.MsgID, "content": content}, bson.M{"$set": bson.M{"link_preview": preview}})
+	if res.Err() != nil {
+		return ignoreDeleted(res.Err())
+	}
+
+	if data.IsRoom {
+		msg := &models.RoomChannelMessage{}
+		if err := res.Decode(&msg); err != nil {
+			return err
+		}
+		outBytes, err := json.Marshal(socketmodels.OutRoomMessageUpdate{
+			Type:        "OUT_ROOM_MESSAGE_UPDATE",
+			Content:     msg.Content,
+			ID:          msg.ID.Hex(),
+			Edited:      msg.Edited,
+			RichText:    msg.RichText,
+			Rendered:    msg.Rendered,
+			LinkPreview: preview,
+		})
+		if err != nil {
+			return err
+		}
+		ss.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
+			Name: "channel:" + msg.ChannelID.Hex(),
+			Data: outBytes,
+		}
+	} else {
+		msg := &models.DirectMessage{}
+		if err := res.Decode(&msg); err != nil {
+			return err
+		}
+		Uids := make(map[primitive.ObjectID]struct{})
+		Uids[msg.Author] = struct{}{}
+		Uids[msg.Recipient] = struct{}{}
+		ss.SendDataToUsers <- socketserver.UsersDataMessage{
+			Uids: Uids,
+			Type: "OUT_DIRECT_MESSAGE_UPDATE",
+			Data: socketmodels.OutDirectMessageUpdate{
+				ID:          msg.ID.Hex(),
+				Content:     msg.Content,
+				Author:      msg.Author.Hex(),
+				Recipient:   msg.Recipient.Hex(),
+				Edited:      msg.Edited,
+				RichText:    msg.RichText,
+				Rendered:    msg.Rendered,
+				LinkPreview: preview,
+			},
+		}
+	}
+
+	return nil
+}
+
+// The message was deleted or edited before the preview was ready
+func ignoreDeleted(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	return err
+}
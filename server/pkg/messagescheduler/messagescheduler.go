@@ -0,0 +1,118 @@
+package messagescheduler
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/web-stuff-98/electron-social-chat/pkg/db"
+	"github.com/web-stuff-98/electron-social-chat/pkg/db/models"
+	"github.com/web-stuff-98/electron-social-chat/pkg/socketmodels"
+	"github.com/web-stuff-98/electron-social-chat/pkg/socketserver"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	Sends scheduled messages and reminders once they are due.
+
+	Everything is stored in the scheduled messages collection, so nothing is
+	lost when the server restarts. Each message is claimed before it's sent
+	and deleted afterwards. If the server stops in between, the claim expires
+	and the message is sent again, up to maxAttempts times. Messages are sent
+	with an ID that was allocated when they were scheduled, so a message that
+	was sent before the server stopped isn't sent again.
+
+	Delivery is done by the handlers package, through the same code as the
+	ROOM_MESSAGE and DIRECT_MESSAGE socket events, so permissions are checked
+	when the message is sent rather than when it was scheduled.
+*/
+
+const (
+	dispatchInterval = time.Second * 5
+	maxAttempts      = 3
+)
+
+// How long a claim lasts before the message is sent again. Expired claims can also be deleted by the user.
+const ClaimTimeout = time.Minute
+
+// Sends a single scheduled message or reminder
+type Deliver func(msg models.ScheduledMessage) error
+
+func Init(ss *socketserver.SocketServer, colls *db.Collections, deliver Deliver) {
+	go dispatchLoop(ss, colls, deliver)
+}
+
+func dispatchLoop(ss *socketserver.SocketServer, colls *db.Collections, deliver Deliver) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			log.Println("Recovered from panic in message scheduler loop:", r)
+		}
+		go dispatchLoop(ss, colls, deliver)
+	}()
+	ticker := time.NewTicker(dispatchInterval)
+	for {
+		<-ticker.C
+		if err := dispatch(ss, colls, deliver, time.Now()); err != nil {
+			log.Println("Error sending scheduled messages:", err)
+		}
+	}
+}
+
+func dispatch(ss *socketserver.SocketServer, colls *db.Collections, deliver Deliver, now time.Time) error {
+	expiredClaim := primitive.NewDateTimeFromTime(now.Add(-ClaimTimeout))
+
+	// Messages that failed every attempt, the server stopped while sending them each time
+	if _, err := colls.ScheduledMessageCollection.DeleteMany(context.Background(), bson.M{
+		"attempts":   bson.M{"$gte": maxAttempts},
+		"claimed_at": bson.M{"$lte": expiredClaim},
+	}); err != nil {
+		return err
+	}
+
+	for {
+		msg := models.ScheduledMessage{}
+		if err := colls.ScheduledMessageCollection.FindOneAndUpdate(context.Background(), bson.M{
+			"send_at":  bson.M{"$lte": primitive.NewDateTimeFromTime(now)},
+			"attempts": bson.M{"$lt": maxAttempts},
+			"$or": bson.A{
+				bson.M{"claimed_at": bson.M{"$exists": false}},
+				bson.M{"claimed_at": bson.M{"$lte": expiredClaim}},
+			},
+		}, bson.M{
+			"$set": bson.M{"claimed_at": primitive.NewDateTimeFromTime(now)},
+			"$inc": bson.M{"attempts": 1},
+		}, options.FindOneAndUpdate().SetSort(bson.M{"send_at": 1})).Decode(&msg); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return nil
+			}
+			return err
+		}
+
+		deliverErr := deliver(msg)
+
+		if _, err := colls.ScheduledMessageCollection.DeleteOne(context.Background(), bson.M{"_id": msg.ID}); err != nil {
+			return err
+		}
+
+		if deliverErr != nil {
+			ss.SendDataToUser <- socketserver.UserDataMessage{
+				Uid:  msg.Uid,
+				Type: "SCHEDULED_FAILED",
+				Data: socketmodels.ScheduledDone{
+					ID:     msg.ID.Hex(),
+					Reason: deliverErr.Error(),
+				},
+			}
+		} else {
+			ss.SendDataToUser <- socketserver.UserDataMessage{
+				Uid:  msg.Uid,
+				Type: "SCHEDULED_SENT",
+				Data: socketmodels.ScheduledDone{ID: msg.ID.Hex()},
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package moderationsweeper
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/web-stuff-98/electron-social-chat/pkg/db"
+	"github.com/web-stuff-98/electron-social-chat/pkg/db/models"
+	"github.com/web-stuff-98/electron-social-chat/pkg/helpers"
+	"github.com/web-stuff-98/electron-social-chat/pkg/socketmodels"
+	"github.com/web-stuff-98/electron-social-chat/pkg/socketserver"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+	Lifts timed room bans and mutes once they expire, and sends out
+	UNBANNED/UNMUTED to the user and everyone watching the rooms channels,
+	the same as if a moderator had done it.
+*/
+
+const sweepInterval = time.Second * 10
+
+func Init(ss *socketserver.SocketServer, colls *db.Collections) {
+	go sweepLoop(ss, colls)
+}
+
+func sweepLoop(ss *socketserver.SocketServer, colls *db.Collections) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			log.Println("Recovered from panic in moderation sweep loop:", r)
+		}
+		go sweepLoop(ss, colls)
+	}()
+	ticker := time.NewTicker(sweepInterval)
+	for {
+		<-ticker.C
+		if err := sweep(ss, colls, time.Now()); err != nil {
+			log.Println("Error sweeping expired bans and mutes:", err)
+		}
+	}
+}
+
+func sweep(ss *socketserver.SocketServer, colls *db.Collections, now time.Time) error {
+	expiredFilter := bson.M{"expires_at": bson.M{"$lte": primitive.NewDateTimeFromTime(now)}}
+	cursor, err := colls.RoomExternalDataCollection.Find(context.Background(), bson.M{
+		"$or": bson.A{
+			bson.M{"ban_records": bson.M{"$elemMatch": expiredFilter}},
+			bson.M{"mutes": bson.M{"$elemMatch": expiredFilter}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	rooms := []models.RoomExternalData{}
+	if err := cursor.All(context.Background(), &rooms); err != nil {
+		return err
+	}
+
+	for _, r := range rooms {
+		expiredBans := []models.RoomRestriction{}
+		unbannedUids := []primitive.ObjectID{}
+		for _, ban := range r.BanRecords {
+			if helpers.RestrictionExpired(ban, now) {
+				expiredBans = append(expiredBans, ban)
+				unbannedUids = append(unbannedUids, ban.Uid)
+			}
+		}
+		expiredMutes := []models.RoomRestriction{}
+		for _, mute := range r.Mutes {
+			if helpers.RestrictionExpired(mute, now) {
+				expiredMutes = append(expiredMutes, mute)
+			}
+		}
+
+		if _, err := colls.RoomExternalDataCollection.UpdateByID(context.Background(), r.ID, bson.M{
+			"$pull": bson.M{
+				"banned":      bson.M{"$in": unbannedUids},
+				"ban_records": expiredFilter,
+				"mutes":       expiredFilter,
+			},
+		}); err != nil {
+			return err
+		}
+
+		uids, err := helpers.GetRoomChannelSubscriberUids(context.Background(), *colls, ss, r.ID)
+		if err != nil {
+			return err
+		}
+		for _, ban := range expiredBans {
+			recipients := copyUids(uids)
+			recipients[ban.Uid] = struct{}{}
+			recipients[ban.Moderator] = struct{}{}
+			ss.SendDataToUsers <- socketserver.UsersDataMessage{
+				Uids: recipients,
+				Data: socketmodels.Banned{
+					Banner: ban.Moderator.Hex(),
+					Banned: ban.Uid.Hex(),
+					RoomID: r.ID.Hex(),
+				},
+				Type: "UNBANNED",
+			}
+		}
+		for _, mute := range expiredMutes {
+			recipients := copyUids(uids)
+			recipients[mute.Uid] = struct{}{}
+			recipients[mute.Moderator] = struct{}{}
+			ss.SendDataToUsers <- socketserver.UsersDataMessage{
+				Uids: recipients,
+				Data: socketmodels.Muted{
+					Muter:  mute.Moderator.Hex(),
+					Muted:  mute.Uid.Hex(),
+					RoomID: r.ID.Hex(),
+				},
+				Type: "UNMUTED",
+			}
+		}
+	}
+
+	return nil
+}
+
+func copyUids(uids map[primitive.ObjectID]struct{}) map[primitive.ObjectID]struct{} {
+	out := make(map[primitive.ObjectID]struct{}, len(uids))
+	for oi := range uids {
+		out[oi] = struct{}{}
+	}
+	return out
+}
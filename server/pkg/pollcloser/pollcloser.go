@@ -0,0 +1,81 @@
+package pollcloser
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/web-stuff-98/electron-social-chat/pkg/db"
+	"github.com/web-stuff-98/electron-social-chat/pkg/db/models"
+	"github.com/web-stuff-98/electron-social-chat/pkg/helpers"
+	"github.com/web-stuff-98/electron-social-chat/pkg/socketmodels"
+	"github.com/web-stuff-98/electron-social-chat/pkg/socketserver"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+	Closes polls once their close time has passed, and sends the final
+	tallies to the channel. Votes are already refused after the close time,
+	this is so that clients find out the poll has closed.
+*/
+
+const closeInterval = time.Second * 10
+
+func Init(ss *socketserver.SocketServer, colls *db.Collections) {
+	go closeLoop(ss, colls)
+}
+
+func closeLoop(ss *socketserver.SocketServer, colls *db.Collections) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			log.Println("Recovered from panic in poll close loop:", r)
+		}
+		go closeLoop(ss, colls)
+	}()
+	ticker := time.NewTicker(closeInterval)
+	for {
+		<-ticker.C
+		if err := closeExpired(ss, colls, time.Now()); err != nil {
+			log.Println("Error closing expired polls:", err)
+		}
+	}
+}
+
+func closeExpired(ss *socketserver.SocketServer, colls *db.Collections, now time.Time) error {
+	cursor, err := colls.RoomMessageCollection.Find(context.Background(), bson.M{
+		"poll.closed":    false,
+		"poll.closes_at": bson.M{"$lte": primitive.NewDateTimeFromTime(now)},
+	})
+	if err != nil {
+		return err
+	}
+	expired := []models.RoomChannelMessage{}
+	if err := cursor.All(context.Background(), &expired); err != nil {
+		return err
+	}
+
+	for _, rcm := range expired {
+		msg, err := helpers.ClosePoll(context.Background(), colls.RoomMessageCollection, bson.M{"_id": rcm.ID})
+		if err != nil {
+			// Closed by someone else in the meantime
+			continue
+		}
+		outBytes, err := json.Marshal(socketmodels.OutPollUpdate{
+			Type: "OUT_POLL_UPDATE",
+			ID:   msg.ID.Hex(),
+			Poll: helpers.OutPoll(msg.Poll),
+		})
+		if err != nil {
+			return err
+		}
+		ss.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
+			Name: "channel:" + msg.ChannelID.Hex(),
+			Data: outBytes,
+		}
+	}
+
+	return nil
+}
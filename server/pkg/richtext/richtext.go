@@ -0,0 +1,209 @@
+package richtext
+
+import (
+	"strings"
+	"unicode"
+)
+
+/*
+	Parses the rich text subset used by messages into a tree of nodes that
+	is stored next to the raw content, so every client renders the same thing.
+
+	Supported:
+		```lang
+		code block
+		```
+		`inline code`
+		**bold**  *italic*  ~~strikethrough~~  ||spoiler||
+		\ escapes the next character
+
+	There is no HTML or links, text nodes are plain text and must be rendered
+	as text. Anything that isn't closed is left as it was written.
+*/
+
+const (
+	NodeText      = "text"
+	NodeLineBreak = "line_break"
+	NodeBold      = "bold"
+	NodeItalic    = "italic"
+	NodeStrike    = "strike"
+	NodeSpoiler   = "spoiler"
+	NodeCode      = "code"
+	NodeCodeBlock = "code_block"
+
+	// Deeper formatting is left as text
+	maxDepth = 8
+)
+
+type Node struct {
+	Type string `bson:"type" json:"type"`
+	// For text, code and code block nodes
+	Text string `bson:"text,omitempty" json:"text,omitempty"`
+	// The language written after the opening ``` of a code block, if any
+	Lang     string `bson:"lang,omitempty" json:"lang,omitempty"`
+	Children []Node `bson:"children,omitempty" json:"children,omitempty"`
+}
+
+// Inline delimiters, longest first so that ** is matched before *
+var delimiters = []struct {
+	marker   string
+	nodeType string
+}{
+	{"**", NodeBold},
+	{"~~", NodeStrike},
+	{"||", NodeSpoiler},
+	{"*", NodeItalic},
+}
+
+func Parse(content string) []Node {
+	content = sanitize(content)
+	nodes := []Node{}
+	for {
+		start := strings.Index(content, "```")
+		if start == -1 {
+			break
+		}
+		end := strings.Index(content[start+3:], "```")
+		if end == -1 {
+			break
+		}
+		end += start + 3
+		nodes = append(nodes, parseInline(content[:start], 0)...)
+		nodes = append(nodes, codeBlock(content[start+3:end]))
+		content = content[end+3:]
+	}
+	nodes = append(nodes, parseInline(content, 0)...)
+	return mergeText(nodes)
+}
+
+// Removes control characters and unicode line/paragraph separators other than newlines and tabs, and normalizes line endings
+func sanitize(content string) string {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if unicode.IsControl(r) || r == '\u2028' || r == '\u2029' {
+			return -1
+		}
+		return r
+	}, content)
+}
+
+// The first line is the language if there is text after the opening ``` on the same line
+func codeBlock(inner string) Node {
+	node := Node{Type: NodeCodeBlock}
+	if newline := strings.Index(inner, "\n"); newline != -1 {
+		lang := strings.TrimSpace(inner[:newline])
+		if lang != "" && !strings.ContainsAny(lang, " \t") && len(lang) <= 20 {
+			node.Lang = lang
+			inner = inner[newline+1:]
+		} else if lang == "" {
+			inner = inner[newline+1:]
+		}
+	}
+	node.Text = strings.TrimSuffix(inner, "\n")
+	return node
+}
+
+func parseInline(s string, depth int) []Node {
+	nodes := []Node{}
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			nodes = append(nodes, Node{Type: NodeText, Text: text.String()})
+			text.Reset()
+		}
+	}
+
+	for i := 0; i < len(s); {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) && strings.ContainsRune("\\`*~|", rune(s[i+1])) {
+				text.WriteByte(s[i+1])
+				i += 2
+				continue
+			}
+		case '\n':
+			flush()
+			nodes = append(nodes, Node{Type: NodeLineBreak})
+			i++
+			continue
+		case '`':
+			if end := strings.IndexByte(s[i+1:], '`'); end > 0 && !strings.Contains(s[i+1:i+1+end], "\n") {
+				flush()
+				nodes = append(nodes, Node{Type: NodeCode, Text: s[i+1 : i+1+end]})
+				i += end + 2
+				continue
+			}
+		}
+
+		if depth < maxDepth {
+			matched := false
+			for _, d := range delimiters {
+				if !strings.HasPrefix(s[i:], d.marker) {
+					continue
+				}
+				innerStart := i + len(d.marker)
+				end := findClosing(s[innerStart:], d.marker)
+				if end <= 0 {
+					break
+				}
+				flush()
+				nodes = append(nodes, Node{
+					Type:     d.nodeType,
+					Children: mergeText(parseInline(s[innerStart:innerStart+end], depth+1)),
+				})
+				i = innerStart + end + len(d.marker)
+				matched = true
+				break
+			}
+			if matched {
+				continue
+			}
+		}
+
+		text.WriteByte(s[i])
+		i++
+	}
+	flush()
+	return nodes
+}
+
+// The index of the closing marker, skipping escaped characters and inline code. -1 if it isn't closed.
+func findClosing(s string, marker string) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+			continue
+		case '`':
+			if end := strings.IndexByte(s[i+1:], '`'); end > 0 {
+				i += end + 1
+				continue
+			}
+		}
+		if strings.HasPrefix(s[i:], marker) {
+			// A single * next to another * is part of a ** marker
+			if marker == "*" && i+1 < len(s) && s[i+1] == '*' {
+				i++
+				continue
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+// Joins neighbouring text nodes, so the same content always gives the same tree
+func mergeText(nodes []Node) []Node {
+	out := []Node{}
+	for _, n := range nodes {
+		if n.Type == NodeText && len(out) > 0 && out[len(out)-1].Type == NodeText {
+			out[len(out)-1].Text += n.Text
+			continue
+		}
+		out = append(out, n)
+	}
+	return out
+}
@@ -0,0 +1,404 @@
+package roomcallserver
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/web-stuff-98/electron-social-chat/pkg/socketmodels"
+	"github.com/web-stuff-98/electron-social-chat/pkg/socketserver"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+	This is for room channel video chat. Any number of users can be in a
+	call, every participant is connected to every other participant, so
+	WebRTC signals are relayed between pairs of participants instead of
+	between a caller and a called user like in the callserver package.
+
+	Authorization (bans, private room membership) is checked by the socket
+	handlers before anything is sent to the channels here.
+
+	Media states are kept until the call ends (the last participant leaves),
+	so a participant that disconnects and rejoins gets their state back.
+*/
+
+type RoomCallServer struct {
+	// Mutex protected maps for the participants of room channel calls
+	Participants Participants
+	// Channel for joining a room channel call
+	JoinChan chan InJoin
+	// Channel for leaving whatever room channel call the user is in
+	LeaveChan chan primitive.ObjectID
+	// Channel for sending a WebRTC offer to another participant
+	SendOfferChan chan PeerSignal
+	// Channel for sending a WebRTC answer back to the participant that made the offer
+	SendAnswerChan chan PeerSignal
+	// Channel for requesting WebRTC re-initialization from another participant (necessary for changing/adding media devices)
+	RequestReInitializationChan chan PeerReInitialization
+	// Channel for mic/camera/screenshare changes, broadcast without renegotiation
+	MediaStateChan chan InMediaState
+	// Channel for removing a user from the call if it is in one of the given channels (used when banning)
+	KickChan chan InKick
+}
+
+/* --------------- MUTEX PROTECTED MAPS --------------- */
+type Participants struct {
+	// outer map key is channel ID, inner map key is participant uid
+	channels map[primitive.ObjectID]map[primitive.ObjectID]struct{}
+	// key is participant uid, value is the channel ID of the call they are in
+	users map[primitive.ObjectID]primitive.ObjectID
+	// outer map key is channel ID, inner map key is participant uid, value is the last media state they sent
+	mediaStates map[primitive.ObjectID]map[primitive.ObjectID]socketmodels.MediaState
+	mutex       sync.Mutex
+}
+
+/* --------------- STRUCTS --------------- */
+
+type InJoin struct {
+	Uid       primitive.ObjectID
+	ChannelID primitive.ObjectID
+}
+type PeerSignal struct {
+	From   primitive.ObjectID
+	To     primitive.ObjectID
+	Signal string
+
+	UserMediaStreamID string
+	UserMediaVid      bool
+	DisplayMediaVid   bool
+}
+type PeerReInitialization struct {
+	From primitive.ObjectID
+	To   primitive.ObjectID
+}
+type InKick struct {
+	Uid        primitive.ObjectID
+	ChannelIDs []primitive.ObjectID
+}
+type InMediaState struct {
+	Uid        primitive.ObjectID
+	MediaState socketmodels.MediaState
+}
+
+func Init(ss *socketserver.SocketServer, dc chan primitive.ObjectID) *RoomCallServer {
+	rcs := &RoomCallServer{
+		Participants: Participants{
+			channels:    make(map[primitive.ObjectID]map[primitive.ObjectID]struct{}),
+			users:       make(map[primitive.ObjectID]primitive.ObjectID),
+			mediaStates: make(map[primitive.ObjectID]map[primitive.ObjectID]socketmodels.MediaState),
+		},
+		JoinChan:                    make(chan InJoin),
+		LeaveChan:                   make(chan primitive.ObjectID),
+		SendOfferChan:               make(chan PeerSignal),
+		SendAnswerChan:              make(chan PeerSignal),
+		RequestReInitializationChan: make(chan PeerReInitialization),
+		MediaStateChan:              make(chan InMediaState),
+		KickChan:                    make(chan InKick),
+	}
+	runServer(ss, rcs, dc)
+	return rcs
+}
+
+func runServer(ss *socketserver.SocketServer, rcs *RoomCallServer, dc chan primitive.ObjectID) {
+	/* ----- Join call loop ----- */
+	go joinLoop(ss, rcs)
+	/* ----- Leave call loop ----- */
+	go leaveLoop(ss, rcs)
+	/* ----- Send webRTC offer to peer loop ----- */
+	go sendOfferLoop(ss, rcs)
+	/* ----- Send webRTC answer to peer loop ----- */
+	go sendAnswerLoop(ss, rcs)
+	/* ----- Peer request webRTC reinitialization loop ----- */
+	go requestReInitializationLoop(ss, rcs)
+	/* ----- Media state loop ----- */
+	go mediaStateLoop(ss, rcs)
+	/* ----- Kick loop ----- */
+	go kickLoop(ss, rcs)
+	/* ----- Socket disconnect registration loop ----- */
+	go socketDisconnectRegistrationLoop(ss, rcs, dc)
+}
+
+func joinLoop(ss *socketserver.SocketServer, rcs *RoomCallServer) {
+	for {
+		defer func() {
+			r := recover()
+			if r != nil {
+				log.Println("Recovered from panic in room call join loop:", r)
+			}
+			go joinLoop(ss, rcs)
+		}()
+		data := <-rcs.JoinChan
+		rcs.Participants.mutex.Lock()
+		if channelId, ok := rcs.Participants.users[data.Uid]; ok {
+			if channelId == data.ChannelID {
+				rcs.Participants.mutex.Unlock()
+				continue
+			}
+			// Users can only be in a single room call. Leave the previous one.
+			removeParticipant(ss, rcs, data.Uid)
+		}
+		uids := []string{}
+		mediaStates := make(map[string]socketmodels.MediaState)
+		for oi := range rcs.Participants.channels[data.ChannelID] {
+			uids = append(uids, oi.Hex())
+			if mediaState, ok := rcs.Participants.mediaStates[data.ChannelID][oi]; ok {
+				mediaStates[oi.Hex()] = mediaState
+			}
+		}
+		if rcs.Participants.channels[data.ChannelID] == nil {
+			rcs.Participants.channels[data.ChannelID] = make(map[primitive.ObjectID]struct{})
+		}
+		rcs.Participants.channels[data.ChannelID][data.Uid] = struct{}{}
+		rcs.Participants.users[data.Uid] = data.ChannelID
+		mediaState, rejoined := rcs.Participants.mediaStates[data.ChannelID][data.Uid]
+		rcs.Participants.mutex.Unlock()
+
+		// The user that joined sends offers to the participants that were already in the call
+		ss.SendDataToUser <- socketserver.UserDataMessage{
+			Uid:  data.Uid,
+			Type: "ROOM_CALL_PARTICIPANTS",
+			Data: socketmodels.RoomCallParticipants{
+				Channel:     data.ChannelID.Hex(),
+				Uids:        uids,
+				MediaStates: mediaStates,
+			},
+		}
+		sendParticipantChange(ss, "OUT_ROOM_CALL_PARTICIPANT_JOINED", data.Uid, data.ChannelID)
+		if rejoined {
+			// The user is rejoining a call that is still going, send everyone their last media state
+			sendMediaState(ss, data.Uid, data.ChannelID, mediaState)
+		}
+	}
+}
+
+func leaveLoop(ss *socketserver.SocketServer, rcs *RoomCallServer) {
+	for {
+		defer func() {
+			r := recover()
+			if r != nil {
+				log.Println("Recovered from panic in room call leave loop:", r)
+			}
+			go leaveLoop(ss, rcs)
+		}()
+		uid := <-rcs.LeaveChan
+		rcs.Participants.mutex.Lock()
+		removeParticipant(ss, rcs, uid)
+		rcs.Participants.mutex.Unlock()
+	}
+}
+
+func sendOfferLoop(ss *socketserver.SocketServer, rcs *RoomCallServer) {
+	for {
+		defer func() {
+			r := recover()
+			if r != nil {
+				log.Println("Recovered from panic in room call send offer loop:", r)
+			}
+			go sendOfferLoop(ss, rcs)
+		}()
+		data := <-rcs.SendOfferChan
+		rcs.Participants.mutex.Lock()
+		if inSameCall(rcs, data.From, data.To) {
+			ss.SendDataToUser <- socketserver.UserDataMessage{
+				Uid:  data.To,
+				Type: "ROOM_CALL_WEBRTC_OFFER_FROM_PEER",
+				Data: socketmodels.RoomCallWebRTCOfferAnswerFromPeer{
+					Uid:    data.From.Hex(),
+					Signal: data.Signal,
+
+					UserMediaStreamID: data.UserMediaStreamID,
+					UserMediaVid:      data.UserMediaVid,
+					DisplayMediaVid:   data.DisplayMediaVid,
+				},
+			}
+		}
+		rcs.Participants.mutex.Unlock()
+	}
+}
+
+func sendAnswerLoop(ss *socketserver.SocketServer, rcs *RoomCallServer) {
+	for {
+		defer func() {
+			r := recover()
+			if r != nil {
+				log.Println("Recovered from panic in room call send answer loop:", r)
+			}
+			go sendAnswerLoop(ss, rcs)
+		}()
+		data := <-rcs.SendAnswerChan
+		rcs.Participants.mutex.Lock()
+		if inSameCall(rcs, data.From, data.To) {
+			ss.SendDataToUser <- socketserver.UserDataMessage{
+				Uid:  data.To,
+				Type: "ROOM_CALL_WEBRTC_ANSWER_FROM_PEER",
+				Data: socketmodels.RoomCallWebRTCOfferAnswerFromPeer{
+					Uid:    data.From.Hex(),
+					Signal: data.Signal,
+
+					UserMediaStreamID: data.UserMediaStreamID,
+					UserMediaVid:      data.UserMediaVid,
+					DisplayMediaVid:   data.DisplayMediaVid,
+				},
+			}
+		}
+		rcs.Participants.mutex.Unlock()
+	}
+}
+
+func requestReInitializationLoop(ss *socketserver.SocketServer, rcs *RoomCallServer) {
+	for {
+		defer func() {
+			r := recover()
+			if r != nil {
+				log.Println("Recovered from panic in room call request re-initialization loop:", r)
+			}
+			go requestReInitializationLoop(ss, rcs)
+		}()
+		data := <-rcs.RequestReInitializationChan
+		rcs.Participants.mutex.Lock()
+		if inSameCall(rcs, data.From, data.To) {
+			ss.SendDataToUser <- socketserver.UserDataMessage{
+				Uid:  data.To,
+				Type: "ROOM_CALL_WEBRTC_REQUESTED_REINITIALIZATION",
+				Data: socketmodels.RoomCallWebRTCRequestedReInitialization{
+					Uid: data.From.Hex(),
+				},
+			}
+		}
+		rcs.Participants.mutex.Unlock()
+	}
+}
+
+func mediaStateLoop(ss *socketserver.SocketServer, rcs *RoomCallServer) {
+	for {
+		defer func() {
+			r := recover()
+			if r != nil {
+				log.Println("Recovered from panic in room call media state loop:", r)
+			}
+			go mediaStateLoop(ss, rcs)
+		}()
+		data := <-rcs.MediaStateChan
+		rcs.Participants.mutex.Lock()
+		channelId, ok := rcs.Participants.users[data.Uid]
+		if ok {
+			if rcs.Participants.mediaStates[channelId] == nil {
+				rcs.Participants.mediaStates[channelId] = make(map[primitive.ObjectID]socketmodels.MediaState)
+			}
+			rcs.Participants.mediaStates[channelId][data.Uid] = data.MediaState
+		}
+		rcs.Participants.mutex.Unlock()
+		if !ok {
+			continue
+		}
+		sendMediaState(ss, data.Uid, channelId, data.MediaState)
+	}
+}
+
+func kickLoop(ss *socketserver.SocketServer, rcs *RoomCallServer) {
+	for {
+		defer func() {
+			r := recover()
+			if r != nil {
+				log.Println("Recovered from panic in room call kick loop:", r)
+			}
+			go kickLoop(ss, rcs)
+		}()
+		data := <-rcs.KickChan
+		rcs.Participants.mutex.Lock()
+		if channelId, ok := rcs.Participants.users[data.Uid]; ok {
+			for _, oi := range data.ChannelIDs {
+				if oi == channelId {
+					removeParticipant(ss, rcs, data.Uid)
+					// The kicked user may no longer be subscribed to the channel, so tell them directly
+					ss.SendDataToUser <- socketserver.UserDataMessage{
+						Uid:  data.Uid,
+						Type: "OUT_ROOM_CALL_PARTICIPANT_LEFT",
+						Data: socketmodels.OutRoomCallParticipant{
+							Uid:     data.Uid.Hex(),
+							Channel: channelId.Hex(),
+						},
+					}
+					break
+				}
+			}
+		}
+		rcs.Participants.mutex.Unlock()
+	}
+}
+
+func socketDisconnectRegistrationLoop(ss *socketserver.SocketServer, rcs *RoomCallServer, dc chan primitive.ObjectID) {
+	for {
+		defer func() {
+			r := recover()
+			if r != nil {
+				log.Println("Recovered from panic in room call socket disconnect registration loop:", r)
+			}
+			go socketDisconnectRegistrationLoop(ss, rcs, dc)
+		}()
+		uid := <-dc
+		rcs.Participants.mutex.Lock()
+		removeParticipant(ss, rcs, uid)
+		rcs.Participants.mutex.Unlock()
+	}
+}
+
+// Participants mutex must be locked before calling
+func removeParticipant(ss *socketserver.SocketServer, rcs *RoomCallServer, uid primitive.ObjectID) {
+	channelId, ok := rcs.Participants.users[uid]
+	if !ok {
+		return
+	}
+	delete(rcs.Participants.users, uid)
+	delete(rcs.Participants.channels[channelId], uid)
+	if len(rcs.Participants.channels[channelId]) == 0 {
+		// The call has ended
+		delete(rcs.Participants.channels, channelId)
+		delete(rcs.Participants.mediaStates, channelId)
+	}
+	sendParticipantChange(ss, "OUT_ROOM_CALL_PARTICIPANT_LEFT", uid, channelId)
+}
+
+// Participants mutex must be locked before calling
+func inSameCall(rcs *RoomCallServer, a primitive.ObjectID, b primitive.ObjectID) bool {
+	if a == b {
+		return false
+	}
+	aChannel, aOk := rcs.Participants.users[a]
+	bChannel, bOk := rcs.Participants.users[b]
+	return aOk && bOk && aChannel == bChannel
+}
+
+func sendParticipantChange(ss *socketserver.SocketServer, eventType string, uid primitive.ObjectID, channelId primitive.ObjectID) {
+	outBytes, err := json.Marshal(socketmodels.OutRoomCallParticipant{
+		Type:    eventType,
+		Uid:     uid.Hex(),
+		Channel: channelId.Hex(),
+	})
+	if err != nil {
+		log.Println("Error marshaling room call participant change :", err)
+		return
+	}
+	ss.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
+		Name: "channel:" + channelId.Hex(),
+		Data: outBytes,
+	}
+}
+
+func sendMediaState(ss *socketserver.SocketServer, uid primitive.ObjectID, channelId primitive.ObjectID, mediaState socketmodels.MediaState) {
+	outBytes, err := json.Marshal(socketmodels.OutRoomCallMediaState{
+		Type:       "OUT_ROOM_CALL_MEDIA_STATE",
+		Uid:        uid.Hex(),
+		Channel:    channelId.Hex(),
+		MediaState: mediaState,
+	})
+	if err != nil {
+		log.Println("Error marshaling room call media state :", err)
+		return
+	}
+	ss.SendDataToSubscription <- socketserver.SubscriptionDataMessage{
+		Name: "channel:" + channelId.Hex(),
+		Data: outBytes,
+	}
+}
@@ -1,5 +1,10 @@
 package socketmodels
 
+import (
+	"github.com/web-stuff-98/electron-social-chat/pkg/linkpreview"
+	"github.com/web-stuff-98/electron-social-chat/pkg/richtext"
+)
+
 /*
 	Models for messages sent through the websocket, encoded into []bytes from json marshal
 
@@ -29,6 +34,19 @@ type RoomMessage struct {
 	Content       string `json:"content"`
 	Channel       string `json:"channel"`
 	HasAttachment bool   `json:"has_attachment"`
+	// Optional, the ID of a message in the same channel
+	ReplyTo string `json:"reply_to"`
+	// Parse the content as rich text
+	RichText bool `json:"rich_text"`
+	// Optional, makes the message a poll with the content as the question
+	Poll *RoomMessagePoll `json:"poll"`
+}
+
+type RoomMessagePoll struct {
+	Options        []string `json:"options"`
+	MultipleChoice bool     `json:"multiple_choice"`
+	// Optional, RFC3339
+	ClosesAt string `json:"closes_at"`
 }
 
 // TYPE: ROOM_MESSAGE_UPDATE
@@ -37,6 +55,18 @@ type RoomMessageUpdate struct {
 	Content string `json:"content"`
 	Channel string `json:"channel"`
 	ID      string `json:"ID"`
+	// Parse the content as rich text
+	RichText bool `json:"rich_text"`
+}
+
+// TYPE: ROOM_MESSAGE_REACT
+type RoomMessageReact struct {
+	Type    string `json:"TYPE"`
+	Channel string `json:"channel"`
+	ID      string `json:"ID"`
+	Emoji   string `json:"emoji"`
+	// Removes the users reaction instead of adding it
+	Remove bool `json:"remove"`
 }
 
 // TYPE: ROOM_MESSAGE_DELETE
@@ -53,13 +83,85 @@ type OutRoomMessage struct {
 	ID            string `json:"ID"`
 	Author        string `json:"author"`
 	HasAttachment bool   `json:"has_attachment"`
+	ReplyTo       string `json:"reply_to,omitempty"`
+	// Users mentioned by name
+	Mentions    []string        `json:"mentions,omitempty"`
+	MassMention string          `json:"mass_mention,omitempty"`
+	RichText    bool            `json:"rich_text"`
+	Rendered    []richtext.Node `json:"rendered,omitempty"`
+	// Set for forwarded messages
+	ForwardedFrom *ForwardOrigin `json:"forwarded_from,omitempty"`
+	// Set when the attachment belongs to another message, use it instead of the message ID to get the attachment
+	AttachmentID string               `json:"attachment_id,omitempty"`
+	LinkPreview  *linkpreview.Preview `json:"link_preview,omitempty"`
+	Poll         *Poll                `json:"poll,omitempty"`
+}
+
+type Poll struct {
+	Options        []PollOption `json:"options"`
+	MultipleChoice bool         `json:"multiple_choice"`
+	// RFC3339, omitted if the poll stays open until it's closed
+	ClosesAt string `json:"closes_at,omitempty"`
+	Closed   bool   `json:"closed"`
+}
+
+type PollOption struct {
+	Text string `json:"text"`
+	// The uids of the users that voted for the option
+	Votes []string `json:"votes"`
+}
+
+// TYPE: POLL_VOTE
+type PollVote struct {
+	Type    string `json:"TYPE"`
+	Channel string `json:"channel"`
+	ID      string `json:"ID"`
+	// The indexes of the options the user is voting for, replacing their previous votes. Empty to remove their votes.
+	Options []int `json:"options"`
 }
 
-// TYPE: OUT_ROOM_MESSAGE_UPDATE
-type OutRoomMessageUpdate struct {
+// TYPE: POLL_CLOSE
+type PollClose struct {
 	Type    string `json:"TYPE"`
-	Content string `json:"content"`
+	Channel string `json:"channel"`
+	ID      string `json:"ID"`
+}
+
+// TYPE: OUT_POLL_UPDATE
+type OutPollUpdate struct {
+	Type string `json:"TYPE"`
+	ID   string `json:"ID"`
+	Poll *Poll  `json:"poll"`
+}
+
+// TYPE: MENTION (no "TYPE" needed in model)
+type Mention struct {
 	ID      string `json:"ID"`
+	Channel string `json:"channel"`
+	RoomID  string `json:"room_id"`
+	Author  string `json:"author"`
+	Content string `json:"content"`
+	// "here" or "everyone" if the user wasn't mentioned by name
+	MassMention string `json:"mass_mention,omitempty"`
+}
+
+// TYPE: OUT_ROOM_MESSAGE_UPDATE
+type OutRoomMessageUpdate struct {
+	Type     string          `json:"TYPE"`
+	Content  string          `json:"content"`
+	ID       string          `json:"ID"`
+	Edited   bool            `json:"edited"`
+	RichText bool            `json:"rich_text"`
+	Rendered []richtext.Node `json:"rendered,omitempty"`
+	// nil if the reactions didn't change
+	Reactions *[]Reaction `json:"reactions,omitempty"`
+	// nil if there is no preview yet
+	LinkPreview *linkpreview.Preview `json:"link_preview,omitempty"`
+}
+
+type Reaction struct {
+	Emoji string   `json:"emoji"`
+	Uids  []string `json:"uids"`
 }
 
 // TYPE: OUT_ROOM_MESSAGE_DELETE
@@ -68,6 +170,13 @@ type OutRoomMessageDelete struct {
 	ID   string `json:"ID"`
 }
 
+// TYPE: OUT_ROOM_MESSAGE_REPLY_COUNT
+type OutRoomMessageReplyCount struct {
+	Type       string `json:"TYPE"`
+	ID         string `json:"ID"`
+	ReplyCount int    `json:"reply_count"`
+}
+
 /* -------- DIRECT MESSAGE, FRIEND REQUEST & INVITATION MODELS -------- */
 
 // TYPE: DIRECT_MESSAGE
@@ -76,6 +185,10 @@ type DirectMessage struct {
 	Content       string `json:"content"`
 	Recipient     string `json:"recipient"`
 	HasAttachment bool   `json:"has_attachment"`
+	// Optional, the ID of a message in the same conversation
+	ReplyTo string `json:"reply_to"`
+	// Parse the content as rich text
+	RichText bool `json:"rich_text"`
 }
 
 // TYPE: ROOM_INVITATION
@@ -120,6 +233,98 @@ type DirectMessageUpdate struct {
 	Content   string `json:"content"`
 	Recipient string `json:"recipient"`
 	ID        string `json:"ID"`
+	// Parse the content as rich text
+	RichText bool `json:"rich_text"`
+}
+
+// TYPE: DIRECT_MESSAGE_REACT
+type DirectMessageReact struct {
+	Type string `json:"TYPE"`
+	// The other user in the conversation
+	Uid   string `json:"uid"`
+	ID    string `json:"ID"`
+	Emoji string `json:"emoji"`
+	// Removes the users reaction instead of adding it
+	Remove bool `json:"remove"`
+}
+
+// TYPE: FORWARD_MESSAGE
+type ForwardMessage struct {
+	Type string `json:"TYPE"`
+	ID   string `json:"ID"`
+	// Set if the message is in a room channel
+	Channel string `json:"channel"`
+	// Set if the message is a direct message, the other user in the conversation
+	Uid string `json:"uid"`
+	// The channel to forward the message to
+	ToChannel string `json:"to_channel"`
+	// The user to forward the message to
+	ToUid string `json:"to_uid"`
+}
+
+type ForwardOrigin struct {
+	ID        string `json:"ID"`
+	Author    string `json:"author"`
+	CreatedAt string `json:"created_at"`
+	Channel   string `json:"channel,omitempty"`
+	RoomID    string `json:"room_id,omitempty"`
+}
+
+// TYPE: PIN/UNPIN
+type Pin struct {
+	Type string `json:"TYPE"`
+	ID   string `json:"ID"`
+	// Set for room messages
+	Channel string `json:"channel"`
+	// Set for direct messages, the other user in the conversation
+	Uid string `json:"uid"`
+}
+
+// TYPE: PINNED/UNPINNED
+type Pinned struct {
+	Type    string `json:"TYPE"`
+	ID      string `json:"ID"`
+	Channel string `json:"channel,omitempty"`
+	// For direct messages, the other user in the conversation
+	Uid string `json:"uid,omitempty"`
+	// The user that pinned or unpinned the message
+	By string `json:"by"`
+}
+
+// TYPE: MARK_READ
+type MarkRead struct {
+	Type string `json:"TYPE"`
+	// The newest message the user has seen
+	ID string `json:"ID"`
+	// Set for room messages
+	Channel string `json:"channel"`
+	// Set for direct messages, the other user in the conversation
+	Uid string `json:"uid"`
+}
+
+// TYPE: READ_RECEIPT (no "TYPE" needed in model)
+type ReadReceipt struct {
+	// The user that read the message
+	Uid string `json:"uid"`
+	ID  string `json:"ID"`
+}
+
+// TYPE: TYPING_START/TYPING_STOP
+type Typing struct {
+	Type string `json:"TYPE"`
+	// Set for room channels
+	Channel string `json:"channel"`
+	// Set for conversations, the other user in the conversation
+	Uid string `json:"uid"`
+}
+
+// TYPE: TYPING_START/TYPING_STOP
+type OutTyping struct {
+	Type string `json:"TYPE"`
+	// The user typing
+	Uid string `json:"uid"`
+	// Omitted for conversations
+	Channel string `json:"channel,omitempty"`
 }
 
 // TYPE: DIRECT_MESSAGE_DELETE
@@ -131,20 +336,42 @@ type DirectMessageDelete struct {
 
 // TYPE: OUT_DIRECT_MESSAGE (no "TYPE" needed in model)
 type OutDirectMessage struct {
-	Content       string `json:"content"`
-	ID            string `json:"ID"`
-	Author        string `json:"author"`
-	Recipient     string `json:"recipient"`
-	HasAttachment bool   `json:"has_attachment"`
+	Content       string          `json:"content"`
+	ID            string          `json:"ID"`
+	Author        string          `json:"author"`
+	Recipient     string          `json:"recipient"`
+	HasAttachment bool            `json:"has_attachment"`
+	MissedCall    bool            `json:"missed_call"`
+	ReplyTo       string          `json:"reply_to,omitempty"`
+	RichText      bool            `json:"rich_text"`
+	Rendered      []richtext.Node `json:"rendered,omitempty"`
+	// Set for forwarded messages
+	ForwardedFrom *ForwardOrigin `json:"forwarded_from,omitempty"`
+	// Set when the attachment belongs to another message, use it instead of the message ID to get the attachment
+	AttachmentID string               `json:"attachment_id,omitempty"`
+	LinkPreview  *linkpreview.Preview `json:"link_preview,omitempty"`
+}
+
+// TYPE: OUT_DIRECT_MESSAGE_REPLY_COUNT (no "TYPE" needed in model)
+type OutDirectMessageReplyCount struct {
+	ID         string `json:"ID"`
+	ReplyCount int    `json:"reply_count"`
 }
 
 // TYPE: OUT_DIRECT_MESSAGE_UPDATE
 type OutDirectMessageUpdate struct {
-	Type      string `json:"TYPE"`
-	Content   string `json:"content"`
-	ID        string `json:"ID"`
-	Author    string `json:"author"`
-	Recipient string `json:"recipient"`
+	Type      string          `json:"TYPE"`
+	Content   string          `json:"content"`
+	ID        string          `json:"ID"`
+	Author    string          `json:"author"`
+	Recipient string          `json:"recipient"`
+	Edited    bool            `json:"edited"`
+	RichText  bool            `json:"rich_text"`
+	Rendered  []richtext.Node `json:"rendered,omitempty"`
+	// nil if the reactions didn't change
+	Reactions *[]Reaction `json:"reactions,omitempty"`
+	// nil if there is no preview yet
+	LinkPreview *linkpreview.Preview `json:"link_preview,omitempty"`
 }
 
 // TYPE: OUT_DIRECT_MESSAGE_DELETE
@@ -206,6 +433,65 @@ type OutFriendRequestResponse struct {
 	Recipient string `json:"recipient"`
 }
 
+/* -------- SCHEDULED MESSAGES & REMINDERS -------- */
+
+// TYPE: SCHEDULE_MESSAGE
+type ScheduleMessage struct {
+	Type    string `json:"TYPE"`
+	Content string `json:"content"`
+	// Set for room messages
+	Channel string `json:"channel"`
+	// Set for direct messages
+	Recipient string `json:"recipient"`
+	// Optional, the ID of a message in the same channel or conversation
+	ReplyTo  string `json:"reply_to"`
+	RichText bool   `json:"rich_text"`
+	// RFC3339
+	SendAt string `json:"send_at"`
+}
+
+// TYPE: SCHEDULE_REMINDER
+type ScheduleReminder struct {
+	Type string `json:"TYPE"`
+	ID   string `json:"ID"`
+	// Set for room messages
+	Channel string `json:"channel"`
+	// Set for direct messages, the other user in the conversation
+	Uid string `json:"uid"`
+	// Optional
+	Note string `json:"note"`
+	// RFC3339
+	RemindAt string `json:"remind_at"`
+}
+
+// TYPE: SCHEDULED_DELETE
+type ScheduledDelete struct {
+	Type string `json:"TYPE"`
+	ID   string `json:"ID"`
+}
+
+// TYPE: SCHEDULED_SENT/SCHEDULED_FAILED/SCHEDULED_DELETED (no "TYPE" needed in model)
+type ScheduledDone struct {
+	ID string `json:"ID"`
+	// Why the message couldn't be sent, for SCHEDULED_FAILED
+	Reason string `json:"reason,omitempty"`
+}
+
+// TYPE: REMINDER (no "TYPE" needed in model)
+type Reminder struct {
+	// The ID of the reminder
+	ID    string `json:"ID"`
+	MsgID string `json:"msg_id"`
+	// Set for room messages
+	Channel string `json:"channel,omitempty"`
+	RoomID  string `json:"room_id,omitempty"`
+	// Set for direct messages, the other user in the conversation
+	Uid     string `json:"uid,omitempty"`
+	Author  string `json:"author"`
+	Content string `json:"content"`
+	Note    string `json:"note,omitempty"`
+}
+
 /* -------- ATTACHMENT EVENTS -------- */
 
 // TYPE: ATTACHMENT_PROGRESS (no "TYPE" needed in model)
@@ -244,6 +530,9 @@ type Ban struct {
 	Type   string `json:"TYPE"`
 	Uid    string `json:"uid"`
 	RoomID string `json:"room_id"`
+	Reason string `json:"reason"`
+	// Seconds, 0 for a permanent ban. Not used for UNBAN.
+	Duration int `json:"duration"`
 }
 
 // TYPE: BANNED/UNBANNED (no "TYPE" needed in model)
@@ -251,6 +540,43 @@ type Banned struct {
 	Banned string `json:"banned"`
 	Banner string `json:"banner"`
 	RoomID string `json:"room_id"`
+	Reason string `json:"reason,omitempty"`
+	// RFC3339, empty if the ban is permanent
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// TYPE: MUTE/UNMUTE
+type Mute struct {
+	Type   string `json:"TYPE"`
+	Uid    string `json:"uid"`
+	RoomID string `json:"room_id"`
+	Reason string `json:"reason"`
+	// Seconds, 0 for a permanent mute. Not used for UNMUTE.
+	Duration int `json:"duration"`
+}
+
+// TYPE: MUTED/UNMUTED (no "TYPE" needed in model)
+type Muted struct {
+	Muted  string `json:"muted"`
+	Muter  string `json:"muter"`
+	RoomID string `json:"room_id"`
+	Reason string `json:"reason,omitempty"`
+	// RFC3339, empty if the mute is permanent
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// TYPE: KICK
+type Kick struct {
+	Type   string `json:"TYPE"`
+	Uid    string `json:"uid"`
+	RoomID string `json:"room_id"`
+}
+
+// TYPE: KICKED (no "TYPE" needed in model)
+type Kicked struct {
+	Kicked string `json:"kicked"`
+	Kicker string `json:"kicker"`
+	RoomID string `json:"room_id"`
 }
 
 // TYPE: BLOCKED/UNBLOCKED (no "TYPE" needed in model)
@@ -280,6 +606,13 @@ type CallResponse struct {
 	Accept bool   `json:"accept"`
 }
 
+// TYPE: CALL_TIMEOUT (no "TYPE" needed in model)
+// Sent to both users when a call goes unanswered
+type CallTimeout struct {
+	Caller string `json:"caller"`
+	Called string `json:"called"`
+}
+
 // TYPE: CALL_LEAVE
 type CallLeave struct {
 	Type string `json:"TYPE"`
@@ -324,6 +657,103 @@ type CallWebRTCRequestReInitialization struct {
 // TYPE: CALL_WEBRTC_REQUESTED_REINITIALIZATION (no "TYPE" needed in model)
 type CallWebRTCRequestedReInitialization struct{}
 
+// Embedded in media state events, and stored by the call servers
+type MediaState struct {
+	Mic         bool `json:"mic"`
+	Camera      bool `json:"camera"`
+	ScreenShare bool `json:"screen_share"`
+}
+
+// TYPE: CALL_MEDIA_STATE
+type CallMediaState struct {
+	Type string `json:"TYPE"`
+	MediaState
+}
+
+// TYPE: CALL_MEDIA_STATE_FROM_PEER (no "TYPE" needed in model)
+// Also sent after an offer or answer is relayed, so the peer gets the last known state back when reconnecting
+type CallMediaStateFromPeer struct {
+	Uid string `json:"uid"`
+	MediaState
+}
+
+/* -------- ROOM CALL EVENTS -------- */
+
+// TYPE: ROOM_CALL_JOIN
+type RoomCallJoin struct {
+	Type    string `json:"TYPE"`
+	Channel string `json:"channel"`
+}
+
+// TYPE: ROOM_CALL_LEAVE
+type RoomCallLeave struct {
+	Type string `json:"TYPE"`
+}
+
+// TYPE: ROOM_CALL_PARTICIPANTS (no "TYPE" needed in model)
+// Sent to the user that joined, contains the uids of everyone else in the call
+// and the last known media state of each participant (keyed by uid)
+type RoomCallParticipants struct {
+	Channel     string                `json:"channel"`
+	Uids        []string              `json:"uids"`
+	MediaStates map[string]MediaState `json:"media_states"`
+}
+
+// TYPE: OUT_ROOM_CALL_PARTICIPANT_JOINED/OUT_ROOM_CALL_PARTICIPANT_LEFT
+type OutRoomCallParticipant struct {
+	Type    string `json:"TYPE"`
+	Uid     string `json:"uid"`
+	Channel string `json:"channel"`
+}
+
+// TYPE: ROOM_CALL_WEBRTC_OFFER/ROOM_CALL_WEBRTC_ANSWER
+// Uid is the participant the signal is for
+type RoomCallWebRTCOfferAnswer struct {
+	Type   string `json:"TYPE"`
+	Uid    string `json:"uid"`
+	Signal string `json:"signal"`
+
+	UserMediaStreamID string `json:"um_stream_id"`
+	UserMediaVid      bool   `json:"um_vid"`
+	DisplayMediaVid   bool   `json:"dm_vid"`
+}
+
+// TYPE: ROOM_CALL_WEBRTC_OFFER_FROM_PEER/ROOM_CALL_WEBRTC_ANSWER_FROM_PEER (no "TYPE" needed in model)
+// Uid is the participant the signal came from
+type RoomCallWebRTCOfferAnswerFromPeer struct {
+	Uid    string `json:"uid"`
+	Signal string `json:"signal"`
+
+	UserMediaStreamID string `json:"um_stream_id"`
+	UserMediaVid      bool   `json:"um_vid"`
+	DisplayMediaVid   bool   `json:"dm_vid"`
+}
+
+// TYPE: ROOM_CALL_WEBRTC_REQUEST_REINITIALIZATION
+type RoomCallWebRTCRequestReInitialization struct {
+	Type string `json:"TYPE"`
+	Uid  string `json:"uid"`
+}
+
+// TYPE: ROOM_CALL_WEBRTC_REQUESTED_REINITIALIZATION (no "TYPE" needed in model)
+type RoomCallWebRTCRequestedReInitialization struct {
+	Uid string `json:"uid"`
+}
+
+// TYPE: ROOM_CALL_MEDIA_STATE
+type RoomCallMediaState struct {
+	Type string `json:"TYPE"`
+	MediaState
+}
+
+// TYPE: OUT_ROOM_CALL_MEDIA_STATE
+type OutRoomCallMediaState struct {
+	Type    string `json:"TYPE"`
+	Uid     string `json:"uid"`
+	Channel string `json:"channel"`
+	MediaState
+}
+
 /* -------- MISC -------- */
 
 // TYPE: CHANGE
@@ -112,7 +112,7 @@ type GetSubscriptionUids struct {
 	Name     string
 }
 
-func Init(colls *db.Collections, disconnectCallChan chan primitive.ObjectID) (*SocketServer, error) {
+func Init(colls *db.Collections, disconnectCallChan chan primitive.ObjectID, disconnectRoomCallChan chan primitive.ObjectID) (*SocketServer, error) {
 	socketServer := &SocketServer{
 		Connections: Connections{
 			data: make(map[*websocket.Conn]primitive.ObjectID),
@@ -144,15 +144,15 @@ func Init(colls *db.Collections, disconnectCallChan chan primitive.ObjectID) (*S
 		SendDataToUser:  make(chan UserDataMessage),
 		SendDataToUsers: make(chan UsersDataMessage),
 	}
-	runServer(socketServer, colls, disconnectCallChan)
+	runServer(socketServer, colls, disconnectCallChan, disconnectRoomCallChan)
 	return socketServer, nil
 }
 
-func runServer(socketServer *SocketServer, colls *db.Collections, disconnectCallChan chan primitive.ObjectID) {
+func runServer(socketServer *SocketServer, colls *db.Collections, disconnectCallChan chan primitive.ObjectID, disconnectRoomCallChan chan primitive.ObjectID) {
 	/* ----- Connection registration ----- */
 	go connectionRegistrationLoop(socketServer, colls)
 	/* ----- Disconnect registration ----- */
-	go disconnectRegistrationLoop(socketServer, colls, disconnectCallChan)
+	go disconnectRegistrationLoop(socketServer, colls, disconnectCallChan, disconnectRoomCallChan)
 	/* ----- Send messages in queue ----- */
 	go messageQueueLoop(socketServer, colls)
 	/* ----- Subscription connection registration (also check the authorization if subscription requires it) ----- */
@@ -209,14 +209,14 @@ func connectionRegistrationLoop(socketServer *SocketServer, colls *db.Collection
 	}
 }
 
-func disconnectRegistrationLoop(socketServer *SocketServer, colls *db.Collections, disconnectCallChan chan primitive.ObjectID) {
+func disconnectRegistrationLoop(socketServer *SocketServer, colls *db.Collections, disconnectCallChan chan primitive.ObjectID, disconnectRoomCallChan chan primitive.ObjectID) {
 	for {
 		defer func() {
 			r := recover()
 			if r != nil {
 				log.Println("Recovered from panic in WS deregistration :", r)
 			}
-			go disconnectRegistrationLoop(socketServer, colls, disconnectCallChan)
+			go disconnectRegistrationLoop(socketServer, colls, disconnectCallChan, disconnectRoomCallChan)
 		}()
 		connData := <-socketServer.UnregisterConn
 		socketServer.Connections.mutex.Lock()
@@ -252,6 +252,7 @@ func disconnectRegistrationLoop(socketServer *SocketServer, colls *db.Collection
 		}
 
 		disconnectCallChan <- connData.Uid
+		disconnectRoomCallChan <- connData.Uid
 
 		socketServer.Connections.mutex.Unlock()
 		socketServer.Subscriptions.mutex.Unlock()
@@ -545,18 +546,21 @@ func removeUserFromSubscriptionLoop(socketServer *SocketServer, colls *db.Collec
 			go removeUserFromSubscriptionLoop(socketServer, colls)
 		}()
 		data := <-socketServer.RemoveUserFromSubscription
-		socketServer.Subscriptions.mutex.RLock()
+		socketServer.Subscriptions.mutex.Lock()
+		socketServer.ConnectionSubscriptionCount.mutex.Lock()
 		if subs, ok := socketServer.Subscriptions.data[data.Name]; ok {
+			// The user could have the subscription open on more than one connection
 			for c, oi := range subs {
 				if oi == data.Uid {
-					socketServer.Subscriptions.mutex.Lock()
-					delete(socketServer.Subscriptions.data[data.Name], c)
-					socketServer.Subscriptions.mutex.Unlock()
-					break
+					delete(subs, c)
+					if _, ok := socketServer.ConnectionSubscriptionCount.data[c]; ok {
+						socketServer.ConnectionSubscriptionCount.data[c]--
+					}
 				}
 			}
 		}
-		socketServer.Subscriptions.mutex.RUnlock()
+		socketServer.ConnectionSubscriptionCount.mutex.Unlock()
+		socketServer.Subscriptions.mutex.Unlock()
 	}
 }
 
@@ -0,0 +1,186 @@
+package typingserver
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/web-stuff-98/electron-social-chat/pkg/socketmodels"
+	"github.com/web-stuff-98/electron-social-chat/pkg/socketserver"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+	Typing indicators for room channels and conversations.
+
+	Clients send TYPING_START while the user is typing. If they don't send
+	TYPING_STOP, or another TYPING_START, before the timeout the user stops
+	typing anyway, so a closed client doesn't leave someone typing forever.
+
+	Permissions and blocks are checked by the socket event handlers. The users
+	that shouldn't see the indicator are stored with it, so that the TYPING_STOP
+	goes to the same users as the TYPING_START.
+*/
+
+const (
+	TypingTimeout  = time.Second * 6
+	expiryInterval = time.Second
+)
+
+type TypingServer struct {
+	// Users currently typing
+	Typing Typing
+	// Channel for starting or refreshing typing
+	StartChan chan InTyping
+	// Channel for stopping typing
+	StopChan chan InTyping
+}
+
+/* --------------- MUTEX PROTECTED MAPS --------------- */
+type Typing struct {
+	data  map[Typist]TypingState
+	mutex sync.Mutex
+}
+
+/* --------------- STRUCTS --------------- */
+
+type Typist struct {
+	Uid primitive.ObjectID
+	// The channel ID, or the other user for conversations
+	Target primitive.ObjectID
+}
+type TypingState struct {
+	IsChannel bool
+	Exclude   map[primitive.ObjectID]bool
+	ExpiresAt time.Time
+}
+type InTyping struct {
+	Uid primitive.ObjectID
+	// The channel ID, or the other user for conversations
+	Target    primitive.ObjectID
+	IsChannel bool
+	// Channel subscribers that shouldn't see the typing indicator. Not used for TYPING_STOP.
+	Exclude map[primitive.ObjectID]bool
+}
+
+func Init(ss *socketserver.SocketServer) *TypingServer {
+	ts := &TypingServer{
+		Typing: Typing{
+			data: make(map[Typist]TypingState),
+		},
+		StartChan: make(chan InTyping),
+		StopChan:  make(chan InTyping),
+	}
+	runServer(ss, ts)
+	return ts
+}
+
+func runServer(ss *socketserver.SocketServer, ts *TypingServer) {
+	/* ----- Typing start loop ----- */
+	go typingStartLoop(ss, ts)
+	/* ----- Typing stop loop ----- */
+	go typingStopLoop(ss, ts)
+	/* ----- Typing expiry loop ----- */
+	go typingExpiryLoop(ss, ts)
+}
+
+func typingStartLoop(ss *socketserver.SocketServer, ts *TypingServer) {
+	for {
+		defer func() {
+			r := recover()
+			if r != nil {
+				log.Println("Recovered from panic in typing start loop:", r)
+			}
+			go typingStartLoop(ss, ts)
+		}()
+		data := <-ts.StartChan
+		typist := Typist{Uid: data.Uid, Target: data.Target}
+		ts.Typing.mutex.Lock()
+		_, alreadyTyping := ts.Typing.data[typist]
+		ts.Typing.data[typist] = TypingState{
+			IsChannel: data.IsChannel,
+			Exclude:   data.Exclude,
+			ExpiresAt: time.Now().Add(TypingTimeout),
+		}
+		// Only the first TYPING_START is sent out, the rest just keep it from expiring
+		if !alreadyTyping {
+			sendTyping(ss, "TYPING_START", typist, ts.Typing.data[typist])
+		}
+		ts.Typing.mutex.Unlock()
+	}
+}
+
+func typingStopLoop(ss *socketserver.SocketServer, ts *TypingServer) {
+	for {
+		defer func() {
+			r := recover()
+			if r != nil {
+				log.Println("Recovered from panic in typing stop loop:", r)
+			}
+			go typingStopLoop(ss, ts)
+		}()
+		data := <-ts.StopChan
+		typist := Typist{Uid: data.Uid, Target: data.Target}
+		ts.Typing.mutex.Lock()
+		if state, ok := ts.Typing.data[typist]; ok {
+			delete(ts.Typing.data, typist)
+			sendTyping(ss, "TYPING_STOP", typist, state)
+		}
+		ts.Typing.mutex.Unlock()
+	}
+}
+
+func typingExpiryLoop(ss *socketserver.SocketServer, ts *TypingServer) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			log.Println("Recovered from panic in typing expiry loop:", r)
+		}
+		go typingExpiryLoop(ss, ts)
+	}()
+	ticker := time.NewTicker(expiryInterval)
+	for {
+		<-ticker.C
+		now := time.Now()
+		ts.Typing.mutex.Lock()
+		for typist, state := range ts.Typing.data {
+			if now.After(state.ExpiresAt) {
+				delete(ts.Typing.data, typist)
+				sendTyping(ss, "TYPING_STOP", typist, state)
+			}
+		}
+		ts.Typing.mutex.Unlock()
+	}
+}
+
+func sendTyping(ss *socketserver.SocketServer, eventType string, typist Typist, state TypingState) {
+	if !state.IsChannel {
+		ss.SendDataToUser <- socketserver.UserDataMessage{
+			Uid:  typist.Target,
+			Type: eventType,
+			Data: socketmodels.OutTyping{Uid: typist.Uid.Hex()},
+		}
+		return
+	}
+	outBytes, err := json.Marshal(socketmodels.OutTyping{
+		Type:    eventType,
+		Uid:     typist.Uid.Hex(),
+		Channel: typist.Target.Hex(),
+	})
+	if err != nil {
+		log.Println("Error encoding typing event:", err)
+		return
+	}
+	exclude := make(map[primitive.ObjectID]bool)
+	for oi := range state.Exclude {
+		exclude[oi] = true
+	}
+	// Users don't need to see themselves typing
+	exclude[typist.Uid] = true
+	ss.SendDataToSubscriptionExclusive <- socketserver.ExclusiveSubscriptionDataMessage{
+		Name:    "channel:" + typist.Target.Hex(),
+		Data:    outBytes,
+		Exclude: exclude,
+	}
+}
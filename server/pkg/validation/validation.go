@@ -14,13 +14,33 @@ type UserSearch struct {
 	Username string `json:"username" validate:"max=16"`
 }
 
+type MessageSearch struct {
+	Query string `json:"query" validate:"required,max=100"`
+	// Optional, limits a room search to one channel
+	Channel string `json:"channel"`
+	// Optional, limits a direct message search to the conversation with one user
+	Uid    string `json:"uid"`
+	Author string `json:"author"`
+	// Optional, RFC3339
+	After  string `json:"after"`
+	Before string `json:"before"`
+}
+
 type UpdateRoomChannelData struct {
 	ID   string `json:"ID"`
 	Name string `json:"name"`
+
+	ReadOnly      bool `json:"read_only"`
+	Hidden        bool `json:"hidden"`
+	NoAttachments bool `json:"no_attachments"`
 }
 type InsertRoomChannelData struct {
 	Name          string `json:"name" validate:"required,max=24"`
 	PromoteToMain bool   `json:"promote_to_main"`
+
+	ReadOnly      bool `json:"read_only"`
+	Hidden        bool `json:"hidden"`
+	NoAttachments bool `json:"no_attachments"`
 }
 type UpdateRoomChannelsData struct {
 	UpdateData    []UpdateRoomChannelData `json:"update_data"`
@@ -29,6 +49,16 @@ type UpdateRoomChannelsData struct {
 	PromoteToMain string                  `json:"promote_to_main"`
 }
 
+type RoomRole struct {
+	Name        string `json:"name" validate:"required,min=2,max=16"`
+	Permissions uint32 `json:"permissions"`
+}
+type RoomRoleAssignment struct {
+	Uid string `json:"uid" validate:"required"`
+	// Empty string to give the user the default role
+	RoleID string `json:"role_id"`
+}
+
 type AttachmentMetadata struct {
 	ID       string `json:"ID"`
 	MimeType string `json:"mime_type"`